@@ -1,6 +1,6 @@
 module github.com/influxdata/pkg-config
 
-go 1.12
+go 1.17
 
 require (
 	github.com/Masterminds/semver v1.4.2
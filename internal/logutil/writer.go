@@ -5,12 +5,33 @@ import (
 	"io"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
+// maxLineSize is the longest line that will be logged. The linker
+// command cargo prints when linking fails easily exceeds the default
+// limit of the scanner.
+const maxLineSize = 1024 * 1024
+
+// LogOutput logs each line of the output as a separate record
+// in the order the lines were written.
 func LogOutput(r io.Reader, l *zap.Logger) error {
+	return logLines(r, l, zapcore.InfoLevel)
+}
+
+// LogFailureOutput logs each line of the output of a failed command
+// as a separate warning so the output is reported with the failure.
+func LogFailureOutput(r io.Reader, l *zap.Logger) error {
+	return logLines(r, l, zapcore.WarnLevel)
+}
+
+func logLines(r io.Reader, l *zap.Logger, level zapcore.Level) error {
 	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxLineSize)
 	for s.Scan() {
-		l.Info(s.Text())
+		if ce := l.Check(level, s.Text()); ce != nil {
+			ce.Write()
+		}
 	}
 	return s.Err()
 }
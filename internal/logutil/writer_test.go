@@ -0,0 +1,58 @@
+package logutil
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogOutput(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+	output := "   Compiling flux v0.194.3\n" +
+		"error[E0308]: mismatched types\n" +
+		"  --> src/lib.rs:1:1\n" +
+		long + "\n" +
+		"error: could not compile `flux`"
+
+	core, logs := observer.New(zap.InfoLevel)
+	if err := LogOutput(strings.NewReader(output), zap.New(core)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var got []string
+	for _, entry := range logs.All() {
+		got = append(got, entry.Message)
+	}
+	want := []string{
+		"   Compiling flux v0.194.3",
+		"error[E0308]: mismatched types",
+		"  --> src/lib.rs:1:1",
+		long,
+		"error: could not compile `flux`",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected records: got %d, want %d in order", len(got), len(want))
+	}
+}
+
+func TestLogFailureOutput(t *testing.T) {
+	output := "error[E0308]: mismatched types\nerror: could not compile `flux`\n"
+
+	core, logs := observer.New(zap.InfoLevel)
+	if err := LogFailureOutput(strings.NewReader(output), zap.New(core)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	entries := logs.All()
+	if len(entries) != 2 {
+		t.Fatalf("unexpected number of records: got %d, want 2", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Level != zap.WarnLevel {
+			t.Errorf("unexpected level for %q: got %s, want %s", entry.Message, entry.Level, zap.WarnLevel)
+		}
+	}
+}
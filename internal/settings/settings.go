@@ -0,0 +1,142 @@
+// Package settings declares the environment variables that configure
+// the wrapper. Each setting is declared once with New and is read
+// through the returned Setting so every setting the wrapper uses can
+// be listed along with where its value came from.
+package settings
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// The sources of the value of a setting.
+const (
+	SourceDefault = "default"
+	SourceEnv     = "env"
+	SourceFile    = "file"
+)
+
+// Setting is an environment variable that configures the wrapper.
+type Setting struct {
+	// Name is the name of the environment variable.
+	Name string
+
+	// Default is the value used when the variable is empty or unset.
+	Default string
+}
+
+// fileValue is the value of an environment variable
+// that was read from a file and the path to the file.
+type fileValue struct {
+	value, path string
+}
+
+var (
+	mu       sync.Mutex
+	declared = map[string]*Setting{}
+	files    = map[string]fileValue{}
+)
+
+// New declares the setting for the environment variable.
+// It panics if the setting has already been declared.
+func New(name, def string) *Setting {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := declared[name]; ok {
+		panic(fmt.Sprintf("setting %s declared more than once", name))
+	}
+	s := &Setting{Name: name, Default: def}
+	declared[name] = s
+	return s
+}
+
+// Get returns the value of the environment variable
+// or the default when it is empty or unset.
+func (s *Setting) Get() string {
+	if v := os.Getenv(s.Name); v != "" {
+		return v
+	}
+	return s.Default
+}
+
+// Lookup returns the value of the environment
+// variable and whether it is set.
+func (s *Setting) Lookup() (string, bool) {
+	return os.LookupEnv(s.Name)
+}
+
+// Value returns the effective value of the setting and its source.
+// A variable that is set, even to an empty value, is reported as is.
+func (s *Setting) Value() (value, source string) {
+	v, ok := os.LookupEnv(s.Name)
+	if !ok {
+		return s.Default, SourceDefault
+	}
+	if _, ok := FilePath(s.Name); ok {
+		return v, SourceFile
+	}
+	return v, SourceEnv
+}
+
+// All returns the declared settings sorted by name.
+func All() []*Setting {
+	mu.Lock()
+	defer mu.Unlock()
+	all := make([]*Setting, 0, len(declared))
+	for _, s := range declared {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
+
+// SetFromFile sets the environment variable to
+// the value that was read from the file at path.
+func SetFromFile(name, value, path string) error {
+	if err := os.Setenv(name, value); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	files[name] = fileValue{value: value, path: path}
+	return nil
+}
+
+// FilePath returns the path to the file the environment variable was
+// read from. It is only reported while the variable has that value.
+func FilePath(name string) (string, bool) {
+	mu.Lock()
+	f, ok := files[name]
+	mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	if v, set := os.LookupEnv(name); !set || v != f.value {
+		return "", false
+	}
+	return f.path, true
+}
+
+// FromFile returns the names of the environment variables
+// that currently have the value read from a file, sorted by name.
+func FromFile() []string {
+	mu.Lock()
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	mu.Unlock()
+
+	sort.Strings(names)
+	kept := names[:0]
+	for _, name := range names {
+		if _, ok := FilePath(name); ok {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,76 @@
+package settings
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+var (
+	testSetting      = New("PKG_CONFIG_SETTINGS_TEST", "fallback")
+	duplicateSetting = New("PKG_CONFIG_SETTINGS_DUPLICATE", "")
+)
+
+func TestSetting_Value(t *testing.T) {
+	s := testSetting
+	t.Setenv(s.Name, "")
+	if err := os.Unsetenv(s.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := s.Get(), "fallback"; got != want {
+		t.Errorf("unexpected value: got %q, want %q", got, want)
+	}
+	if value, source := s.Value(); value != "fallback" || source != SourceDefault {
+		t.Errorf("unexpected value: got %q from %s, want %q from %s", value, source, "fallback", SourceDefault)
+	}
+
+	// An empty value uses the default but is reported as set.
+	t.Setenv(s.Name, "")
+	if got, want := s.Get(), "fallback"; got != want {
+		t.Errorf("unexpected value: got %q, want %q", got, want)
+	}
+	if value, source := s.Value(); value != "" || source != SourceEnv {
+		t.Errorf("unexpected value: got %q from %s, want %q from %s", value, source, "", SourceEnv)
+	}
+
+	if err := SetFromFile(s.Name, "file", "/src/.pkgconfig.env"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if value, source := s.Value(); value != "file" || source != SourceFile {
+		t.Errorf("unexpected value: got %q from %s, want %q from %s", value, source, "file", SourceFile)
+	}
+	if got, want := FromFile(), []string{s.Name}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected settings from file: got %q, want %q", got, want)
+	}
+
+	// Replacing the value from the file makes it come from the environment.
+	t.Setenv(s.Name, "env")
+	if value, source := s.Value(); value != "env" || source != SourceEnv {
+		t.Errorf("unexpected value: got %q from %s, want %q from %s", value, source, "env", SourceEnv)
+	}
+	if got := FromFile(); len(got) != 0 {
+		t.Errorf("expected no settings from file, got %q", got)
+	}
+}
+
+func TestNew_Duplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected declaring a setting twice to panic")
+		}
+	}()
+	New(duplicateSetting.Name, "")
+}
+
+func TestAll(t *testing.T) {
+	all := All()
+	if len(all) < 2 {
+		t.Fatalf("expected the declared settings, got %d", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1].Name >= all[i].Name {
+			t.Errorf("expected settings sorted by name, got %s before %s", all[i-1].Name, all[i].Name)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,13 +14,19 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Masterminds/semver"
 	"github.com/influxdata/pkg-config/internal/logutil"
 	"github.com/influxdata/pkg-config/internal/modfile"
 	"github.com/influxdata/pkg-config/internal/modload"
 	"github.com/influxdata/pkg-config/internal/module"
+	"github.com/influxdata/pkg-config/internal/settings"
 	"go.uber.org/zap"
 )
 
@@ -28,12 +35,21 @@ type Target struct {
 	Arch   string
 	Arm    string
 	Static bool
+
+	// Triple is the cargo target triple when it was given
+	// directly instead of determined from the target.
+	Triple string
 }
 
 func (t Target) String() string {
+	if t.OS == "" || t.Arch == "" {
+		// The triple could not be mapped to a target
+		// so it is used as the label.
+		return t.Triple
+	}
 	s := fmt.Sprintf("%s_%s", t.OS, t.Arch)
-	if t.Arm != "" {
-		s += "v" + t.Arm
+	if arm := t.armVersion(); arm != "" {
+		s += "v" + arm
 	}
 	if t.Static {
 		s += "_static"
@@ -41,39 +57,229 @@ func (t Target) String() string {
 	return s
 }
 
+// ParseTarget parses a target in the form os/arch[/arm][/static].
+// The arm version may only be specified when the architecture is arm.
+func ParseTarget(s string) (Target, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return Target{}, fmt.Errorf("invalid target %q: expected os/arch[/arm][/static]", s)
+	}
+
+	t := Target{OS: parts[0], Arch: parts[1]}
+	for _, part := range parts[2:] {
+		switch {
+		case part == "static" && !t.Static:
+			t.Static = true
+		case t.Arch == "arm" && t.Arm == "" && !t.Static && isArmVersion(part):
+			t.Arm = strings.TrimPrefix(part, "v")
+		default:
+			return Target{}, fmt.Errorf("invalid target %q: unexpected component %q", s, part)
+		}
+	}
+	return t, nil
+}
+
+// armVersion returns the arm version of the target. A version left
+// over from the environment is ignored when the architecture is not arm.
+func (t Target) armVersion() string {
+	if t.Arch != "arm" {
+		return ""
+	}
+	return t.Arm
+}
+
+func isArmVersion(s string) bool {
+	s = strings.TrimPrefix(s, "v")
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Spec returns the target in the form accepted by ParseTarget.
+func (t Target) Spec() string {
+	s := t.OS + "/" + t.Arch
+	if arm := t.armVersion(); arm != "" {
+		s += "/" + arm
+	}
+	if t.Static {
+		s += "/static"
+	}
+	return s
+}
+
+// cargoTargets maps each supported target to its cargo target triple.
+var cargoTargets = map[Target]string{
+	{OS: "linux", Arch: "amd64", Static: true}:         "x86_64-unknown-linux-musl",
+	{OS: "linux", Arch: "amd64"}:                       "x86_64-unknown-linux-gnu",
+	{OS: "linux", Arch: "386"}:                         "i686-unknown-linux-gnu",
+	{OS: "linux", Arch: "arm", Arm: "6"}:               "arm-unknown-linux-gnueabihf",
+	{OS: "linux", Arch: "arm", Arm: "6", Static: true}: "arm-unknown-linux-musleabihf",
+	{OS: "linux", Arch: "arm", Arm: "7"}:               "armv7-unknown-linux-gnueabihf",
+	{OS: "linux", Arch: "arm", Arm: "7", Static: true}: "armv7-unknown-linux-musleabihf",
+	{OS: "linux", Arch: "arm64"}:                       "aarch64-unknown-linux-gnu",
+	{OS: "linux", Arch: "arm64", Static: true}:         "aarch64-unknown-linux-musl",
+	{OS: "linux", Arch: "mips"}:                        "mips-unknown-linux-gnu",
+	{OS: "linux", Arch: "mips", Static: true}:          "mips-unknown-linux-musl",
+	{OS: "linux", Arch: "mipsle"}:                      "mipsel-unknown-linux-gnu",
+	{OS: "linux", Arch: "mipsle", Static: true}:        "mipsel-unknown-linux-musl",
+	{OS: "linux", Arch: "s390x"}:                       "s390x-unknown-linux-gnu",
+	{OS: "linux", Arch: "s390x", Static: true}:         "s390x-unknown-linux-gnu",
+	{OS: "darwin", Arch: "amd64"}:                      "x86_64-apple-darwin",
+	{OS: "darwin", Arch: "amd64", Static: true}:        "x86_64-apple-darwin",
+	{OS: "darwin", Arch: "arm64"}:                      "aarch64-apple-darwin",
+	{OS: "darwin", Arch: "arm64", Static: true}:        "aarch64-apple-darwin",
+	{OS: "windows", Arch: "amd64"}:                     "x86_64-pc-windows-gnu",
+	{OS: "windows", Arch: "amd64", Static: true}:       "x86_64-pc-windows-gnu",
+}
+
+// tripleArchs maps the architecture of a cargo target triple
+// to the go architecture.
+var tripleArchs = map[string]string{
+	"x86_64":  "amd64",
+	"i686":    "386",
+	"i586":    "386",
+	"aarch64": "arm64",
+	"arm":     "arm",
+	"armv7":   "arm",
+	"mips":    "mips",
+	"mipsel":  "mipsle",
+	"s390x":   "s390x",
+}
+
+// TargetFromTriple returns the target for a cargo target triple.
+// The triple is always used for the cargo build. The remaining fields
+// are mapped from the triple on a best effort basis and are left
+// empty when the triple is not understood.
+func TargetFromTriple(triple string) Target {
+	// Prefer a known target that uses the triple. Several targets
+	// can share a triple so the one with the fewest
+	// qualifiers is chosen.
+	var (
+		t     Target
+		found bool
+	)
+	for _, known := range SupportedTargets() {
+		if cargoTargets[known] != triple {
+			continue
+		}
+		if !found || (t.Static && !known.Static) {
+			t, found = known, true
+		}
+	}
+	if found {
+		t.Triple = triple
+		return t
+	}
+
+	t = Target{Triple: triple}
+	parts := strings.Split(triple, "-")
+	t.Arch = tripleArchs[parts[0]]
+	if strings.HasPrefix(parts[0], "armv") {
+		t.Arch = "arm"
+		if v := strings.TrimPrefix(parts[0], "armv"); v != "" && isArmVersion(v[:1]) {
+			t.Arm = v[:1]
+		}
+	}
+	for _, part := range parts[1:] {
+		switch {
+		case part == "linux" || part == "darwin" || part == "windows":
+			t.OS = part
+		case part == "apple":
+			t.OS = "darwin"
+		case strings.HasPrefix(part, "musl"):
+			t.Static = true
+		}
+	}
+	return t
+}
+
+// SupportedTargets returns the targets that have a known
+// cargo target triple, ordered by their spec.
+func SupportedTargets() []Target {
+	targets := make([]Target, 0, len(cargoTargets))
+	for t := range cargoTargets {
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Spec() < targets[j].Spec()
+	})
+	return targets
+}
+
 // Determine the cargo target.
 func (t Target) DetermineCargoTarget(logger *zap.Logger) string {
-	switch {
-	case t.OS == "linux" && t.Arch == "amd64" && t.Static:
-		return "x86_64-unknown-linux-musl"
-	case t.OS == "linux" && t.Arch == "amd64" && !t.Static:
-		return "x86_64-unknown-linux-gnu"
-	case t.OS == "linux" && t.Arch == "386" && !t.Static:
-		return "i686-unknown-linux-gnu"
-	case t.OS == "linux" && t.Arch == "arm" && t.Arm == "6" && !t.Static:
-		return "arm-unknown-linux-gnueabihf"
-	case t.OS == "linux" && t.Arch == "arm" && t.Arm == "6" && t.Static:
-		return "arm-unknown-linux-musleabihf"
-	case t.OS == "linux" && t.Arch == "arm" && t.Arm == "7" && !t.Static:
-		return "armv7-unknown-linux-gnueabihf"
-	case t.OS == "linux" && t.Arch == "arm" && t.Arm == "7" && t.Static:
-		return "armv7-unknown-linux-musleabihf"
-	case t.OS == "linux" && t.Arch == "arm64" && !t.Static:
-		return "aarch64-unknown-linux-gnu"
-	case t.OS == "linux" && t.Arch == "arm64" && t.Static:
-		return "aarch64-unknown-linux-musl"
-	case t.OS == "linux" && t.Arch == "s390x":
-		return "s390x-unknown-linux-gnu"
-	case t.OS == "darwin" && t.Arch == "amd64":
-		return "x86_64-apple-darwin"
-	case t.OS == "darwin" && t.Arch == "arm64":
-		return "aarch64-apple-darwin"
-	case t.OS == "windows" && t.Arch == "amd64":
-		return "x86_64-pc-windows-gnu"
-	default:
-		logger.Warn("Unable to determine cargo target. Using the default.", zap.String("target", t.String()))
-		return ""
+	if triple := t.cargoTarget(); triple != "" {
+		return triple
+	}
+	logger.Warn("Unable to determine cargo target. Using the default.", zap.String("target", t.String()))
+	return ""
+}
+
+// cargoTarget returns the cargo target triple or an empty string if
+// the target is unknown. Windows targets use the gnu toolchain unless
+// PKG_CONFIG_WINDOWS_ABI selects msvc.
+func (t Target) cargoTarget() string {
+	if t.Triple != "" {
+		return t.Triple
+	}
+	t.Arm = t.armVersion()
+	triple := cargoTargets[t]
+	if t.OS == "windows" && envWindowsABI.Get() == "msvc" {
+		triple = strings.TrimSuffix(triple, "-gnu") + "-msvc"
+	}
+	return triple
+}
+
+// systemLibs returns the system libraries that flux
+// needs to be linked with for the target.
+func (t Target) systemLibs() string {
+	if isMSVC(t.cargoTarget()) {
+		return " kernel32.lib advapi32.lib bcrypt.lib ntdll.lib userenv.lib ws2_32.lib"
+	} else if t.OS == "linux" {
+		if t.Static {
+			return " -ldl -lpthread -lm"
+		}
+		return " -ldl -lm"
+	} else if t.OS == "windows" {
+		return " -lkernel32 -ladvapi32 -lbcrypt -lkernel32 -lntdll -luserenv -lws2_32 -lkernel32 -lws2_32 -lkernel32 -lntdll -lkernel32"
+	}
+	return ""
+}
+
+// omittedSystemLibs are the system libraries that consumers
+// commonly link themselves and are left out with OmitSystemLibs.
+var omittedSystemLibs = map[string]bool{"-ldl": true, "-lpthread": true}
+
+// omitSystemLibs removes the omittedSystemLibs from the libraries.
+func omitSystemLibs(libs string) string {
+	var kept string
+	for _, lib := range strings.Fields(libs) {
+		if !omittedSystemLibs[lib] {
+			kept += " " + lib
+		}
+	}
+	return kept
+}
+
+// isMSVC reports whether the cargo target triple uses the msvc toolchain.
+func isMSVC(triple string) bool {
+	return strings.HasSuffix(triple, "-msvc")
+}
+
+// libraryFilename returns the filename of the static library that
+// cargo produces for the target triple. The msvc toolchain names
+// libraries without the lib prefix and uses the .lib extension.
+func libraryFilename(triple, name string) string {
+	if isMSVC(triple) {
+		return name + ".lib"
 	}
+	return "lib" + name + ".a"
 }
 
 type Library struct {
@@ -81,41 +287,306 @@ type Library struct {
 	Version string
 	Dir     string
 	Target  Target
+
+	// ExtraLibs are additional linker flags appended
+	// to the end of the libraries in the package config.
+	ExtraLibs []string
+
+	// ExtraIncludeDirs are additional include directories
+	// added to the compiler flags in the package config.
+	ExtraIncludeDirs []string
+
+	// Defines are preprocessor definitions in the form NAME or
+	// NAME=VALUE added to the compiler flags in the package config.
+	Defines []string
+
+	// HeadersOnly skips building the library and only
+	// includes the compiler flags in the package config.
+	HeadersOnly bool
+
+	// DebugInfo installs the split debug info produced by the
+	// build and references it from the package config.
+	DebugInfo bool
+
+	// OmitSystemLibs leaves linking -ldl and -lpthread to the
+	// consumer of the package config. Other system libraries,
+	// such as -lm and the Windows libraries, are still linked.
+	OmitSystemLibs bool
+
+	// ArchTag replaces the target in the directory the library
+	// is installed to, such as x86_64-linux-gnu for the layout
+	// of a Debian multiarch distribution.
+	ArchTag string
+
+	// Variant is appended to the directory the library is
+	// installed to so builds of different versions for the
+	// same target do not share a libdir.
+	Variant string
+}
+
+// Options configures how the library is resolved and built.
+type Options struct {
+	// Static selects static linking for the target.
+	Static bool
+
+	// Target overrides the target that would otherwise be
+	// determined from the go environment.
+	Target *Target
+
+	// HeadersOnly indicates only the compiler flags are needed
+	// so the library does not need to be built.
+	HeadersOnly bool
+
+	// ArchTag names the directory the library is installed to
+	// instead of the target. PKG_CONFIG_ARCH_TAG is used when
+	// it is empty.
+	ArchTag string
+
+	// Variant names the install directory of a library that
+	// is built alongside another version of it for the same
+	// target, such as flux-a and flux-b when comparing versions.
+	Variant string
 }
 
-var modulePathPattern = regexp.MustCompile("github.com/([^/]+)/flux")
+// modulePathPattern matches the flux module path including
+// the suffix of a major version after v1.
+var modulePathPattern = regexp.MustCompile(`^github\.com/([^/]+)/flux(/v[2-9][0-9]*)?$`)
 
-func Configure(ctx context.Context, logger *zap.Logger, static bool) (*Library, error) {
-	target, err := getTarget(static)
+func Configure(ctx context.Context, logger *zap.Logger, opts Options) (*Library, error) {
+	// Build flux at a git ref instead of the required version.
+	// The go command resolves the ref to a pseudo-version.
+	if ref := envFluxRef.Get(); ref != "" {
+		logger.Info("Using flux at git ref", zap.String("ref", ref))
+		return ConfigureVersion(ctx, logger, opts, ref)
+	}
+
+	target, err := configureTarget(opts)
 	if err != nil {
 		return nil, err
 	}
 
 	modroot := modload.ModRoot()
 	logger.Info("Determined module root", zap.String("path", modroot))
-	data, err := ioutil.ReadFile(filepath.Join(modroot, "go.mod"))
+	ver, dir, tagged, err := resolveModule(ctx, modroot, logger)
+	if err != nil {
+		return nil, err
+	}
+	return newLibrary(logger, opts, target, ver, dir, tagged)
+}
+
+// ConfigureVersion configures the library using the given version of
+// flux rather than the version required by the main module. This allows
+// multiple versions of flux to be built side by side.
+func ConfigureVersion(ctx context.Context, logger *zap.Logger, opts Options, version string) (*Library, error) {
+	target, err := configureTarget(opts)
 	if err != nil {
 		return nil, err
 	}
 
-	module, err := modfile.Parse(modroot, data, nil)
+	modulePath := fluxModulePath(modload.ModRoot())
+	logger.Info("Downloading flux version", zap.String("path", modulePath), zap.String("version", version))
+	ver, dir, err := downloadModule(ctx, modulePath+"@"+version, logger)
 	if err != nil {
 		return nil, err
 	}
+	return newLibrary(logger, opts, target, ver, dir, !isPseudoVersion(ver.Version))
+}
 
-	ver, dir, err := findModule(module, logger)
+// newLibrary constructs the library for a resolved module.
+// The version is tagged when it was determined from a release tag
+// rather than derived from a commit or the sources.
+func newLibrary(logger *zap.Logger, opts Options, target Target, ver module.Version, dir string, tagged bool) (*Library, error) {
+	if err := checkLibfluxDir(dir); err != nil {
+		return nil, err
+	}
+	if !opts.HeadersOnly {
+		if err := checkLibfluxCrate(dir); err != nil {
+			return nil, err
+		}
+	}
+	if envRequireTagged.Get() == "1" && !tagged {
+		return nil, fmt.Errorf("flux version %s was not determined from a release tag but PKG_CONFIG_REQUIRE_TAGGED requires a tagged version", ver.Version)
+	}
+	extraLibs, err := getExtraLibs(logger)
+	if err != nil {
+		return nil, err
+	}
+	includeDirs, err := getExtraIncludeDirs(logger)
+	if err != nil {
+		return nil, err
+	}
+	defines, err := getDefines(logger)
+	if err != nil {
+		return nil, err
+	}
+	archTag, err := getArchTag(opts)
 	if err != nil {
 		return nil, err
 	}
 	return &Library{
-		Path:    ver.Path,
-		Version: ver.Version,
-		Dir:     dir,
-		Target:  target,
+		Path:             ver.Path,
+		Version:          ver.Version,
+		Dir:              dir,
+		Target:           target,
+		ExtraLibs:        extraLibs,
+		ExtraIncludeDirs: includeDirs,
+		Defines:          defines,
+		HeadersOnly:      opts.HeadersOnly,
+		DebugInfo:        envDebugInfo.Get() == "1",
+		OmitSystemLibs:   envOmitSystemLibs.Get() == "1",
+		ArchTag:          archTag,
+		Variant:          opts.Variant,
 	}, nil
 }
 
+// getArchTag returns the name of the directory the library is
+// installed to when it should not be named for the target.
+// The name must be a single path component.
+func getArchTag(opts Options) (string, error) {
+	tag := opts.ArchTag
+	if tag == "" {
+		tag = envArchTag.Get()
+	}
+	if tag == "." || tag == ".." || strings.ContainsAny(tag, `/\`) {
+		return "", fmt.Errorf("invalid arch tag %q: must be a single directory name", tag)
+	}
+	return tag, nil
+}
+
+// archDir returns the name of the directory in the cache
+// the library is installed to. This is the target unless
+// an arch tag replaces it followed by the variant if there is one.
+func (l *Library) archDir() string {
+	dir := l.Target.String()
+	if l.ArchTag != "" {
+		dir = l.ArchTag
+	}
+	if l.Variant != "" {
+		dir += "-" + l.Variant
+	}
+	return dir
+}
+
+// pseudoVersionPattern matches the pseudo-versions the go command
+// generates for untagged commits, such as v0.0.0-20210101000000-abcdef123456.
+var pseudoVersionPattern = regexp.MustCompile(`^v[0-9]+\.(0\.0-|\d+\.\d+-([^+]*\.)?0\.)\d{14}-[A-Za-z0-9]+(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
+// isPseudoVersion reports whether the version is a pseudo-version.
+func isPseudoVersion(v string) bool {
+	return strings.Count(v, "-") >= 2 && pseudoVersionPattern.MatchString(v)
+}
+
+// fluxModulePath determines the flux module path used by the main module.
+// This is github.com/influxdata/flux unless a fork is required instead.
+func fluxModulePath(modroot string) string {
+	if data, err := ioutil.ReadFile(filepath.Join(modroot, "go.mod")); err == nil {
+		if mod, err := modfile.Parse(modroot, data, nil); err == nil {
+			for _, m := range mod.Require {
+				if modulePath := getModulePath(m.Mod.Path); modulePath != "" {
+					return modulePath
+				}
+			}
+		}
+	}
+	return "github.com/influxdata/flux"
+}
+
+// getExtraLibs reads the additional linker flags from PKG_CONFIG_EXTRA_LIBS.
+// The flags are space separated and must be either -l or -L flags.
+func getExtraLibs(logger *zap.Logger) ([]string, error) {
+	extraLibs := strings.Fields(envExtraLibs.Get())
+	for _, lib := range extraLibs {
+		if !strings.HasPrefix(lib, "-l") && !strings.HasPrefix(lib, "-L") {
+			return nil, fmt.Errorf("invalid flag in PKG_CONFIG_EXTRA_LIBS: %q must start with -l or -L", lib)
+		}
+	}
+	if len(extraLibs) > 0 {
+		logger.Info("Appending extra libraries", zap.Strings("libs", extraLibs))
+	}
+	return extraLibs, nil
+}
+
+// getExtraIncludeDirs reads the additional include directories from
+// PKG_CONFIG_EXTRA_INCLUDES. The directories are separated by the
+// os-specific path list separator. Relative directories are made
+// absolute since the compiler is run from another directory.
+func getExtraIncludeDirs(logger *zap.Logger) ([]string, error) {
+	var dirs []string
+	for _, dir := range filepath.SplitList(envExtraIncludes.Get()) {
+		if dir == "" {
+			continue
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid directory in PKG_CONFIG_EXTRA_INCLUDES: %w", err)
+		}
+		if _, err := os.Stat(dir); err != nil {
+			logger.Warn("Extra include directory does not exist", zap.String("dir", dir), zap.Error(err))
+		}
+		dirs = append(dirs, dir)
+	}
+	if len(dirs) > 0 {
+		logger.Info("Appending extra include directories", zap.Strings("dirs", dirs))
+	}
+	return dirs, nil
+}
+
+// getDefines reads the preprocessor definitions from PKG_CONFIG_DEFINES.
+// The definitions are space separated in the form NAME or NAME=VALUE
+// and may be given with the -D prefix.
+func getDefines(logger *zap.Logger) ([]string, error) {
+	var defines []string
+	for _, define := range strings.Fields(envDefines.Get()) {
+		define = strings.TrimPrefix(define, "-D")
+		if define == "" || strings.HasPrefix(define, "-") || strings.HasPrefix(define, "=") {
+			return nil, fmt.Errorf("invalid definition in PKG_CONFIG_DEFINES: %q must be NAME or NAME=VALUE", define)
+		}
+		defines = append(defines, define)
+	}
+	if len(defines) > 0 {
+		logger.Info("Adding preprocessor definitions", zap.Strings("defines", defines))
+	}
+	return defines, nil
+}
+
+// checkLibfluxDir verifies the module directory contains the libflux
+// sources so a module that is not really flux is reported clearly
+// instead of failing in the middle of the build.
+func checkLibfluxDir(dir string) error {
+	libfluxDir := filepath.Join(dir, "libflux")
+	if st, err := os.Stat(libfluxDir); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("flux module at %s does not contain the libflux directory: %s", dir, libfluxDir)
+		}
+		return err
+	} else if !st.IsDir() {
+		return fmt.Errorf("flux module at %s does not contain the libflux directory: %s is not a directory", dir, libfluxDir)
+	}
+	return nil
+}
+
+// checkLibfluxCrate verifies the libflux directory contains the
+// rust crate that is built with cargo. A version of flux without
+// the crate has nothing to build so this is reported instead of
+// letting cargo fail.
+func checkLibfluxCrate(dir string) error {
+	cargoToml := filepath.Join(dir, "libflux", "Cargo.toml")
+	if _, err := os.Stat(cargoToml); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("flux module at %s has no libflux Rust crate to build: %s does not exist", dir, cargoToml)
+		}
+		return err
+	}
+	return nil
+}
+
 func (l *Library) Install(ctx context.Context, logger *zap.Logger) (string, error) {
+	// Only the headers are needed so there is nothing to build.
+	if l.HeadersOnly {
+		logger.Info("Skipping build for headers only package config")
+		return "", nil
+	}
+
 	// Find the go cache as this is a safe place for us to write files.
 	cache, err := getGoCache()
 	if err != nil {
@@ -128,191 +599,1512 @@ func (l *Library) Install(ctx context.Context, logger *zap.Logger) (string, erro
 		return "", err
 	}
 
-	targetdir, err := l.build(ctx, logger)
+	// Other versions may be built in the same target directory and would
+	// replace the library, so it stays locked until the library is linked.
+	unlock, err := l.lockTargetDir(logger, cache)
 	if err != nil {
 		return "", err
 	}
+	defer unlock()
 
-	libdir := filepath.Join(cache, "pkgconfig", l.Target.String(), "lib")
+	targetdir, err := l.build(ctx, logger, cache)
+	if err != nil {
+		return "", err
+	}
+
+	libdir := filepath.Join(cache, "pkgconfig", l.archDir(), "lib")
 	logger.Info("Creating libdir", zap.String("libdir", libdir))
 	if err := os.MkdirAll(libdir, 0755); err != nil {
 		return "", err
 	}
 
+	triple := l.Target.cargoTarget()
 	libnames := []string{"flux"}
-	buildid, err := l.determineBuildId(targetdir, libnames)
+	buildid, err := l.determineBuildId(targetdir, triple, libnames)
 	if err != nil {
 		return "", err
 	}
 
 	for _, name := range libnames {
-		basename := fmt.Sprintf("lib%s.a", name)
-		src := filepath.Join(targetdir, basename)
-		dst := filepath.Join(libdir, fmt.Sprintf("lib%s-%s.a", name, buildid))
+		src := filepath.Join(targetdir, libraryFilename(triple, name))
+		dst := filepath.Join(libdir, libraryFilename(triple, name+"-"+buildid))
 		logger.Info("Linking library to libdir", zap.String("src", src), zap.String("dst", dst))
-		if _, err := os.Stat(dst); err == nil {
-			_ = os.Remove(dst)
-		}
-
-		if err := safeLink(src, dst); err != nil {
+		if err := installFile(src, dst); err != nil {
 			logger.Error("Could not link library", zap.Error(err))
 			return "", err
 		}
 	}
-	return buildid, nil
-}
 
-func (l *Library) determineBuildId(targetdir string, libnames []string) (string, error) {
-	shasum := sha256.New()
-	for _, name := range libnames {
-		basename := fmt.Sprintf("lib%s.a", name)
-		src := filepath.Join(targetdir, basename)
-		data, err := ioutil.ReadFile(src)
+	if envStrip.Get() == "1" && !isMSVC(triple) {
+		strip := l.Target.stripCmd()
+		for _, name := range libnames {
+			dst := filepath.Join(libdir, libraryFilename(triple, name+"-"+buildid))
+			if err := stripLibrary(ctx, logger, strip, dst); err != nil {
+				logger.Error("Could not strip library", zap.Error(err))
+				return "", err
+			}
+		}
+	}
+
+	if l.DebugInfo {
+		debugdir := filepath.Join(cache, "pkgconfig", l.archDir(), "debug", buildid)
+		logger.Info("Linking debug info to debugdir", zap.String("debugdir", debugdir))
+		n, err := linkDebugInfo(targetdir, debugdir, libnames)
 		if err != nil {
+			logger.Error("Could not link debug info", zap.Error(err))
 			return "", err
+		} else if n == 0 {
+			logger.Warn("No split debug info was produced by the build", zap.String("targetdir", targetdir))
 		}
-		shasum.Write(data)
 	}
-	return hex.EncodeToString(shasum.Sum(nil)), nil
+	unlock()
+
+	if hook := envPostBuildHook.Get(); hook != "" {
+		if err := l.runPostBuildHook(ctx, logger, hook, libdir, buildid); err != nil {
+			return "", err
+		}
+	}
+
+	l.pruneCache(logger, cache, buildid)
+	return buildid, nil
 }
 
-// copyIfReadOnly will copy the module to another location if the directory is read only.
-func (l *Library) copyIfReadOnly(ctx context.Context, logger *zap.Logger, cache string) error {
-	if st, err := os.Stat(l.Dir); err != nil {
-		return err
-	} else if st.Mode()&0200 != 0 {
-		return nil
+// pruneCache removes all but the most recently used generations of
+// the source copies and the installed libraries for the target from
+// the cache. The number of generations is read from
+// PKG_CONFIG_CACHE_GENERATIONS and nothing is removed when it is unset.
+// The generation that was just installed is always kept and the source
+// copies are kept while another build holds the cargo lock since it may
+// be building one of them. Failing to prune does not fail the build so
+// problems are only logged.
+func (l *Library) pruneCache(logger *zap.Logger, cache, buildid string) {
+	value := envCacheGenerations.Get()
+	if value == "" {
+		return
+	}
+	generations, err := strconv.Atoi(value)
+	if err != nil || generations < 1 {
+		logger.Warn("Invalid value for PKG_CONFIG_CACHE_GENERATIONS, skipping cache pruning", zap.String("value", value))
+		return
 	}
 
-	// Determine the source path. If the directory already exists,
-	// then we have already copied the files.
-	srcdir := filepath.Join(cache, "pkgconfig", l.Path+"@"+l.Version)
-	if _, err := os.Stat(srcdir); err == nil {
-		l.Dir = srcdir
-		return nil
+	// The sources are copied into the cache once per version.
+	copies, err := filepath.Glob(filepath.Join(copyRoot(cache), filepath.FromSlash(l.Path)+"@*"))
+	if err != nil {
+		logger.Warn("Unable to list the cached sources", zap.Error(err))
 	}
+	stale := pruneGenerations(copies, l.copyDir(cache), generations)
 
-	// Copy over the directory.
-	if err := filepath.Walk(l.Dir, func(path string, info os.FileInfo, err error) error {
-		relpath, err := filepath.Rel(l.Dir, path)
-		if err != nil {
-			return err
+	// The copies of every version are built in the same target directory
+	// so another build holding its lock may be using any of them.
+	targetDir := envCargoTargetDir.Get()
+	if targetDir == "" {
+		targetDir = l.copyTargetDir(cache)
+	}
+	if len(stale) > 0 && cargoLockHeld(logger, targetDir) {
+		logger.Info("Another build holds the cargo lock, keeping the cached sources", zap.String("dir", targetDir))
+		stale = nil
+	}
+	for _, dir := range stale {
+		logger.Info("Removing cached sources", zap.String("dir", dir))
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Warn("Unable to remove cached sources", zap.String("dir", dir), zap.Error(err))
 		}
+	}
 
-		targetpath := filepath.Join(srcdir, relpath)
-		if info.IsDir() {
-			return os.MkdirAll(targetpath, 0755)
+	// Each build of the library is installed under its build id
+	// along with the debug info when it was requested.
+	targetdir := filepath.Join(cache, "pkgconfig", l.archDir())
+	triple := l.Target.cargoTarget()
+	pattern := libraryFilename(triple, "flux-*")
+	libs, err := filepath.Glob(filepath.Join(targetdir, "lib", pattern))
+	if err != nil {
+		logger.Warn("Unable to list the installed libraries", zap.Error(err))
+	}
+	current := filepath.Join(targetdir, "lib", libraryFilename(triple, "flux-"+buildid))
+	affixes := strings.SplitN(pattern, "*", 2)
+	for _, lib := range pruneGenerations(libs, current, generations) {
+		logger.Info("Removing installed library", zap.String("path", lib))
+		if err := os.Remove(lib); err != nil {
+			logger.Warn("Unable to remove installed library", zap.String("path", lib), zap.Error(err))
 		}
 
-		r, err := os.Open(path)
-		if err != nil {
-			return err
+		id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(lib), affixes[0]), affixes[1])
+		if err := os.RemoveAll(filepath.Join(targetdir, "debug", id)); err != nil {
+			logger.Warn("Unable to remove debug info", zap.String("buildid", id), zap.Error(err))
 		}
-		defer func() { _ = r.Close() }()
+	}
+}
 
-		w, err := os.Create(targetpath)
+// pruneGenerations returns the paths that are not among the most
+// recently modified generations. The current path counts as the
+// most recent generation regardless of when it was modified.
+func pruneGenerations(paths []string, current string, generations int) []string {
+	type entry struct {
+		path    string
+		modTime time.Time
+	}
+	entries := make([]entry, 0, len(paths))
+	for _, path := range paths {
+		if path == current {
+			generations--
+			continue
+		}
+		info, err := os.Stat(path)
 		if err != nil {
-			return err
+			continue
 		}
+		entries = append(entries, entry{path: path, modTime: info.ModTime()})
+	}
+	if generations < 0 {
+		generations = 0
+	}
+	if len(entries) <= generations {
+		return nil
+	}
 
-		if _, err := io.Copy(w, r); err != nil {
-			return err
-		}
-		return w.Close()
-	}); err != nil {
-		return err
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.After(entries[j].modTime)
+	})
+	pruned := make([]string, 0, len(entries)-generations)
+	for _, e := range entries[generations:] {
+		pruned = append(pruned, e.path)
 	}
+	return pruned
+}
 
-	l.Dir = srcdir
+// runPostBuildHook runs the hook after the library has been installed
+// into the libdir. The hook receives the details of the installed
+// library through the environment.
+func (l *Library) runPostBuildHook(ctx context.Context, logger *zap.Logger, hook, libdir, buildid string) error {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(),
+		"FLUX_LIBDIR="+libdir,
+		"FLUX_VERSION="+l.Version,
+		"FLUX_TARGET="+l.Target.String(),
+		"FLUX_BUILDID="+buildid,
+	)
+
+	logger.Info("Running post-build hook", zap.String("hook", hook))
+	err := cmd.Run()
+	_ = logutil.LogOutput(&output, logger)
+	if err != nil {
+		return fmt.Errorf("post-build hook %s failed: %w", hook, err)
+	}
 	return nil
 }
 
-func (l *Library) build(ctx context.Context, logger *zap.Logger) (string, error) {
-	var stderr bytes.Buffer
-	cargoCmd := os.Getenv("CARGO")
-	if cargoCmd == "" {
-		cargoCmd = "cargo"
+// isHost reports whether the target is the
+// operating system and architecture of the host.
+func (t Target) isHost() bool {
+	return t.OS == runtime.GOOS && t.Arch == runtime.GOARCH
+}
+
+// stripCmd returns the strip binary for the target. PKG_CONFIG_STRIP_CMD
+// overrides it for every target. Targets other than the host use the
+// strip from the cross toolchain of the C compiler for the target, which
+// is named for the GNU triple such as aarch64-linux-gnu rather than the
+// rust triple. When there is no cross compiler, the rust triple is used.
+func (t Target) stripCmd() string {
+	if strip := envStripCmd.Get(); strip != "" {
+		return strip
+	}
+	if t.isHost() {
+		return "strip"
 	}
+	triple := t.cargoTarget()
+	if triple == "" {
+		return "strip"
+	}
+	if strip, ok := toolchainStrip(crossCC(triple)); ok {
+		return strip
+	}
+	return triple + "-strip"
+}
 
-	cmd := exec.Command(cargoCmd, "build", "--release")
-	cmd.Stdout = &stderr
-	cmd.Stderr = &stderr
-	cmd.Dir = filepath.Join(l.Dir, "libflux")
-	cmd.Env = os.Environ()
+// crossCC returns the C compiler used for the target triple.
+// This is PKG_CONFIG_CROSS_CC or the compiler that the cc crate
+// would use from CC_<triple>.
+func crossCC(triple string) string {
+	if cc := envCrossCC.Get(); cc != "" {
+		return cc
+	}
+	for _, key := range []string{"CC_" + triple, "CC_" + strings.ReplaceAll(triple, "-", "_")} {
+		if cc := os.Getenv(key); cc != "" {
+			return cc
+		}
+	}
+	return ""
+}
 
-	targetString := l.Target.DetermineCargoTarget(logger)
-	if targetString != "" {
-		cmd.Args = append(cmd.Args, "--target", targetString)
+// toolchainStrip returns the strip from the same toolchain as the
+// C compiler, such as aarch64-linux-gnu-strip for aarch64-linux-gnu-gcc.
+// It reports false when the compiler is not named for a toolchain.
+func toolchainStrip(cc string) (string, bool) {
+	fields := strings.Fields(cc)
+	if len(fields) == 0 {
+		return "", false
+	}
+	dir, name := filepath.Split(fields[0])
+	for _, suffix := range []string{"-gcc", "-cc", "-clang"} {
+		if prefix := strings.TrimSuffix(name, suffix); prefix != name && prefix != "" {
+			return dir + prefix + "-strip", true
+		}
 	}
+	return "", false
+}
 
-	logger.Info("Executing cargo build", zap.String("dir", cmd.Dir), zap.String("target", targetString))
-	if err := cmd.Run(); err != nil {
-		logutil.LogOutput(&stderr, logger)
-		return "", err
+// stripLibrary strips the debug symbols from the static library.
+// The stripped library is written to a temporary name and renamed
+// into place as the library is linked to the build output.
+// Stripping is skipped if the strip binary cannot be found.
+func stripLibrary(ctx context.Context, logger *zap.Logger, strip, path string) error {
+	if _, err := exec.LookPath(strip); err != nil {
+		logger.Warn("Unable to find strip, skipping", zap.String("strip", strip))
+		return nil
 	}
-	targetDir := filepath.Join(cmd.Dir, "target", targetString, "release")
-	logger.Info("Build succeeded", zap.String("dir", targetDir))
-	return targetDir, nil
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_ = f.Close()
+	defer func() { _ = os.Remove(tmp) }()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, strip, "-S", "-o", tmp, path)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	logger.Info("Stripping library", zap.String("strip", strip), zap.String("path", path))
+	err = cmd.Run()
+	_ = logutil.LogOutput(&output, logger)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %w", strip, path, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// debugInfoSuffixes are the suffixes of the split debug info
+// artifacts that the toolchains produce.
+var debugInfoSuffixes = []string{".debug", ".dwp", ".dSYM", ".pdb"}
+
+// linkDebugInfo links the split debug info for the libraries
+// from the target directory into the debug directory.
+// It returns the number of artifacts that were linked.
+func linkDebugInfo(targetdir, debugdir string, libnames []string) (int, error) {
+	entries, err := ioutil.ReadDir(targetdir)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, entry := range entries {
+		if !isDebugInfo(entry.Name(), libnames) {
+			continue
+		}
+		src, dst := filepath.Join(targetdir, entry.Name()), filepath.Join(debugdir, entry.Name())
+		if err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(dst, rel)
+			if info.IsDir() {
+				return os.MkdirAll(target, 0755)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			return installFile(path, target)
+		}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// isDebugInfo reports whether the file is split debug info
+// for one of the libraries.
+func isDebugInfo(name string, libnames []string) bool {
+	for _, suffix := range debugInfoSuffixes {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		for _, lib := range libnames {
+			if strings.HasPrefix(name, "lib"+lib+".") || strings.HasPrefix(name, lib+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l *Library) determineBuildId(targetdir, triple string, libnames []string) (string, error) {
+	paths := make([]string, 0, len(libnames))
+	for _, name := range libnames {
+		paths = append(paths, filepath.Join(targetdir, libraryFilename(triple, name)))
+	}
+	return checksumFiles(paths...)
+}
+
+// checksumFiles returns the hex encoded SHA-256 checksum
+// of the contents of the files in the order they are given.
+func checksumFiles(paths ...string) (string, error) {
+	shasum := sha256.New()
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		shasum.Write(data)
+	}
+	return hex.EncodeToString(shasum.Sum(nil)), nil
+}
+
+// copyIfReadOnly will copy the module to another location if the directory is read only.
+// The copy is placed in the go build cache rather than the module cache so
+// we never write into a directory that go considers to be immutable.
+func (l *Library) copyIfReadOnly(ctx context.Context, logger *zap.Logger, cache string) error {
+	if readonly, err := l.isReadOnly(); err != nil {
+		return err
+	} else if !readonly {
+		return nil
+	}
+
+	// Determine the source path. If the directory already exists,
+	// then we have already copied the files.
+	srcdir := l.copyDir(cache)
+	if _, err := os.Stat(srcdir); err == nil {
+		// Mark the copy as used so pruning the cache
+		// counts it as a recent generation.
+		now := time.Now()
+		if err := os.Chtimes(srcdir, now, now); err != nil {
+			logger.Info("Unable to update the modification time of the cached sources", zap.String("dir", srcdir), zap.Error(err))
+		}
+		l.Dir = srcdir
+		return nil
+	}
+
+	// Copy over the directory.
+	if err := filepath.Walk(l.Dir, func(path string, info os.FileInfo, err error) error {
+		relpath, err := filepath.Rel(l.Dir, path)
+		if err != nil {
+			return err
+		}
+
+		targetpath := filepath.Join(srcdir, relpath)
+		if info.IsDir() {
+			return os.MkdirAll(targetpath, 0755)
+		}
+
+		r, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = r.Close() }()
+
+		w, err := os.Create(targetpath)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+		return w.Close()
+	}); err != nil {
+		return err
+	}
+
+	l.Dir = srcdir
+	return nil
+}
+
+// SourceDir returns the directory the library will be built from.
+// This is the directory that Install will use after any copy of
+// read only sources has been made, but calling it does not perform
+// the copy itself.
+func (l *Library) SourceDir() (string, error) {
+	if readonly, err := l.isReadOnly(); err != nil {
+		return "", err
+	} else if !readonly {
+		return l.Dir, nil
+	}
+
+	cache, err := getGoCache()
+	if err != nil {
+		return "", err
+	}
+	return l.copyDir(cache), nil
+}
+
+// isReadOnly reports whether the library sources are read only.
+// The build writes into the libflux directory so that directory is
+// checked along with the module root since only part of the tree
+// may be writable.
+func (l *Library) isReadOnly() (bool, error) {
+	st, err := os.Stat(l.Dir)
+	if err != nil {
+		return false, err
+	} else if st.Mode()&0200 == 0 {
+		return true, nil
+	}
+
+	libfluxDir := filepath.Join(l.Dir, "libflux")
+	if st, err := os.Stat(libfluxDir); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	} else if st.Mode()&0200 == 0 {
+		return true, nil
+	}
+
+	// The mode bits may not tell the whole story, such as
+	// on a read only filesystem, so attempt to write a file.
+	f, err := ioutil.TempFile(libfluxDir, ".pkgconfig-")
+	if err != nil {
+		return true, nil
+	}
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+	return false, nil
+}
+
+// copyDir returns the location within the cache that read only
+// sources will be copied to.
+func (l *Library) copyDir(cache string) string {
+	return filepath.Join(copyRoot(cache), l.Path+"@"+l.Version)
+}
+
+// copyRoot returns the directory read only sources are copied into.
+// This is within the cache unless PKG_CONFIG_COPY_DIR relocates it,
+// such as to a directory per user when the cache is shared.
+func copyRoot(cache string) string {
+	dir := envCopyDir.Get()
+	if dir == "" {
+		return filepath.Join(cache, "pkgconfig")
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return dir
+}
+
+// NeedsBuild reports whether Install would build the library along
+// with the reason. Nothing is built and read only sources are not
+// copied. The library is considered built when the build products
+// exist and were built from sources with the same hash.
+func (l *Library) NeedsBuild(ctx context.Context, logger *zap.Logger) (bool, string, error) {
+	if l.HeadersOnly {
+		return false, "only the headers are needed", nil
+	}
+
+	cache, err := getGoCache()
+	if err != nil {
+		return false, "", err
+	}
+
+	lib := *l
+	if lib.Dir, err = l.SourceDir(); err != nil {
+		return false, "", err
+	} else if _, err := os.Stat(lib.Dir); os.IsNotExist(err) {
+		return true, "sources have not been copied into the cache", nil
+	}
+
+	b, err := lib.prepareBuild(ctx, logger, cache)
+	if err != nil {
+		return false, "", err
+	}
+	needed, reason := b.needsBuild(logger)
+	return needed, reason, nil
+}
+
+// cargoBuild is a cargo build of the library along with
+// what is needed to determine whether it is up to date.
+type cargoBuild struct {
+	cmd            *exec.Cmd
+	stderr         bytes.Buffer
+	targetString   string
+	cargoTargetDir string
+	targetDir      string
+	sourceHash     string
+	rustcVersion   string
+}
+
+// prepareBuild constructs the cargo command and computes the
+// hash of the sources without running anything that builds.
+func (l *Library) prepareBuild(ctx context.Context, logger *zap.Logger, cache string) (*cargoBuild, error) {
+	b := &cargoBuild{}
+	cargoCmd := lookupCargoCmd()
+
+	targetString := l.Target.DetermineCargoTarget(logger)
+	args, err := cargoBuildArgs(targetString)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, cargoCmd, args...)
+	cmd.Stdout = &b.stderr
+	cmd.Stderr = &b.stderr
+	cmd.Dir = filepath.Join(l.Dir, "libflux")
+	cmd.Env = os.Environ()
+
+	// In offline mode, cargo should fail fast instead of waiting
+	// on a connection to the registry. Vendored dependencies never
+	// need the registry. A value set by the user is left alone.
+	if envOffline.Get() == "1" || envCargoVendorDir.Get() != "" {
+		if _, ok := os.LookupEnv("CARGO_NET_OFFLINE"); !ok {
+			cmd.Env = append(cmd.Env, "CARGO_NET_OFFLINE=true")
+		}
+	}
+
+	// Incremental compilation can make the artifacts differ
+	// between builds of the same sources.
+	if envCargoIncremental.Get() == "0" {
+		cmd.Env = append(cmd.Env, "CARGO_INCREMENTAL=0")
+	}
+
+	cmd.Env = append(cmd.Env, crossCompileEnv(targetString)...)
+
+	// Optimize the library for a particular cpu.
+	if cpu := envTargetCPU.Get(); cpu != "" {
+		if cpu == "native" && !l.Target.isHost() {
+			logger.Warn("PKG_CONFIG_TARGET_CPU=native optimizes for the cpu of this machine, which is not the cpu of the cross target", zap.String("target", l.Target.String()))
+		}
+		cmd.Env = append(cmd.Env, targetCPUEnv(cpu))
+	}
+
+	cargoTargetDir := l.cargoTargetDir(cache)
+	if cargoTargetDir != "" {
+		cmd.Env = append(cmd.Env, "CARGO_TARGET_DIR="+cargoTargetDir)
+	} else {
+		cargoTargetDir = filepath.Join(cmd.Dir, "target")
+	}
+
+	// The cargo configuration may relocate the target directory
+	// so ask cargo where the artifacts will be written.
+	if dir, err := cargoMetadataTargetDir(ctx, cargoCmd, cmd.Dir, cmd.Env); err != nil {
+		logger.Warn("Unable to determine target directory from cargo metadata. Using the default.", zap.String("target_dir", cargoTargetDir), zap.Error(err))
+	} else {
+		cargoTargetDir = dir
+	}
+
+	b.cmd, b.targetString = cmd, targetString
+	b.cargoTargetDir = cargoTargetDir
+	b.targetDir = filepath.Join(cargoTargetDir, targetString, "release")
+
+	inputs, err := buildInputs(cmd.Dir, args, cmd.Env)
+	if err != nil {
+		return nil, err
+	}
+	if b.sourceHash, err = hashSources(l.Dir, cargoTargetDir, inputs); err != nil {
+		return nil, err
+	}
+
+	// The version is determined within the crate
+	// so a rust-toolchain file there is applied.
+	if b.rustcVersion, err = toolVersion(ctx, cmd.Dir, lookupRustcCmd()); err != nil {
+		logger.Info("Unable to determine the rustc version", zap.Error(err))
+	}
+	return b, nil
+}
+
+// needsBuild reports whether the library must be built along
+// with the reason. The library is up to date when it exists and
+// was built from the same sources and build inputs with a rustc
+// that cachedRustcMatches accepts.
+func (b *cargoBuild) needsBuild(logger *zap.Logger) (bool, string) {
+	stampFile := filepath.Join(b.targetDir, sourceHashFile)
+	lib := filepath.Join(b.targetDir, libraryFilename(b.targetString, "flux"))
+	if _, err := os.Stat(lib); err != nil {
+		return true, "library has not been built"
+	} else if !isUpToDate(stampFile, b.sourceHash, lib) {
+		return true, "sources or build inputs have changed since the last build"
+	} else if !cachedRustcMatches(logger, filepath.Join(b.targetDir, rustcVersionFile), b.rustcVersion) {
+		return true, "library was built with a different rustc version"
+	}
+	return false, "sources and build inputs are unchanged since the last build"
+}
+
+func (l *Library) build(ctx context.Context, logger *zap.Logger, cache string) (string, error) {
+	b, err := l.prepareBuild(ctx, logger, cache)
+	if err != nil {
+		return "", err
+	}
+	cmd, targetDir := b.cmd, b.targetDir
+
+	if err := checkDiskSpace(logger, b.cargoTargetDir, copyRoot(cache)); err != nil {
+		return "", err
+	}
+
+	// Skip the build when the library was already built from the same sources.
+	if err := checkCargoLocks(ctx, logger, b.cargoTargetDir, targetDir); err != nil {
+		return "", err
+	}
+	if needed, _ := b.needsBuild(logger); !needed {
+		logger.Info("Sources are unchanged since the last build, skipping cargo build", zap.String("dir", targetDir))
+		return targetDir, nil
+	}
+
+	logger.Info("Executing cargo build", zap.String("dir", cmd.Dir), zap.String("target", b.targetString), zap.String("target_dir", b.cargoTargetDir))
+	if err := cmd.Run(); err != nil {
+		output := append([]byte(nil), b.stderr.Bytes()...)
+		_ = logutil.LogFailureOutput(&b.stderr, logger)
+		return "", &BuildError{Err: err, Stderr: output}
+	}
+	logger.Info("Build succeeded", zap.String("dir", targetDir))
+
+	stampFile := filepath.Join(targetDir, sourceHashFile)
+	if err := ioutil.WriteFile(stampFile, []byte(b.sourceHash), 0644); err != nil {
+		logger.Warn("Unable to record the source hash for the build", zap.String("path", stampFile), zap.Error(err))
+	}
+	if b.rustcVersion != "" {
+		rustcFile := filepath.Join(targetDir, rustcVersionFile)
+		if err := ioutil.WriteFile(rustcFile, []byte(b.rustcVersion), 0644); err != nil {
+			logger.Warn("Unable to record the rustc version for the build", zap.String("path", rustcFile), zap.Error(err))
+		}
+	}
+	return targetDir, nil
+}
+
+// sourceHashFile is the file in the release directory that
+// records the hash of the sources the library was built from.
+const sourceHashFile = ".pkg-config-source-hash"
+
+// rustcVersionFile is the file in the release directory that
+// records the version of rustc the library was built with.
+const rustcVersionFile = ".pkg-config-rustc-version"
+
+// cachedRustcMatches reports whether the cached library can be used
+// with the current rustc. A library built by a different rustc may not
+// be compatible with code built by the current one. The difference is
+// reported as a warning unless PKG_CONFIG_STRICT_ABI=1, in which case
+// the library is rebuilt. Nothing is checked when either version is unknown.
+func cachedRustcMatches(logger *zap.Logger, rustcFile, current string) bool {
+	data, err := ioutil.ReadFile(rustcFile)
+	if err != nil || current == "" {
+		return true
+	}
+	cached := strings.TrimSpace(string(data))
+	if cached == current {
+		return true
+	}
+
+	if envStrictABI.Get() == "1" {
+		logger.Info("Cached library was built with a different rustc version, rebuilding", zap.String("cached", cached), zap.String("current", current))
+		return false
+	}
+	logger.Warn("Cached library was built with a different rustc version. Set PKG_CONFIG_STRICT_ABI=1 to rebuild it.", zap.String("cached", cached), zap.String("current", current))
+	return true
+}
+
+// hashedEnv are the environment variables that change what cargo,
+// rustc or the C compiler used by the build scripts produce. The
+// variables starting with one of hashedEnvPrefixes are included too.
+var (
+	hashedEnv         = []string{"AR", "CC", "CFLAGS", "CARGO_ENCODED_RUSTFLAGS", "CARGO_INCREMENTAL", "RUSTC", "RUSTC_WRAPPER", "RUSTFLAGS"}
+	hashedEnvPrefixes = []string{"AR_", "CC_", "CFLAGS_", "CARGO_BUILD_", "CARGO_PROFILE_", "CARGO_TARGET_"}
+)
+
+// buildInputs returns everything other than the sources that determines
+// the library cargo builds. This is the cargo arguments, the environment
+// cargo is run with and the cargo configuration files. The toolchain is
+// left out so a library built by another rustc can still be reused; it
+// is checked separately by cachedRustcMatches.
+func buildInputs(dir string, args, env []string) ([]string, error) {
+	inputs := []string{fmt.Sprintf("args=%q", args)}
+
+	// Later entries replace earlier ones like they do for cargo.
+	values := make(map[string]string)
+	for _, kv := range env {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if isHashedEnv(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		inputs = append(inputs, key+"="+values[key])
+	}
+
+	configs, err := cargoConfigFiles(dir, values["CARGO_HOME"])
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range configs {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, "config="+path+"\n"+string(data))
+	}
+
+	return inputs, nil
+}
+
+// isHashedEnv reports whether the environment
+// variable is one of the build inputs.
+func isHashedEnv(key string) bool {
+	for _, name := range hashedEnv {
+		if key == name {
+			return true
+		}
+	}
+	for _, prefix := range hashedEnvPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cargoConfigFiles returns the cargo configuration files that apply to
+// the crate in dir. Cargo reads the .cargo directory of dir and each
+// of its parents followed by the one in the cargo home directory.
+func cargoConfigFiles(dir, cargoHome string) ([]string, error) {
+	var dirs []string
+	for d := dir; ; d = filepath.Dir(d) {
+		dirs = append(dirs, filepath.Join(d, ".cargo"))
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if cargoHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			cargoHome = filepath.Join(home, ".cargo")
+		}
+	}
+	if cargoHome != "" {
+		dirs = append(dirs, cargoHome)
+	}
+
+	var files []string
+	for _, d := range dirs {
+		for _, name := range []string{"config", "config.toml"} {
+			path := filepath.Join(d, name)
+			if st, err := os.Stat(path); err == nil && st.Mode().IsRegular() {
+				files = append(files, path)
+			} else if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// hashedSourceDirs are the directories of the flux module the library is
+// built from. The build script of libflux embeds the flux standard library.
+var hashedSourceDirs = []string{"libflux", "stdlib"}
+
+// hashSources computes a hash of the build inputs and the contents of the
+// sources in the flux module at root. The target directories are skipped
+// since they contain the build products rather than the sources.
+func hashSources(root, cargoTargetDir string, inputs []string) (string, error) {
+	shasum := sha256.New()
+	for _, input := range inputs {
+		_, _ = fmt.Fprintf(shasum, "%d\n%s\n", len(input), input)
+	}
+
+	skip := map[string]bool{
+		filepath.Join(root, "libflux", "target"): true,
+		filepath.Clean(cargoTargetDir):           true,
+	}
+	for _, name := range hashedSourceDirs {
+		dir := filepath.Join(root, name)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+		if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if skip[path] {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = f.Close() }()
+
+			_, _ = fmt.Fprintf(shasum, "%s\n%d\n", filepath.ToSlash(rel), info.Size())
+			_, err = io.Copy(shasum, f)
+			return err
+		}); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(shasum.Sum(nil)), nil
+}
+
+// isUpToDate reports whether the library exists and the stamp
+// file records that it was built from sources with the given hash.
+func isUpToDate(stampFile, sourceHash, lib string) bool {
+	data, err := ioutil.ReadFile(stampFile)
+	if err != nil || string(data) != sourceHash {
+		return false
+	}
+	_, err = os.Stat(lib)
+	return err == nil
+}
+
+// cargoMetadataTargetDir determines the target directory that cargo
+// will write artifacts to from the output of cargo metadata.
+func cargoMetadataTargetDir(ctx context.Context, cargoCmd, dir string, env []string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cargoCmd, "metadata", "--format-version", "1", "--no-deps")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Dir = dir
+	cmd.Env = env
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("cargo metadata failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var metadata struct {
+		TargetDirectory string `json:"target_directory"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &metadata); err != nil {
+		return "", fmt.Errorf("could not parse cargo metadata: %w", err)
+	}
+	if metadata.TargetDirectory == "" {
+		return "", fmt.Errorf("cargo metadata did not report a target directory")
+	}
+	return metadata.TargetDirectory, nil
+}
+
+// diskSpace returns the available space on the filesystem
+// containing the path. This can be replaced for testing.
+var diskSpace = availableDiskSpace
+
+// errDiskSpaceUnsupported is returned by availableDiskSpace on
+// the platforms where the available space cannot be determined.
+var errDiskSpaceUnsupported = errors.New("checking the available disk space is not supported on this platform")
+
+// fileLocked reports whether another process holds the lock on the file.
+var fileLocked = isFileLocked
+
+// cargoLockPoll is how often a held cargo lock is checked
+// while waiting for it to be released.
+var cargoLockPoll = time.Second
+
+// checkCargoLocks waits for another build to release the lock cargo
+// takes on the build directories of the host or the target. The lock
+// is released when the process holding it exits, so a lock that is
+// still held after PKG_CONFIG_CARGO_LOCK_TIMEOUT is assumed to belong
+// to a build that died and left a process behind with the lock, such
+// as a compiler cache server started by a build script. That lock is
+// reported as an error unless PKG_CONFIG_CLEAR_CARGO_LOCK=1, in which
+// case it is removed so cargo takes a new one.
+func checkCargoLocks(ctx context.Context, logger *zap.Logger, cargoTargetDir, targetDir string) error {
+	timeout, err := time.ParseDuration(envCargoLockTimeout.Get())
+	if err != nil {
+		return fmt.Errorf("invalid value for PKG_CONFIG_CARGO_LOCK_TIMEOUT: %q", envCargoLockTimeout.Get())
+	}
+
+	dirs := []string{filepath.Join(cargoTargetDir, "release")}
+	if targetDir != dirs[0] {
+		dirs = append(dirs, targetDir)
+	}
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, ".cargo-lock")
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		locked, err := waitCargoLock(ctx, logger, path, timeout)
+		if err != nil {
+			return err
+		} else if !locked {
+			continue
+		}
+
+		if envClearCargoLock.Get() != "1" {
+			return fmt.Errorf("cargo target appears locked by a dead process: %s is still locked after %s; stop the process holding it or set PKG_CONFIG_CLEAR_CARGO_LOCK=1 to remove the lock", path, timeout)
+		}
+		logger.Warn("Cargo target appears locked by a dead process, removing the lock", zap.String("path", path), zap.Duration("timeout", timeout))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove the cargo lock: %w", err)
+		}
+	}
+	return nil
+}
+
+// waitCargoLock waits up to timeout for another process to release
+// the cargo lock at path and reports whether it is still held.
+func waitCargoLock(ctx context.Context, logger *zap.Logger, path string, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for waited := false; ; waited = true {
+		locked, err := fileLocked(path)
+		if err != nil {
+			logger.Info("Unable to determine if the cargo target is locked", zap.String("path", path), zap.Error(err))
+			return false, nil
+		} else if !locked {
+			return false, nil
+		} else if !time.Now().Before(deadline) {
+			return true, nil
+		}
+
+		if !waited {
+			logger.Info("Waiting for another build to release the cargo target", zap.String("path", path), zap.Duration("timeout", timeout))
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(cargoLockPoll):
+		}
+	}
+}
+
+// checkDiskSpace verifies there is at least PKG_CONFIG_MIN_DISK_MB
+// megabytes available for the cargo target directory. If there is not
+// and the target directory is within ownedDir, where the wrapper keeps
+// its own builds, the target directory is removed to reclaim space.
+// A target directory elsewhere may be shared with other builds so it
+// is left alone. If there is still not enough space, an error is
+// returned. No check is performed unless PKG_CONFIG_MIN_DISK_MB is set.
+func checkDiskSpace(logger *zap.Logger, targetDir, ownedDir string) error {
+	minDiskMB := envMinDiskMB.Get()
+	if minDiskMB == "" {
+		return nil
+	}
+	minMB, err := strconv.ParseUint(minDiskMB, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value for PKG_CONFIG_MIN_DISK_MB: %q", minDiskMB)
+	}
+	required := minMB * 1024 * 1024
+
+	// The target directory may not exist yet so
+	// check the closest directory that does.
+	dir := targetDir
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	available, err := diskSpace(dir)
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		logger.Info("Skipping the disk space check", zap.Error(err))
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if available >= required {
+		return nil
+	}
+	if !strings.HasPrefix(filepath.Clean(targetDir), filepath.Clean(ownedDir)+string(os.PathSeparator)) {
+		return fmt.Errorf("insufficient disk space to build flux: %d MB available, %d MB required", available/(1024*1024), minMB)
+	}
+
+	logger.Warn("Low disk space, removing the cargo target directory",
+		zap.String("dir", targetDir),
+		zap.Uint64("available_mb", available/(1024*1024)),
+		zap.Uint64("required_mb", minMB),
+	)
+	if err := os.RemoveAll(targetDir); err != nil {
+		return err
+	}
+
+	if available, err = diskSpace(dir); err != nil {
+		return err
+	} else if available < required {
+		return fmt.Errorf("insufficient disk space to build flux: %d MB available, %d MB required", available/(1024*1024), minMB)
+	}
+	return nil
+}
+
+// crossCompileEnv returns the environment for compiling the C
+// dependencies of the crates for the target triple with a cross
+// compiler. PKG_CONFIG_CROSS_CC selects the compiler and
+// PKG_CONFIG_SYSROOT the sysroot it compiles against. The variables
+// are specific to the target so they do not affect build scripts
+// that are compiled for the host.
+func crossCompileEnv(triple string) []string {
+	if triple == "" {
+		return nil
+	}
+	suffix := strings.ReplaceAll(triple, "-", "_")
+
+	var env []string
+	if cc := envCrossCC.Get(); cc != "" {
+		env = append(env, "CC_"+suffix+"="+cc)
+	}
+	if sysroot := envSysroot.Get(); sysroot != "" {
+		cflags := "--sysroot=" + sysroot + " -I" + filepath.Join(sysroot, "include")
+		if existing := os.Getenv("CFLAGS_" + suffix); existing != "" {
+			cflags += " " + existing
+		}
+		env = append(env, "CFLAGS_"+suffix+"="+cflags)
+	}
+	return env
+}
+
+// targetCPUEnv returns the rustc flags from the environment with the
+// flag that selects the cpu appended. Cargo uses CARGO_ENCODED_RUSTFLAGS
+// instead of RUSTFLAGS when it is set so the flag is added to it instead.
+func targetCPUEnv(cpu string) string {
+	if encoded, ok := os.LookupEnv("CARGO_ENCODED_RUSTFLAGS"); ok {
+		if encoded != "" {
+			encoded += "\x1f"
+		}
+		return "CARGO_ENCODED_RUSTFLAGS=" + encoded + "-Ctarget-cpu=" + cpu
+	}
+	flag := "-C target-cpu=" + cpu
+	if rustflags := os.Getenv("RUSTFLAGS"); rustflags != "" {
+		return "RUSTFLAGS=" + rustflags + " " + flag
+	}
+	return "RUSTFLAGS=" + flag
+}
+
+// cargoBuildArgs constructs the arguments to cargo for building
+// the library for the given target triple.
+func cargoBuildArgs(targetString string) ([]string, error) {
+	args := []string{"build", "--release"}
+	if targetString != "" {
+		args = append(args, "--target", targetString)
+	}
+
+	// Ensure the dependencies match the Cargo.lock exactly if requested.
+	// Frozen additionally prevents cargo from accessing the network.
+	switch locked := envCargoLocked.Get(); locked {
+	case "", "0":
+	case "1", "locked":
+		args = append(args, "--locked")
+	case "frozen":
+		args = append(args, "--frozen")
+	default:
+		return nil, fmt.Errorf("invalid value for PKG_CONFIG_CARGO_LOCKED: %q", locked)
+	}
+
+	// Link time optimization trades build time for runtime performance.
+	switch lto := envLTO.Get(); lto {
+	case "", "off":
+	case "thin", "fat":
+		args = append(args, "--config", fmt.Sprintf("profile.release.lto=%q", lto))
+	default:
+		return nil, fmt.Errorf("invalid value for PKG_CONFIG_LTO: %q", lto)
+	}
+
+	// Aborting on panic drops the unwinding tables to reduce the size
+	// of the library. A panic can then no longer unwind across the C ABI
+	// so consumers must not rely on catching one from flux.
+	switch panicStrategy := envPanic.Get(); panicStrategy {
+	case "":
+	case "abort", "unwind":
+		args = append(args, "--config", fmt.Sprintf("profile.release.panic=%q", panicStrategy))
+	default:
+		return nil, fmt.Errorf("invalid value for PKG_CONFIG_PANIC: %q", panicStrategy)
+	}
+
+	// Replace the registry with the dependencies from cargo vendor.
+	if vendorDir := envCargoVendorDir.Get(); vendorDir != "" {
+		vendorDir, err := filepath.Abs(vendorDir)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(vendorDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("PKG_CONFIG_CARGO_VENDOR_DIR %s is not a directory", vendorDir)
+		}
+		args = append(args,
+			"--config", `source.crates-io.replace-with="vendored-sources"`,
+			"--config", fmt.Sprintf("source.vendored-sources.directory=%q", vendorDir),
+		)
+	}
+
+	overrides, err := cargoProfileOverrides()
+	if err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		args = append(args, "--config", override)
+	}
+	return args, nil
+}
+
+var (
+	profileKeyRegexp   = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	profileValueRegexp = regexp.MustCompile(`^(-?\d+|true|false|"[^"]*")$`)
+)
+
+// cargoProfileOverrides reads the release profile settings from
+// PKG_CONFIG_CARGO_PROFILE_OVERRIDES. The settings are separated by
+// whitespace in the form key=value, such as codegen-units=1, and are
+// returned as cargo configuration values for the release profile.
+// Values that are not integers or booleans are quoted as strings.
+func cargoProfileOverrides() ([]string, error) {
+	var overrides []string
+	for _, setting := range strings.Fields(envCargoProfileOverrides.Get()) {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 || !profileKeyRegexp.MatchString(parts[0]) || parts[1] == "" {
+			return nil, fmt.Errorf("invalid setting in PKG_CONFIG_CARGO_PROFILE_OVERRIDES: %q must be in the form key=value", setting)
+		}
+		key, value := parts[0], parts[1]
+		if !profileValueRegexp.MatchString(value) {
+			if strings.Contains(value, `"`) {
+				return nil, fmt.Errorf("invalid value in PKG_CONFIG_CARGO_PROFILE_OVERRIDES: %q", setting)
+			}
+			value = strconv.Quote(value)
+		}
+		overrides = append(overrides, "profile.release."+key+"="+value)
+	}
+	return overrides, nil
+}
+
+// cargoTargetDir determines the cargo target directory to use for the build.
+// An empty string means cargo should use its default location within the sources.
+//
+// Sources that were copied into the cache are stored per version, so the
+// default target directory would start empty every time the version changes.
+// These builds share a target directory in the cache instead so cargo is able
+// to reuse the artifacts from a previous build.
+func (l *Library) cargoTargetDir(cache string) string {
+	if dir := envCargoTargetDir.Get(); dir != "" {
+		return dir
+	}
+
+	root := copyRoot(cache)
+	if !strings.HasPrefix(l.Dir, root+string(os.PathSeparator)) {
+		return ""
+	}
+	return l.copyTargetDir(cache)
+}
+
+// targetDirLockFile is the file in the cargo target directory that is
+// locked while a library is built there and linked into the libdir.
+const targetDirLockFile = ".pkg-config-lock"
+
+// lockTargetDir locks the cargo target directory the library is built in
+// when it is shared with other builds. Builds of other versions in the
+// same directory wait until the lock is released by calling unlock, which
+// may be called more than once.
+func (l *Library) lockTargetDir(logger *zap.Logger, cache string) (unlock func(), err error) {
+	dir := l.cargoTargetDir(cache)
+	if dir == "" {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, targetDirLockFile)
+	if locked, err := fileLocked(path); err == nil && locked {
+		logger.Info("Waiting for another build to finish with the cargo target directory", zap.String("path", path))
+	}
+	release, err := lockFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not lock the cargo target directory: %w", err)
+	}
+	var once sync.Once
+	return func() { once.Do(release) }, nil
+}
+
+// copyTargetDir returns the cargo target directory the copies of
+// every version of the sources are built in.
+func (l *Library) copyTargetDir(cache string) string {
+	return filepath.Join(copyRoot(cache), "target", filepath.FromSlash(l.Path))
+}
+
+// cargoLockHeld reports whether another process holds one of the
+// locks cargo takes on the build directories within the target dir.
+func cargoLockHeld(logger *zap.Logger, targetDir string) bool {
+	var paths []string
+	for _, pattern := range []string{
+		filepath.Join(targetDir, "*", ".cargo-lock"),
+		filepath.Join(targetDir, "*", "*", ".cargo-lock"),
+	} {
+		matches, _ := filepath.Glob(pattern)
+		paths = append(paths, matches...)
+	}
+	for _, path := range paths {
+		if locked, err := fileLocked(path); err != nil {
+			logger.Info("Unable to determine if the cargo target is locked", zap.String("path", path), zap.Error(err))
+		} else if locked {
+			return true
+		}
+	}
+	return false
+}
+
+// WritePackageConfig writes the package config file for the library.
+// Every line ends with a single line feed on all platforms so the
+// generated file is the same wherever it is written.
+func (l *Library) WritePackageConfig(w io.Writer, buildid string) error {
+	return l.writePackageConfig(w, buildid, "", "")
+}
+
+// WriteInstalledPackageConfig writes the package config file for the
+// library once it has been installed under prefix. The library is
+// expected to be installed to prefix/lib and the headers to
+// prefix/include. The package config only resolves after the
+// library has been installed, so it is meant to be shipped with
+// the library rather than queried by the wrapper.
+func (l *Library) WriteInstalledPackageConfig(w io.Writer, buildid, prefix string) error {
+	return l.writePackageConfig(w, buildid, prefix, "")
+}
+
+// WriteRelocatablePackageConfig writes the package config file for
+// the library that will be located in pcfiledir. The paths are written
+// relative to pcfiledir using the variable of the same name that
+// pkg-config defines, so they stay valid when pcfiledir is moved along
+// with the sources and the go cache, such as when they are all within
+// a directory that is copied or mounted elsewhere.
+func (l *Library) WriteRelocatablePackageConfig(w io.Writer, buildid, pcfiledir string) error {
+	return l.writePackageConfig(w, buildid, "", pcfiledir)
+}
+
+func (l *Library) writePackageConfig(w io.Writer, buildid, installPrefix, pcfiledir string) error {
+	version := strings.TrimPrefix(l.Version, "v")
+	if version == "" {
+		return fmt.Errorf("could not write package config for %s: %w", l.Dir, ErrVersionUndetermined)
+	}
+
+	cache, err := getGoCache()
+	if err != nil {
+		return err
+	}
+
+	// Prefer the flags flux declares for itself over the defaults.
+	manifest, err := readManifest(l.Dir, l.Target)
+	if err != nil {
+		return err
+	}
+
+	var (
+		prefix     = filepath.Join(l.Dir, "libflux")
+		execPrefix = filepath.Join(cache, "pkgconfig", l.archDir())
+	)
+	prefixValue, execPrefixValue := pcPath(prefix), pcPath(execPrefix)
+	if installPrefix != "" {
+		// The headers and libraries are installed together
+		// under the prefix from where they are staged.
+		prefixValue, execPrefixValue = pcPath(installPrefix), "${prefix}"
+	} else if pcfiledir != "" {
+		if prefixValue, execPrefixValue, err = relocatablePrefixes(pcfiledir, prefix, execPrefix); err != nil {
+			return err
+		}
+	}
+	variables := []string{
+		"prefix=" + prefixValue,
+		"exec_prefix=" + execPrefixValue,
+		"buildid=" + buildid,
+		"libdir=${exec_prefix}" + pcSep + "lib",
+		"includedir=${prefix}" + pcSep + "include",
+	}
+	if l.DebugInfo && !l.HeadersOnly {
+		// Only reference the debug info when the build produced it.
+		if _, err := os.Stat(filepath.Join(execPrefix, "debug", buildid)); err == nil {
+			variables = append(variables, "debuginfodir=${exec_prefix}"+pcSep+"debug"+pcSep+"${buildid}")
+		}
+	}
+	fields := map[string]string{
+		"Name":        "Flux",
+		"Version":     version,
+		"Description": "Library for the InfluxData Flux engine",
+	}
+	if manifest != nil && len(manifest.Requires) > 0 {
+		fields["Requires"] = strings.Join(manifest.Requires, " ")
+	}
+	if !l.HeadersOnly {
+		fields["Libs"] = pcLibs(l.Target, "flux-${buildid}", manifest, l.OmitSystemLibs, l.ExtraLibs)
+	}
+	fields["Cflags"] = pcCflags(manifest, l.ExtraIncludeDirs, l.Defines)
+	return writePcFile(w, variables, fields)
+}
+
+// pcLibs returns the libraries of the package config that link the
+// library with the given name from ${libdir}. The system libraries
+// are the ones flux declares in the manifest or the defaults for the
+// target when there is no manifest. The extra libraries come last.
+func pcLibs(target Target, name string, manifest *manifestEntry, omitSystem bool, extraLibs []string) string {
+	libs, systemLibs := "-L${libdir} -l"+name, target.systemLibs()
+	if isMSVC(target.cargoTarget()) {
+		// The msvc linker does not understand -l so
+		// the libraries are referenced explicitly.
+		libs = "${libdir}" + pcSep + name + ".lib"
+	}
+	if manifest != nil {
+		systemLibs = ""
+		for _, lib := range manifest.Libs {
+			systemLibs += " " + lib
+		}
+	}
+	if omitSystem {
+		systemLibs = omitSystemLibs(systemLibs)
+	}
+	libs += systemLibs
+	for _, lib := range extraLibs {
+		libs += " " + lib
+	}
+	return libs
+}
+
+// pcCflags returns the compiler flags of the package config. These are
+// the headers in ${includedir}, the flags flux declares in the manifest,
+// the extra include directories and the preprocessor definitions.
+func pcCflags(manifest *manifestEntry, includeDirs, defines []string) string {
+	cflags := "-I${includedir}"
+	if manifest != nil {
+		for _, flag := range manifest.Cflags {
+			cflags += " " + flag
+		}
+	}
+	for _, dir := range includeDirs {
+		cflags += " -I" + pcPath(dir)
+	}
+	for _, define := range defines {
+		cflags += " -D" + define
+	}
+	return cflags
+}
+
+// pcFieldOrder is the order the keyword fields of
+// a package config are written in.
+var pcFieldOrder = []string{"Name", "Version", "Description", "URL", "Requires", "Libs", "Cflags"}
+
+// writePcFile writes the variable assignments, a blank line and then
+// the keyword fields in pcFieldOrder. Fields without a value are left
+// out. Every line, including the last, ends with a single line feed.
+func writePcFile(w io.Writer, variables []string, fields map[string]string) error {
+	var sb strings.Builder
+	for _, v := range variables {
+		sb.WriteString(v + "\n")
+	}
+	sb.WriteString("\n")
+	for _, key := range pcFieldOrder {
+		if value := fields[key]; value != "" {
+			sb.WriteString(key + ": " + value + "\n")
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
 }
 
-func (l *Library) WritePackageConfig(w io.Writer, buildid string) error {
-	cache, err := getGoCache()
+// relocatablePrefixes returns the prefixes relative to the directory
+// of the package config file using the pcfiledir variable that
+// pkg-config defines.
+func relocatablePrefixes(pcfiledir, prefix, execPrefix string) (string, string, error) {
+	pcfiledir, err := filepath.Abs(pcfiledir)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	var (
-		prefix     = filepath.Join(l.Dir, "libflux")
-		execPrefix = filepath.Join(cache, "pkgconfig", l.Target.String())
-	)
-	_, _ = fmt.Fprintf(w, "prefix=%s\n", strings.ReplaceAll(prefix, string(os.PathSeparator), pcSep))
-	_, _ = fmt.Fprintf(w, "exec_prefix=%s\n", strings.ReplaceAll(execPrefix, string(os.PathSeparator), pcSep))
-	_, _ = fmt.Fprintf(w, "buildid=%s\n", buildid)
-	_, _ = io.WriteString(w, fmt.Sprintf(`libdir=${exec_prefix}%[1]slib
-includedir=${prefix}%[1]sinclude
-
-Name: Flux
-`, pcSep))
-	_, _ = fmt.Fprintf(w, "Version: %s\n", l.Version[1:])
-	_, _ = fmt.Fprintln(w, `Description: Library for the InfluxData Flux engine`)
-	if l.Target.OS == "linux" {
-		if l.Target.Static {
-			_, _ = fmt.Fprintf(w, "Libs: -L${libdir} -lflux-${buildid} -ldl -lpthread -lm\n")
-		} else {
-			_, _ = fmt.Fprintf(w, "Libs: -L${libdir} -lflux-${buildid} -ldl -lm\n")
+	prefixes := make([]string, 0, 2)
+	for _, path := range []string{prefix, execPrefix} {
+		rel, err := filepath.Rel(pcfiledir, path)
+		if err != nil {
+			return "", "", err
 		}
-	} else if l.Target.OS == "windows" {
-		_, _ = fmt.Fprintf(w, "Libs: -L${libdir} -lflux-${buildid} -lkernel32 -ladvapi32 -lbcrypt -lkernel32 -lntdll -luserenv -lws2_32 -lkernel32 -lws2_32 -lkernel32 -lntdll -lkernel32\n")
-	} else {
-		_, _ = fmt.Fprintf(w, "Libs: -L${libdir} -lflux-${buildid}\n")
+		prefixes = append(prefixes, "${pcfiledir}"+pcSep+pcPath(rel))
 	}
-	_, _ = fmt.Fprintln(w, `Cflags: -I${includedir}`)
-	return nil
+	return prefixes[0], prefixes[1], nil
+}
+
+// pcPath formats a filesystem path for use in a pkg-config file.
+// Path separators are replaced with pcSep and spaces are escaped
+// with a backslash so pkg-config keeps the path as a single argument.
+func pcPath(path string) string {
+	path = strings.ReplaceAll(path, string(os.PathSeparator), pcSep)
+	return strings.ReplaceAll(path, " ", `\ `)
 }
 
 func getModulePath(path string) string {
 	// Flux may be either in "influxdata", the "InfluxCommunity" fork, or somewhere else.
-	if matches := modulePathPattern.FindStringSubmatch(path); len(matches) == 2 {
-		return fmt.Sprintf("github.com/%v/flux", matches[1])
+	// A major version after v1 is part of the module path.
+	if matches := modulePathPattern.FindStringSubmatch(path); len(matches) == 3 {
+		return fmt.Sprintf("github.com/%v/flux%v", matches[1], matches[2])
 	}
 	return ""
 }
 
+// resolveModule determines the flux module version and directory
+// for the main module in modroot and whether the version is tagged.
+func resolveModule(ctx context.Context, modroot string, logger *zap.Logger) (module.Version, string, bool, error) {
+	if submodule := envFluxSubmodule.Get(); submodule != "" {
+		return findSubmodule(ctx, modroot, submodule, logger)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(modroot, "go.mod"))
+	if err != nil {
+		return module.Version{}, "", false, err
+	}
+
+	mod, err := modfile.Parse(modroot, data, nil)
+	if err != nil {
+		return module.Version{}, "", false, err
+	}
+	return findModule(ctx, mod, logger)
+}
+
+// findSubmodule will use the flux sources checked out at the given path,
+// such as a git submodule, instead of resolving flux from the module file.
+// A relative path is relative to the module root.
+func findSubmodule(ctx context.Context, modroot, path string, logger *zap.Logger) (module.Version, string, bool, error) {
+	dir := path
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(modroot, dir)
+	}
+	if st, err := os.Stat(dir); err != nil {
+		return module.Version{}, "", false, err
+	} else if !st.IsDir() {
+		return module.Version{}, "", false, fmt.Errorf("flux submodule path is not a directory: %s", dir)
+	}
+
+	logger.Info("Using flux submodule", zap.String("dir", dir))
+	v, tagged, err := getVersion(ctx, dir, logger)
+	if err != nil {
+		return module.Version{}, "", false, err
+	}
+	return module.Version{Version: v}, dir, tagged, nil
+}
+
 // findModule will find the module in the module file and instantiate
-// a module.Version that points to a local copy of the module.
-func findModule(mod *modfile.File, logger *zap.Logger) (module.Version, string, error) {
+// a module.Version that points to a local copy of the module. It also
+// reports whether the version is tagged.
+func findModule(ctx context.Context, mod *modfile.File, logger *zap.Logger) (module.Version, string, bool, error) {
 	logger.Info("finding module", zap.String("modfile", fmt.Sprintf("%+v", mod.Module.Syntax.Token)))
 	if modulePath := getModulePath(mod.Module.Mod.Path); len(modulePath) != 0 {
 		modroot := modload.ModRoot()
 		logger.Info("Flux module is the main module", zap.String("modroot", modroot))
-		v, err := getVersion(modroot, logger)
+		v, tagged, err := getVersion(ctx, modroot, logger)
 		if err != nil {
-			return module.Version{}, "", err
+			return module.Version{}, "", false, err
 		}
 		return module.Version{
 			Path:    modulePath,
 			Version: v,
-		}, modroot, nil
+		}, modroot, tagged, nil
 	}
 
 	// Attempt to find the module in the list of replace values.
@@ -324,86 +2116,321 @@ func findModule(mod *modfile.File, logger *zap.Logger) (module.Version, string,
 				modroot := modload.ModRoot()
 				path, err := filepath.Abs(filepath.Join(modroot, replace.New.Path))
 				if err != nil {
-					return module.Version{}, "", err
+					return module.Version{}, "", false, err
 				}
 				replace.New.Path = path
 			}
-			return getModule(replace.New, modulePath, logger)
+			ver, dir, tagged, err := getModule(ctx, replace.New, modulePath, logger)
+			if err != nil {
+				return module.Version{}, "", false, err
+			}
+			if replace.New.Version == "" {
+				checkRequireVersion(mod, replace.Old.Path, ver.Version, logger)
+			}
+			return ver, dir, tagged, nil
 		}
 	}
 
 	// Attempt to find the module in the normal dependencies.
 	for _, m := range mod.Require {
 		if modulePath := getModulePath(m.Mod.Path); len(modulePath) > 0 {
-			return getModule(m.Mod, modulePath, logger)
+			// The go command uses the next version that is not excluded
+			// instead of the required version so defer to it for the
+			// version it selects.
+			if isExcluded(mod, m.Mod) {
+				logger.Info("Required flux version is excluded, using the version selected by go", zap.String("version", m.Mod.Version))
+			}
+			ver, dir, tagged, err := getModule(ctx, m.Mod, modulePath, logger)
+			if err != nil {
+				return module.Version{}, "", false, err
+			}
+			if isExcluded(mod, ver) {
+				return module.Version{}, "", false, fmt.Errorf("go selected flux %s which is excluded by the module file", ver.Version)
+			}
+			return ver, dir, tagged, nil
+		}
+	}
+	return module.Version{}, "", false, fmt.Errorf("%w matching %s", ErrModuleNotFound, modulePathPattern)
+}
+
+// checkRequireVersion will log a warning if the version determined for
+// a module on the filesystem does not match the version the module file
+// requires. This means a different version is being built than the one
+// that was declared.
+func checkRequireVersion(mod *modfile.File, modulePath, version string, logger *zap.Logger) {
+	for _, m := range mod.Require {
+		if m.Mod.Path != modulePath {
+			continue
+		}
+		if strings.TrimPrefix(m.Mod.Version, "v") != strings.TrimPrefix(version, "v") {
+			logger.Warn("Flux version does not match the required version",
+				zap.String("path", modulePath),
+				zap.String("version", version),
+				zap.String("require", m.Mod.Version),
+			)
+		}
+		return
+	}
+}
+
+// isExcluded reports whether the module version is
+// excluded by the module file.
+func isExcluded(mod *modfile.File, ver module.Version) bool {
+	for _, x := range mod.Exclude {
+		if x.Mod == ver {
+			return true
 		}
 	}
-	return module.Version{}, "", fmt.Errorf("could not find module matching %s", modulePathPattern)
+	return false
 }
 
 // getModule will retrieve or copy the module sources to the go build cache.
-func getModule(ver module.Version, modulePath string, logger *zap.Logger) (module.Version, string, error) {
+// It also reports whether the version is tagged.
+func getModule(ctx context.Context, ver module.Version, modulePath string, logger *zap.Logger) (module.Version, string, bool, error) {
 	if strings.HasPrefix(ver.Path, "/") || strings.HasPrefix(ver.Path, ".") {
 		// We are dealing with a filepath meaning we are building from the filesystem.
 		// If this is the case, this is the same as building from the main module.
 		// We fill out the version using any git version data and return as-is.
 		logger.Info("Module path references the filesystem")
-		v, err := getVersion(ver.Path, logger)
+		v, tagged, err := getVersion(ctx, ver.Path, logger)
 		if err != nil {
-			return module.Version{}, "", err
+			return module.Version{}, "", false, err
 		}
 		abspath, err := filepath.Abs(ver.Path)
 		if err != nil {
-			return module.Version{}, "", err
+			return module.Version{}, "", false, err
 		}
-		return module.Version{Version: v}, abspath, nil
+		return module.Version{Version: v}, abspath, tagged, nil
 	}
 
 	// This references a module. Use go mod download to download the module.
 	// We use go mod download specifically to avoid downloading extra dependencies.
 	// This should work properly even if vendor was used for the dependencies.
-	return downloadModule(modulePath, logger)
+	downloaded, dir, err := downloadModule(ctx, modulePath, logger)
+	if err != nil {
+		return module.Version{}, "", false, err
+	}
+	return downloaded, dir, !isPseudoVersion(downloaded.Version), nil
 }
 
 // downloadModule will download the module to a file path.
-func downloadModule(modulePath string, logger *zap.Logger) (module.Version, string, error) {
+//
+// An interrupted download can leave an incomplete module in the module
+// cache. When PKG_CONFIG_REPAIR_MODCACHE is set, the incomplete module
+// is removed and downloaded again once. Whether the module contains
+// what is needed to build the library is checked separately.
+func downloadModule(ctx context.Context, modulePath string, logger *zap.Logger) (module.Version, string, error) {
+	ver, dir, err := goModDownload(ctx, modulePath, logger)
+	if err != nil {
+		return module.Version{}, "", err
+	}
+	err = checkModuleComplete(dir, ver)
+	if err == nil {
+		return ver, dir, nil
+	} else if envRepairModcache.Get() != "1" {
+		return module.Version{}, "", fmt.Errorf("%w: set PKG_CONFIG_REPAIR_MODCACHE=1 to download it again", err)
+	}
+	logger.Warn("Module in the module cache is incomplete. Downloading it again.", zap.String("dir", dir), zap.Error(err))
+
+	if err := removeModuleDir(dir); err != nil {
+		return module.Version{}, "", err
+	}
+	ver, dir, err = goModDownload(ctx, modulePath, logger)
+	if err != nil {
+		return module.Version{}, "", err
+	}
+	if err := checkModuleComplete(dir, ver); err != nil {
+		return module.Version{}, "", err
+	}
+	return ver, dir, nil
+}
+
+// checkModuleComplete verifies go finished extracting the module
+// into the module cache. go records the hash of the module zip once
+// the module has been extracted and leaves a partial marker behind
+// when the extraction was interrupted.
+func checkModuleComplete(dir string, ver module.Version) error {
+	encPath, err := module.EncodePath(ver.Path)
+	if err != nil {
+		return err
+	}
+	encVer, err := module.EncodeVersion(ver.Version)
+	if err != nil {
+		return err
+	}
+	modcache := strings.TrimSuffix(dir, string(filepath.Separator)+filepath.FromSlash(encPath)+"@"+encVer)
+	if modcache == dir {
+		// The module is not laid out like the module
+		// cache so there are no markers to check.
+		return nil
+	}
+
+	prefix := filepath.Join(modcache, "cache", "download", filepath.FromSlash(encPath), "@v", encVer)
+	if _, err := os.Stat(prefix + ".partial"); err == nil {
+		return fmt.Errorf("module in the module cache is incomplete: %s", dir)
+	}
+	if _, err := os.Stat(prefix + ".ziphash"); os.IsNotExist(err) {
+		return fmt.Errorf("module in the module cache is incomplete: %s", dir)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// removeModuleDir removes a module from the module cache.
+// The module cache is read only so the directories
+// are made writable before they are removed.
+func removeModuleDir(dir string) error {
+	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.Chmod(path, 0755)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// goModDownload runs go mod download for the module
+// and returns the version and directory it reports.
+func goModDownload(ctx context.Context, modulePath string, logger *zap.Logger) (module.Version, string, error) {
 	// Download the module and send the JSON output to stdout.
 	var stderr bytes.Buffer
-	cmd := exec.Command(gocmd, "mod", "download", "-json", modulePath)
+	cmd := exec.CommandContext(ctx, gocmd, "mod", "download", "-json", modulePath)
 	cmd.Stderr = &stderr
 	cmd.Dir = modload.ModRoot()
+	// Resolve flux through its own proxy without
+	// changing the proxy for the rest of the build.
+	if proxy := envGoProxy.Get(); proxy != "" {
+		cmd.Env = append(os.Environ(), "GOPROXY="+proxy)
+	}
 	data, err := cmd.Output()
 	if err != nil {
-		_ = logutil.LogOutput(&stderr, logger)
+		if ctx.Err() != nil {
+			return module.Version{}, "", ctx.Err()
+		}
+		_ = logutil.LogFailureOutput(&stderr, logger)
 		return module.Version{}, "", err
 	}
 
 	// Download succeeded. Deserialize the JSON to find the file path.
 	var m struct {
-		Dir     string
-		Path    string
-		Version string
+		Dir      string
+		Path     string
+		Version  string
+		Sum      string
+		GoModSum string
 	}
 	if err := json.Unmarshal(data, &m); err != nil {
 		return module.Version{}, "", err
 	}
-	return module.Version{Path: m.Path, Version: m.Version}, m.Dir, nil
+
+	ver := module.Version{Path: m.Path, Version: m.Version}
+	if envVerifySum.Get() == "1" {
+		gosum := filepath.Join(modload.ModRoot(), "go.sum")
+		if err := verifyModuleSum(gosum, ver, m.Sum, m.GoModSum); err != nil {
+			return module.Version{}, "", err
+		}
+	}
+	if m.Dir == "" {
+		// Older versions of go do not always report the directory.
+		// Reconstruct it from the module cache rather than assuming
+		// the default location.
+		modcache, err := getGoModCache()
+		if err != nil {
+			return module.Version{}, "", err
+		}
+		dir, err := moduleCacheDir(modcache, ver)
+		if err != nil {
+			return module.Version{}, "", err
+		}
+		m.Dir = dir
+	}
+	return ver, m.Dir, nil
+}
+
+// verifyModuleSum verifies the hashes reported for a downloaded
+// module match the entries for that module in the go.sum file.
+func verifyModuleSum(gosum string, ver module.Version, sum, goModSum string) error {
+	if sum == "" {
+		return fmt.Errorf("no checksum was reported for %s %s", ver.Path, ver.Version)
+	}
+	data, err := ioutil.ReadFile(gosum)
+	if err != nil {
+		return err
+	}
+
+	want := map[string]string{
+		ver.Version:             sum,
+		ver.Version + "/go.mod": goModSum,
+	}
+	found := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != ver.Path {
+			continue
+		}
+		h, ok := want[fields[1]]
+		if !ok || h == "" {
+			continue
+		}
+		if h != fields[2] {
+			return fmt.Errorf("checksum mismatch for %s %s: downloaded %s, go.sum has %s", ver.Path, fields[1], h, fields[2])
+		}
+		found[fields[1]] = true
+	}
+	if !found[ver.Version] {
+		return fmt.Errorf("missing go.sum entry for %s %s", ver.Path, ver.Version)
+	}
+	return nil
+}
+
+// moduleCacheDir returns the directory where the given module version
+// is extracted within the module cache.
+func moduleCacheDir(modcache string, ver module.Version) (string, error) {
+	encPath, err := module.EncodePath(ver.Path)
+	if err != nil {
+		return "", err
+	}
+	encVer, err := module.EncodeVersion(ver.Version)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(modcache, filepath.FromSlash(encPath)+"@"+encVer), nil
 }
 
-func getVersion(dir string, logger *zap.Logger) (string, error) {
+// getVersion determines the version of the flux sources in dir and
+// reports whether it is tagged. Only a release version in the module
+// cache path or a commit that git describes as exactly a tag is tagged.
+func getVersion(ctx context.Context, dir string, logger *zap.Logger) (string, bool, error) {
 	if v, err := getVersionFromPath(dir); err != nil {
 		logger.Info("Could not determine version from base path", zap.Error(err))
 	} else {
-		return v, nil
+		return v, !isPseudoVersion(v), nil
 	}
 
-	if v, err := getVersionFromGit(dir, logger); err != nil {
+	if envNoGit.Get() == "1" {
+		logger.Info("Skipping version detection with git")
+	} else if v, tagged, err := getVersionFromGit(ctx, dir, logger); err != nil {
+		if ctx.Err() != nil {
+			return "", false, ctx.Err()
+		}
 		logger.Info("Could not determine version from git data", zap.Error(err))
 	} else {
-		return v, nil
+		return v, tagged, nil
+	}
+
+	if v, err := getVersionFromFile(dir, logger); err != nil {
+		logger.Info("Could not determine version from source files", zap.Error(err))
+	} else {
+		return v, false, nil
 	}
 	logger.Info("Using default version")
-	return "v0.0.0", nil
+	return "v0.0.0", false, nil
 }
 
 func getVersionFromPath(dir string) (string, error) {
@@ -415,37 +2442,135 @@ func getVersionFromPath(dir string) (string, error) {
 	return m[1], nil
 }
 
-func getVersionFromGit(dir string, logger *zap.Logger) (string, error) {
-	var stderr bytes.Buffer
-	cmd := exec.Command("git", "describe")
-	cmd.Stderr = &stderr
-	cmd.Dir = dir
+// getVersionFromFile reads the version from a top-level VERSION file
+// or from the package section of libflux/Cargo.toml. This is used for
+// sources that were extracted from an archive without the git data.
+// A VERSION file without a valid version is logged and skipped.
+func getVersionFromFile(dir string, logger *zap.Logger) (string, error) {
+	versionFile := filepath.Join(dir, "VERSION")
+	if data, err := ioutil.ReadFile(versionFile); err == nil {
+		v, err := parseFileVersion(strings.TrimSpace(string(data)))
+		if err == nil {
+			return v, nil
+		}
+		logger.Warn("Ignoring VERSION file without a valid version", zap.String("path", versionFile), zap.Error(err))
+	}
 
-	out, err := cmd.Output()
+	cargoToml := filepath.Join(dir, "libflux", "Cargo.toml")
+	data, err := ioutil.ReadFile(cargoToml)
 	if err != nil {
-		_ = logutil.LogOutput(&stderr, logger)
 		return "", err
 	}
+
+	var section string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+		if section != "[package]" {
+			continue
+		}
+		if m := cargoVersionRegexp.FindStringSubmatch(line); m != nil {
+			return parseFileVersion(m[1])
+		}
+	}
+	return "", fmt.Errorf("no package version found in %s", cargoToml)
+}
+
+var cargoVersionRegexp = regexp.MustCompile(`^version\s*=\s*"([^"]+)"`)
+
+func parseFileVersion(s string) (string, error) {
+	v, err := semver.NewVersion(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid version %q: %w", s, err)
+	}
+	return "v" + v.String(), nil
+}
+
+// getVersionFromGit determines the version from the most recent tag
+// and reports whether the commit is exactly at that tag.
+func getVersionFromGit(ctx context.Context, dir string, logger *zap.Logger) (string, bool, error) {
+	out, err := gitDescribe(ctx, dir, logger)
+	if err != nil && envGitFetchTags.Get() == "1" {
+		// Shallow clones frequently do not have any tags.
+		// Fetch them and try again.
+		logger.Info("Fetching git tags to determine the version", zap.String("dir", dir))
+		if fetchErr := gitFetchTags(ctx, dir, logger); fetchErr != nil {
+			logger.Info("Could not fetch git tags", zap.Error(fetchErr))
+		} else {
+			out, err = gitDescribe(ctx, dir, logger)
+		}
+	}
+	if err != nil {
+		return "", false, err
+	}
 	versionStr := strings.TrimSpace(string(out))
+	// Some CI setups hand describe a full ref, so drop the ref
+	// prefix to leave the plain tag.
+	versionStr = strings.TrimPrefix(versionStr, "refs/tags/")
 
 	re := regexp.MustCompile(`(v\d+\.\d+\.\d+)(-.*)?`)
 	m := re.FindStringSubmatch(versionStr)
 	if m == nil {
-		return "", fmt.Errorf("invalid tag version format: %s", versionStr)
+		return "", false, fmt.Errorf("invalid tag version format: %s", versionStr)
 	}
 
 	if m[2] == "" {
-		return m[1][1:], nil
+		return m[1][1:], true, nil
 	}
 
 	v, err := semver.NewVersion(m[1])
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
-	*v = v.IncMinor()
-	return "v" + v.String(), nil
+
+	// There are commits since the tag so the version is bumped
+	// to the next development version according to PKG_CONFIG_VERSION_BUMP.
+	switch bump := envVersionBump.Get(); bump {
+	case "", "minor":
+		*v = v.IncMinor()
+	case "patch":
+		*v = v.IncPatch()
+	case "none":
+	default:
+		return "", false, fmt.Errorf("invalid value for PKG_CONFIG_VERSION_BUMP: %q", bump)
+	}
+	return "v" + v.String(), false, nil
+}
+
+func gitDescribe(ctx context.Context, dir string, logger *zap.Logger) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, gitcmd, "describe")
+	cmd.Stderr = &stderr
+	cmd.Dir = dir
+
+	out, err := cmd.Output()
+	if err != nil {
+		_ = logutil.LogFailureOutput(&stderr, logger)
+		return nil, err
+	}
+	return out, nil
+}
+
+func gitFetchTags(ctx context.Context, dir string, logger *zap.Logger) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, gitcmd, "fetch", "--tags", "--depth=1")
+	cmd.Stdout = &stderr
+	cmd.Stderr = &stderr
+	cmd.Dir = dir
+
+	if err := cmd.Run(); err != nil {
+		_ = logutil.LogFailureOutput(&stderr, logger)
+		return err
+	}
+	return nil
 }
 
+// getGoCache returns the go build cache directory. This is only used
+// as a scratch area for our own build products and source copies.
+// Downloaded modules are located through getGoModCache.
 func getGoCache() (string, error) {
 	if cacheDir := os.Getenv("GOCACHE"); cacheDir != "" {
 		return cacheDir, nil
@@ -459,43 +2584,128 @@ func getGoCache() (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
+// getGoModCache returns the directory where go stores downloaded modules.
+func getGoModCache() (string, error) {
+	if modCacheDir := os.Getenv("GOMODCACHE"); modCacheDir != "" {
+		return modCacheDir, nil
+	}
+
+	cmd := exec.Command(gocmd, "env", "GOMODCACHE")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	if modCacheDir := strings.TrimSpace(string(out)); modCacheDir != "" {
+		return modCacheDir, nil
+	}
+
+	// Versions of go before 1.15 do not know about GOMODCACHE
+	// and always use the first entry in GOPATH.
+	cmd = exec.Command(gocmd, "env", "GOPATH")
+	out, err = cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	gopath := filepath.SplitList(strings.TrimSpace(string(out)))
+	if len(gopath) == 0 || gopath[0] == "" {
+		return "", fmt.Errorf("could not determine module cache location")
+	}
+	return filepath.Join(gopath[0], "pkg", "mod"), nil
+}
+
+// configureTarget determines the target from the options,
+// falling back to the go environment when no target was given.
+func configureTarget(opts Options) (Target, error) {
+	if opts.Target == nil {
+		return getTarget(opts.Static)
+	}
+	target := *opts.Target
+	target.Arm = target.armVersion()
+	if opts.Static {
+		target.Static = true
+	}
+	return target, nil
+}
+
 func getTarget(static bool) (Target, error) {
-	goos := os.Getenv("GOOS")
-	if goos == "" {
-		cmd := exec.Command(gocmd, "env", "GOOS")
-		out, err := cmd.Output()
-		if err != nil {
-			return Target{}, err
-		}
-		goos = strings.TrimSpace(string(out))
+	targetFile, err := readTargetFile()
+	if err != nil {
+		return Target{}, err
 	}
 
-	goarch := os.Getenv("GOARCH")
-	if goarch == "" {
-		cmd := exec.Command(gocmd, "env", "GOARCH")
-		out, err := cmd.Output()
-		if err != nil {
-			return Target{}, err
-		}
-		goarch = strings.TrimSpace(string(out))
+	goos, err := targetVar("GOOS", targetFile)
+	if err != nil {
+		return Target{}, err
+	}
+
+	goarch, err := targetVar("GOARCH", targetFile)
+	if err != nil {
+		return Target{}, err
 	}
 
 	var goarm string
 	if goarch == "arm" {
-		goarm = os.Getenv("GOARM")
-		if goarm == "" {
-			cmd := exec.Command(gocmd, "env", "GOARM")
-			out, err := cmd.Output()
-			if err != nil {
-				return Target{}, err
-			}
-			goarm = strings.TrimSpace(string(out))
+		goarm, err = targetVar("GOARM", targetFile)
+		if err != nil {
+			return Target{}, err
 		}
 	}
 
 	return Target{OS: goos, Arch: goarch, Arm: goarm, Static: static}, nil
 }
 
+// targetVar determines the value of the go environment variable for
+// the target. The environment takes precedence over the target file
+// and go env is used when neither has a value.
+func targetVar(key string, targetFile map[string]string) (string, error) {
+	if v := os.Getenv(key); v != "" {
+		return v, nil
+	}
+	if v := targetFile[key]; v != "" {
+		return v, nil
+	}
+
+	cmd := exec.Command(gocmd, "env", key)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// readTargetFile reads the GOOS, GOARCH, and GOARM values from the
+// KEY=VALUE lines in PKG_CONFIG_TARGET_FILE if it is set.
+func readTargetFile() (map[string]string, error) {
+	path := envTargetFile.Get()
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, i+1)
+		}
+		switch key := strings.TrimSpace(parts[0]); key {
+		case "GOOS", "GOARCH", "GOARM":
+			vars[key] = strings.TrimSpace(parts[1])
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown target variable %q", path, i+1, key)
+		}
+	}
+	return vars, nil
+}
+
 // safeLink will safely link or copy the file from src to dst.
 func safeLink(src, dst string) error {
 	if err := os.Link(src, dst); err == nil {
@@ -520,16 +2730,55 @@ func safeLink(src, dst string) error {
 	return dstf.Close()
 }
 
-// gocmd is the value of environment variable GO if it is non-empty,
-// otherwise it is the string "go".
-// This allows build scripts to use a particular version of go
+// installFile links or copies the file from src to dst, replacing
+// any existing file. The file is linked to a temporary name and renamed
+// into place so concurrent invocations never observe a missing or
+// partially written dst.
+func installFile(src, dst string) error {
+	f, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_ = f.Close()
+	_ = os.Remove(tmp)
+
+	if err := safeLink(src, tmp); err != nil {
+		return err
+	}
+	// Renaming a link to the file dst already refers to
+	// does nothing so the temporary name is always removed.
+	defer func() { _ = os.Remove(tmp) }()
+	return os.Rename(tmp, dst)
+}
+
+// gocmd is the go binary used for all go commands, as determined by
+// lookupGoCmd. This allows build scripts to use a particular version of go
 // that is not necessarily on the PATH, or not necessarily even named "go".
 var gocmd string
 
-func init() {
-	if env := os.Getenv("GO"); env == "" {
-		gocmd = "go"
-	} else {
-		gocmd = env
+// gitcmd is the git executable used to determine versions.
+var gitcmd = "git"
+
+// lookupGoCmd returns the value of the environment variable
+// PKG_CONFIG_GO_BINARY or GO, in that order, if either is non-empty.
+// Otherwise it is the string "go".
+func lookupGoCmd() string {
+	for _, setting := range []*settings.Setting{envGoBinary, envGo} {
+		if env := setting.Get(); env != "" {
+			return env
+		}
 	}
+	return "go"
+}
+
+func init() {
+	ResolveGoCmd()
+}
+
+// ResolveGoCmd determines the go binary from the environment again.
+// It is called after the environment has been changed, such as when
+// the variables are loaded from a file.
+func ResolveGoCmd() {
+	gocmd = lookupGoCmd()
 }
@@ -0,0 +1,3919 @@
+package flux
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/pkg-config/internal/modfile"
+	"github.com/influxdata/pkg-config/internal/module"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestGetGoModCache(t *testing.T) {
+	modcache := filepath.Join(t.TempDir(), "modcache")
+	t.Setenv("GOMODCACHE", modcache)
+
+	got, err := getGoModCache()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != modcache {
+		t.Errorf("unexpected module cache: got %q, want %q", got, modcache)
+	}
+}
+
+func TestModuleCacheDir(t *testing.T) {
+	modcache := filepath.Join(t.TempDir(), "modcache")
+	ver := module.Version{Path: "github.com/InfluxCommunity/flux", Version: "v0.194.3"}
+
+	got, err := moduleCacheDir(modcache, ver)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := filepath.Join(modcache, "github.com", "!influx!community", "flux@v0.194.3")
+	if got != want {
+		t.Errorf("unexpected module directory: got %q, want %q", got, want)
+	}
+
+	// The version must still be discoverable from the custom location.
+	if v, err := getVersionFromPath(got); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if v != ver.Version {
+		t.Errorf("unexpected version: got %q, want %q", v, ver.Version)
+	}
+}
+
+func TestLibrary_SourceDir(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("GOCACHE", cache)
+
+	dir := t.TempDir()
+	l := &Library{Path: "github.com/influxdata/flux", Version: "v0.194.3", Dir: dir}
+	if got, err := l.SourceDir(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if got != dir {
+		t.Errorf("unexpected source dir for writable sources: got %q, want %q", got, dir)
+	}
+
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chmod(dir, 0755) }()
+
+	want := filepath.Join(cache, "pkgconfig", "github.com/influxdata/flux@v0.194.3")
+	if got, err := l.SourceDir(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if got != want {
+		t.Errorf("unexpected source dir for read only sources: got %q, want %q", got, want)
+	}
+}
+
+func TestLibrary_BuildReusesCargoTargetDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+
+	// The fake cargo records the target directory it was given.
+	tmpdir, _ := fakeCargo(t, "echo \"$CARGO_TARGET_DIR\" >> \"$dir/target_dir\"\n")
+
+	cache := t.TempDir()
+	var targetDirs []string
+	for _, version := range []string{"v0.194.3", "v0.194.4"} {
+		l := &Library{
+			Path:    "github.com/influxdata/flux",
+			Version: version,
+			Target:  Target{OS: "linux", Arch: "amd64"},
+		}
+		l.Dir = l.copyDir(cache)
+		if err := os.MkdirAll(filepath.Join(l.Dir, "libflux"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		targetdir, err := l.build(context.Background(), zap.NewNop(), cache)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		targetDirs = append(targetDirs, targetdir)
+	}
+
+	want := filepath.Join(cache, "pkgconfig", "target", "github.com", "influxdata", "flux", "x86_64-unknown-linux-gnu", "release")
+	for i, got := range targetDirs {
+		if got != want {
+			t.Errorf("unexpected target dir for build %d: got %q, want %q", i, got, want)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpdir, "target_dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantEnv := filepath.Join(cache, "pkgconfig", "target", "github.com", "influxdata", "flux")
+	if got, want := string(data), wantEnv+"\n"+wantEnv+"\n"; got != want {
+		t.Errorf("unexpected CARGO_TARGET_DIR values: got %q, want %q", got, want)
+	}
+}
+
+func TestLibrary_BuildOffline(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+
+	for _, tt := range []struct {
+		name    string
+		offline string
+		userSet string
+		want    string
+	}{
+		{name: "Offline", offline: "1", want: "true"},
+		{name: "Online", offline: "", want: ""},
+		{name: "UserSet", offline: "1", userSet: "false", want: "false"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CARGO_TARGET_DIR", "")
+			t.Setenv("PKG_CONFIG_OFFLINE", tt.offline)
+			if tt.userSet != "" {
+				t.Setenv("CARGO_NET_OFFLINE", tt.userSet)
+			} else if v, ok := os.LookupEnv("CARGO_NET_OFFLINE"); ok {
+				_ = os.Unsetenv("CARGO_NET_OFFLINE")
+				defer func() { _ = os.Setenv("CARGO_NET_OFFLINE", v) }()
+			}
+
+			// The fake cargo records the offline setting it was given.
+			tmpdir, _ := fakeCargo(t, "echo \"$CARGO_NET_OFFLINE\" > \"$dir/offline\"\n")
+
+			cache := t.TempDir()
+			l := &Library{
+				Path:    "github.com/influxdata/flux",
+				Version: "v0.194.3",
+				Target:  Target{OS: "linux", Arch: "amd64"},
+			}
+			l.Dir = l.copyDir(cache)
+			if err := os.MkdirAll(filepath.Join(l.Dir, "libflux"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := l.build(context.Background(), zap.NewNop(), cache); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(tmpdir, "offline"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := strings.TrimSpace(string(data)), tt.want; got != want {
+				t.Errorf("unexpected CARGO_NET_OFFLINE: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLibrary_BuildTargetCPU(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+	if v, ok := os.LookupEnv("CARGO_ENCODED_RUSTFLAGS"); ok {
+		_ = os.Unsetenv("CARGO_ENCODED_RUSTFLAGS")
+		defer func() { _ = os.Setenv("CARGO_ENCODED_RUSTFLAGS", v) }()
+	}
+
+	cross := Target{OS: "linux", Arch: "s390x"}
+	if cross.isHost() {
+		cross.Arch = "mips"
+	}
+	for _, tt := range []struct {
+		name      string
+		target    Target
+		cpu       string
+		rustflags string
+		want      string
+		warn      bool
+	}{
+		{name: "Native", target: Target{OS: runtime.GOOS, Arch: runtime.GOARCH}, cpu: "native", want: "-C target-cpu=native"},
+		{name: "CrossNative", target: cross, cpu: "native", rustflags: "-g", want: "-g -C target-cpu=native", warn: true},
+		{name: "CrossMicroarch", target: cross, cpu: "z15", want: "-C target-cpu=z15"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_TARGET_CPU", tt.cpu)
+			t.Setenv("RUSTFLAGS", tt.rustflags)
+
+			// The fake cargo records the rustc flags it was given.
+			tmpdir, _ := fakeCargo(t, "echo \"$RUSTFLAGS\" > \"$dir/rustflags\"\n")
+
+			l := &Library{Dir: t.TempDir(), Target: tt.target}
+			if err := os.MkdirAll(filepath.Join(l.Dir, "libflux"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			core, logs := observer.New(zap.WarnLevel)
+			if _, err := l.build(context.Background(), zap.New(core), t.TempDir()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(tmpdir, "rustflags"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(data)); got != tt.want {
+				t.Errorf("unexpected RUSTFLAGS: got %q, want %q", got, tt.want)
+			}
+			warned := logs.FilterMessageSnippet("PKG_CONFIG_TARGET_CPU=native").Len() > 0
+			if warned != tt.warn {
+				t.Errorf("unexpected warning for native cpu: got %v, want %v", warned, tt.warn)
+			}
+		})
+	}
+
+	t.Setenv("CARGO_ENCODED_RUSTFLAGS", "-g")
+	if got, want := targetCPUEnv("native"), "CARGO_ENCODED_RUSTFLAGS=-g\x1f-Ctarget-cpu=native"; got != want {
+		t.Errorf("unexpected encoded rustc flags: got %q, want %q", got, want)
+	}
+}
+
+func TestLibrary_BuildIncremental(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+	if v, ok := os.LookupEnv("CARGO_INCREMENTAL"); ok {
+		_ = os.Unsetenv("CARGO_INCREMENTAL")
+		defer func() { _ = os.Setenv("CARGO_INCREMENTAL", v) }()
+	}
+
+	for _, tt := range []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "Default", want: "unset"},
+		{name: "Disabled", value: "0", want: "0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_CARGO_INCREMENTAL", tt.value)
+
+			// The fake cargo records whether incremental compilation was set.
+			tmpdir, _ := fakeCargo(t, "echo \"${CARGO_INCREMENTAL-unset}\" > \"$dir/incremental\"\n")
+
+			l := &Library{Dir: t.TempDir(), Target: Target{OS: runtime.GOOS, Arch: runtime.GOARCH}}
+			if err := os.MkdirAll(filepath.Join(l.Dir, "libflux"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := l.build(context.Background(), zap.NewNop(), t.TempDir()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(tmpdir, "incremental"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(data)); got != tt.want {
+				t.Errorf("unexpected CARGO_INCREMENTAL: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLibrary_NeedsBuild(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("GOCACHE", t.TempDir())
+	t.Setenv("CARGO_TARGET_DIR", t.TempDir())
+	t.Setenv("RUSTC", filepath.Join(t.TempDir(), "rustc"))
+
+	// The fake cargo writes an empty library.
+	l := &Library{Dir: t.TempDir(), Target: Target{OS: runtime.GOOS, Arch: runtime.GOARCH}}
+	triple := l.Target.DetermineCargoTarget(zap.NewNop())
+	release := filepath.Join(os.Getenv("CARGO_TARGET_DIR"), triple, "release")
+	fakeCargo(t, "mkdir -p "+release+" && touch "+filepath.Join(release, libraryFilename(triple, "flux"))+"\n")
+
+	source := filepath.Join(l.Dir, "libflux", "lib.rs")
+	if err := os.MkdirAll(filepath.Dir(source), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(source, []byte("// v1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(wantNeeded bool, wantReason string) {
+		t.Helper()
+		needed, reason, err := l.NeedsBuild(context.Background(), zap.NewNop())
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if needed != wantNeeded || reason != wantReason {
+			t.Errorf("unexpected result: got %v %q, want %v %q", needed, reason, wantNeeded, wantReason)
+		}
+	}
+	check(true, "library has not been built")
+
+	if _, err := l.build(context.Background(), zap.NewNop(), os.Getenv("GOCACHE")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	check(false, "sources and build inputs are unchanged since the last build")
+
+	if err := ioutil.WriteFile(source, []byte("// v2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check(true, "sources or build inputs have changed since the last build")
+}
+
+func TestLibrary_BuildVendored(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+	if v, ok := os.LookupEnv("CARGO_NET_OFFLINE"); ok {
+		_ = os.Unsetenv("CARGO_NET_OFFLINE")
+		defer func() { _ = os.Setenv("CARGO_NET_OFFLINE", v) }()
+	}
+
+	vendorDir := t.TempDir()
+	t.Setenv("PKG_CONFIG_CARGO_VENDOR_DIR", vendorDir)
+
+	// The fake cargo records the offline setting and its arguments.
+	tmpdir, _ := fakeCargo(t, "echo \"$CARGO_NET_OFFLINE\" > \"$dir/build\"\nfor arg; do echo \"$arg\" >> \"$dir/build\"; done\n")
+
+	cache := t.TempDir()
+	l := &Library{
+		Path:    "github.com/influxdata/flux",
+		Version: "v0.194.3",
+		Target:  Target{OS: "linux", Arch: "amd64"},
+	}
+	l.Dir = l.copyDir(cache)
+	if err := os.MkdirAll(filepath.Join(l.Dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.build(context.Background(), zap.NewNop(), cache); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpdir, "build"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if got := lines[0]; got != "true" {
+		t.Errorf("unexpected CARGO_NET_OFFLINE: got %q, want %q", got, "true")
+	}
+	args := strings.Join(lines[1:], " ")
+	for _, want := range []string{
+		`--config source.crates-io.replace-with="vendored-sources"`,
+		fmt.Sprintf("--config source.vendored-sources.directory=%q", vendorDir),
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("expected cargo arguments to contain %q, got %q", want, args)
+		}
+	}
+
+	// A missing vendor directory is reported before building.
+	t.Setenv("PKG_CONFIG_CARGO_VENDOR_DIR", filepath.Join(tmpdir, "missing"))
+	if _, err := l.build(context.Background(), zap.NewNop(), cache); err == nil {
+		t.Error("expected error for missing vendor directory")
+	}
+}
+
+func TestLibrary_BuildRelocatedTargetDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+
+	// The fake cargo reports a target directory that was
+	// relocated by the cargo configuration.
+	tmpdir := t.TempDir()
+	relocated := filepath.Join(tmpdir, "relocated")
+	cargo := filepath.Join(tmpdir, "cargo")
+	script := "#!/bin/sh\nif [ \"$1\" = metadata ]; then\n  echo '{\"packages\":[],\"target_directory\":\"" + relocated + "\"}'\nfi\n"
+	if err := ioutil.WriteFile(cargo, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CARGO", cargo)
+
+	l := &Library{
+		Path:    "github.com/influxdata/flux",
+		Version: "v0.194.3",
+		Dir:     t.TempDir(),
+		Target:  Target{OS: "linux", Arch: "amd64"},
+	}
+	if err := os.MkdirAll(filepath.Join(l.Dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	targetdir, err := l.build(context.Background(), zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := filepath.Join(relocated, "x86_64-unknown-linux-gnu", "release"); targetdir != want {
+		t.Errorf("unexpected target dir: got %q, want %q", targetdir, want)
+	}
+}
+
+func TestLibrary_BuildSecondVersionIsIncremental(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+	t.Setenv("PKG_CONFIG_COPY_DIR", "")
+
+	// The fake cargo is slow unless it finds the incremental
+	// state left in the target directory by an earlier build.
+	tmpdir, _ := fakeCargo(t, `if [ -d "$CARGO_TARGET_DIR/incremental" ]; then
+	echo incremental >> "$dir/runs"
+	exit 0
+fi
+sleep 1
+mkdir -p "$CARGO_TARGET_DIR/incremental"
+echo full >> "$dir/runs"
+`)
+
+	// The second version only differs from the first by a comment.
+	cache := t.TempDir()
+	var elapsed []time.Duration
+	for i, version := range []string{"v0.194.3", "v0.194.4"} {
+		l := &Library{
+			Path:    "github.com/influxdata/flux",
+			Version: version,
+			Target:  Target{OS: "linux", Arch: "amd64"},
+		}
+		l.Dir = l.copyDir(cache)
+		src := filepath.Join(l.Dir, "libflux", "src", "lib.rs")
+		if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+			t.Fatal(err)
+		}
+		contents := fmt.Sprintf("// build %d\npub fn flux() {}\n", i)
+		if err := ioutil.WriteFile(src, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		if _, err := l.build(context.Background(), zap.NewNop(), cache); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		elapsed = append(elapsed, time.Since(start))
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpdir, "runs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "full\nincremental\n"; got != want {
+		t.Errorf("expected the second build to be incremental: got %q, want %q", got, want)
+	}
+	if elapsed[1] >= elapsed[0] {
+		t.Errorf("expected the second build to be faster: first took %s, second took %s", elapsed[0], elapsed[1])
+	}
+}
+
+func TestLibrary_InstallVersionsConcurrently(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+	t.Setenv("PKG_CONFIG_COPY_DIR", "")
+	cache := t.TempDir()
+	t.Setenv("GOCACHE", cache)
+
+	// The fake cargo builds the library from the sources after a delay
+	// so the builds of both versions overlap without a lock. Like cargo,
+	// it replaces the library rather than writing over it.
+	releaseDir := `"$CARGO_TARGET_DIR/x86_64-unknown-linux-gnu/release"`
+	tmpdir, builds := fakeCargo(t, `echo start >> "$dir/log"
+sleep 1
+mkdir -p `+releaseDir+`
+cat src/lib.rs > "$dir/lib.$$"
+mv "$dir/lib.$$" `+releaseDir+`/libflux.a
+echo end >> "$dir/log"
+`)
+
+	versions := []string{"v0.194.3", "v0.194.4"}
+	libs := make([]*Library, len(versions))
+	for i, version := range versions {
+		l := &Library{
+			Path:    "github.com/influxdata/flux",
+			Version: version,
+			Target:  Target{OS: "linux", Arch: "amd64"},
+		}
+		l.Dir = l.copyDir(cache)
+		src := filepath.Join(l.Dir, "libflux", "src", "lib.rs")
+		if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(src, []byte("// "+version+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		libs[i] = l
+	}
+
+	buildids := make([]string, len(libs))
+	errs := make([]error, len(libs))
+	var wg sync.WaitGroup
+	for i, l := range libs {
+		wg.Add(1)
+		go func(i int, l *Library) {
+			defer wg.Done()
+			buildids[i], errs[i] = l.Install(context.Background(), zap.NewNop())
+		}(i, l)
+	}
+	wg.Wait()
+
+	if got := builds(); got != 2 {
+		t.Errorf("expected both versions to be built, got %d builds", got)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(tmpdir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "start\nend\nstart\nend\n"; got != want {
+		t.Errorf("expected the builds to wait for each other: got %q, want %q", got, want)
+	}
+
+	libdir := filepath.Join(cache, "pkgconfig", "linux_amd64", "lib")
+	for i, version := range versions {
+		if errs[i] != nil {
+			t.Errorf("unexpected error for %s: %s", version, errs[i])
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(libdir, "libflux-"+buildids[i]+".a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(data), "// "+version+"\n"; got != want {
+			t.Errorf("unexpected library installed for %s: got %q, want %q", version, got, want)
+		}
+	}
+}
+
+func TestLibrary_CargoTargetDirInPlace(t *testing.T) {
+	t.Setenv("CARGO_TARGET_DIR", "")
+
+	dir := t.TempDir()
+	l := &Library{Dir: dir}
+	if got := l.cargoTargetDir(t.TempDir()); got != "" {
+		t.Errorf("expected default cargo target dir for in place sources, got %q", got)
+	}
+}
+
+func TestPcPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/usr/local/flux", want: "/usr/local/flux"},
+		{path: "/Users/jane doe/go/pkg/mod", want: `/Users/jane\ doe/go/pkg/mod`},
+		{path: "/tmp/a  b", want: `/tmp/a\ \ b`},
+	}
+	if runtime.GOOS == "windows" {
+		tests = []struct {
+			path string
+			want string
+		}{
+			{path: `C:\flux`, want: `C:\\flux`},
+			{path: `C:\Program Files\flux`, want: `C:\\Program\ Files\\flux`},
+			{path: `C:\Users\jane doe\go`, want: `C:\\Users\\jane\ doe\\go`},
+		}
+	}
+	for _, tt := range tests {
+		if got := pcPath(tt.path); got != tt.want {
+			t.Errorf("unexpected path for %q: got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestLibrary_WritePackageConfigWithSpaces(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("pkg-config output uses the escaped windows separator")
+	}
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Skip("pkg-config is not installed")
+	}
+
+	cache := filepath.Join(t.TempDir(), "go cache")
+	t.Setenv("GOCACHE", cache)
+
+	dir := filepath.Join(t.TempDir(), "my flux")
+	l := &Library{
+		Version: "v0.194.3",
+		Dir:     dir,
+		Target:  Target{OS: "linux", Arch: "amd64"},
+	}
+
+	pcdir := t.TempDir()
+	f, err := os.Create(filepath.Join(pcdir, "flux.pc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WritePackageConfig(f, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// pkg-config keeps each path as a single flag and escapes the spaces
+	// in its output so the caller can split the flags on whitespace.
+	cmd := exec.Command(pkgConfigExec, "--cflags-only-I", "--libs-only-L", "flux")
+	cmd.Env = append(os.Environ(), "PKG_CONFIG_PATH="+pcdir)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var flags []string
+	for _, flag := range strings.Split(strings.TrimSpace(string(out)), " ") {
+		if n := len(flags); n > 0 && strings.HasSuffix(flags[n-1], `\`) {
+			flags[n-1] = strings.TrimSuffix(flags[n-1], `\`) + " " + flag
+			continue
+		}
+		flags = append(flags, flag)
+	}
+	want := []string{
+		"-I" + filepath.Join(dir, "libflux", "include"),
+		"-L" + filepath.Join(cache, "pkgconfig", "linux_amd64", "lib"),
+	}
+	if !reflect.DeepEqual(flags, want) {
+		t.Errorf("unexpected flags: got %q, want %q", flags, want)
+	}
+}
+
+func TestLibrary_WritePackageConfigLineEndings(t *testing.T) {
+	t.Setenv("GOCACHE", t.TempDir())
+
+	l := &Library{
+		Version:   "v0.194.3",
+		Dir:       t.TempDir(),
+		Target:    Target{OS: "windows", Arch: "amd64"},
+		ExtraLibs: []string{"-lextra"},
+		Defines:   []string{"FLUX_STATIC"},
+	}
+
+	// Write to a file so the test covers what ends up on disk.
+	path := filepath.Join(t.TempDir(), "flux.pc")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WritePackageConfig(f, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("\r")) {
+		t.Errorf("expected only line feeds in package config, got:\n%q", data)
+	}
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		t.Errorf("expected package config to end with a line feed, got:\n%q", data)
+	}
+}
+
+func TestLibrary_WritePackageConfigGolden(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the golden file uses the unix path separator")
+	}
+	t.Setenv("GOCACHE", t.TempDir())
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"platforms": {"linux": {"libs": ["-ldl", "-lm"], "cflags": ["-DFLUX_NO_STD"], "requires": ["zlib"]}}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "libflux", manifestFile), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &Library{
+		Version:   "v0.194.3",
+		Dir:       dir,
+		Target:    Target{OS: "linux", Arch: "amd64"},
+		ExtraLibs: []string{"-lextra"},
+		Defines:   []string{"FLUX_STATIC"},
+	}
+	var buf bytes.Buffer
+	if err := l.WriteInstalledPackageConfig(&buf, "abc", "/usr/local"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "flux.pc.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != string(golden) {
+		t.Errorf("package config does not match testdata/flux.pc.golden:\ngot:\n%s\nwant:\n%s", got, golden)
+	}
+}
+
+func TestLibrary_CopyIfReadOnlyLibfluxDir(t *testing.T) {
+	cache := t.TempDir()
+
+	// The module root is writable, but the libflux directory is not.
+	dir := t.TempDir()
+	libfluxDir := filepath.Join(dir, "libflux")
+	if err := os.Mkdir(libfluxDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(libfluxDir, "Cargo.toml"), []byte("[workspace]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(libfluxDir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chmod(libfluxDir, 0755) }()
+
+	l := &Library{Path: "github.com/influxdata/flux", Version: "v0.194.3", Dir: dir}
+	if err := l.copyIfReadOnly(context.Background(), zap.NewNop(), cache); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if want := l.copyDir(cache); l.Dir != want {
+		t.Fatalf("unexpected source dir: got %q, want %q", l.Dir, want)
+	}
+	if _, err := os.Stat(filepath.Join(l.Dir, "libflux", "Cargo.toml")); err != nil {
+		t.Errorf("expected sources to be copied: %s", err)
+	}
+}
+
+func TestLibrary_CopyIfReadOnly(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		mode   os.FileMode
+		copied bool
+	}{
+		{name: "ReadOnly", mode: 0555, copied: true},
+		{name: "Writable", mode: 0755, copied: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := t.TempDir()
+			dir := t.TempDir()
+			if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module github.com/influxdata/flux\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(dir, tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.Chmod(dir, 0755) }()
+
+			l := &Library{Path: "github.com/influxdata/flux", Version: "v0.194.3", Dir: dir}
+			if err := l.copyIfReadOnly(context.Background(), zap.NewNop(), cache); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			want := dir
+			if tt.copied {
+				want = l.copyDir(cache)
+			}
+			if l.Dir != want {
+				t.Errorf("unexpected source dir: got %q, want %q", l.Dir, want)
+			}
+			if _, err := os.Stat(filepath.Join(l.Dir, "go.mod")); err != nil {
+				t.Errorf("expected sources in %s: %s", l.Dir, err)
+			}
+		})
+	}
+}
+
+func TestLibrary_CopyIfReadOnlyCopyDir(t *testing.T) {
+	cache := t.TempDir()
+	copyDir := filepath.Join(t.TempDir(), "copies")
+	t.Setenv("PKG_CONFIG_COPY_DIR", copyDir)
+	t.Setenv("CARGO_TARGET_DIR", "")
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module github.com/influxdata/flux\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chmod(dir, 0755) }()
+
+	l := &Library{Path: "github.com/influxdata/flux", Version: "v0.194.3", Dir: dir}
+	if err := l.copyIfReadOnly(context.Background(), zap.NewNop(), cache); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := filepath.Join(copyDir, "github.com", "influxdata", "flux@v0.194.3")
+	if l.Dir != want {
+		t.Fatalf("unexpected source dir: got %q, want %q", l.Dir, want)
+	}
+	if _, err := os.Stat(filepath.Join(l.Dir, "go.mod")); err != nil {
+		t.Errorf("expected sources to be copied: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(cache, "pkgconfig")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be copied into the cache, got %v", err)
+	}
+	if got, want := l.cargoTargetDir(cache), filepath.Join(copyDir, "target", "github.com", "influxdata", "flux"); got != want {
+		t.Errorf("unexpected cargo target dir: got %q, want %q", got, want)
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want Target
+		err  bool
+	}{
+		{s: "linux/amd64", want: Target{OS: "linux", Arch: "amd64"}},
+		{s: "linux/amd64/static", want: Target{OS: "linux", Arch: "amd64", Static: true}},
+		{s: "linux/arm/7", want: Target{OS: "linux", Arch: "arm", Arm: "7"}},
+		{s: "linux/arm/v6/static", want: Target{OS: "linux", Arch: "arm", Arm: "6", Static: true}},
+		{s: "darwin/arm64", want: Target{OS: "darwin", Arch: "arm64"}},
+		{s: "linux", err: true},
+		{s: "linux/", err: true},
+		{s: "linux/amd64/7", err: true},
+		{s: "linux/arm/static/7", err: true},
+		{s: "linux/amd64/static/static", err: true},
+	} {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseTarget(tt.s)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("unexpected target: got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureTarget_Override(t *testing.T) {
+	// The go command must not be consulted when a target is given.
+	t.Setenv("GO", filepath.Join(t.TempDir(), "missing-go"))
+	t.Setenv("GOOS", "")
+	t.Setenv("GOARCH", "")
+
+	target := Target{OS: "linux", Arch: "arm64"}
+	got, err := configureTarget(Options{Static: true, Target: &target})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := (Target{OS: "linux", Arch: "arm64", Static: true}); got != want {
+		t.Errorf("unexpected target: got %+v, want %+v", got, want)
+	}
+}
+
+func TestFindModule_RequireVersionMismatch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	gitInit(t, dir, "v0.190.0")
+
+	for _, tt := range []struct {
+		require string
+		warn    bool
+	}{
+		{require: "v0.194.3", warn: true},
+		{require: "v0.190.0", warn: false},
+	} {
+		t.Run(tt.require, func(t *testing.T) {
+			data := "module example.com/app\n\n" +
+				"require github.com/influxdata/flux " + tt.require + "\n\n" +
+				"replace github.com/influxdata/flux => " + dir + "\n"
+			mod, err := modfile.Parse("go.mod", []byte(data), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			core, logs := observer.New(zap.InfoLevel)
+			if _, _, _, err := findModule(context.Background(), mod, zap.New(core)); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			warnings := logs.FilterMessage("Flux version does not match the required version").All()
+			if !tt.warn {
+				if len(warnings) != 0 {
+					t.Errorf("unexpected warning: %v", warnings[0].ContextMap())
+				}
+				return
+			}
+			if len(warnings) != 1 {
+				t.Fatalf("expected one warning, got %d", len(warnings))
+			}
+			fields := warnings[0].ContextMap()
+			if fields["require"] != tt.require || fields["version"] != "0.190.0" {
+				t.Errorf("unexpected warning fields: %v", fields)
+			}
+		})
+	}
+}
+
+func TestFindModule_Exclude(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake go requires a unix shell")
+	}
+
+	for _, tt := range []struct {
+		name     string
+		selected string
+		wantErr  bool
+	}{
+		{name: "NextVersion", selected: "v0.194.4"},
+		{name: "ExcludedVersion", selected: "v0.194.3", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The fake go reports the version it selected for the module.
+			dir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(dir, "libflux"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "libflux", "Cargo.toml"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			script := "#!/bin/sh\n[ \"$1 $2 $3 $4\" = \"mod download -json github.com/influxdata/flux\" ] || exit 1\n" +
+				"echo '{\"Path\": \"github.com/influxdata/flux\", \"Version\": \"" + tt.selected + "\", \"Dir\": \"" + dir + "\"}'\n"
+			fakeGo := filepath.Join(t.TempDir(), "go")
+			if err := ioutil.WriteFile(fakeGo, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			gocmd = fakeGo
+			defer func() { gocmd = "go" }()
+
+			data := "module example.com/app\n\n" +
+				"require github.com/influxdata/flux v0.194.3\n\n" +
+				"exclude github.com/influxdata/flux v0.194.3\n"
+			mod, err := modfile.Parse("go.mod", []byte(data), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			core, logs := observer.New(zap.InfoLevel)
+			ver, _, _, err := findModule(context.Background(), mod, zap.New(core))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error for excluded version, got %s", ver.Version)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if ver.Version != tt.selected {
+				t.Errorf("unexpected version: got %s, want %s", ver.Version, tt.selected)
+			}
+			if logs.FilterMessage("Required flux version is excluded, using the version selected by go").Len() != 1 {
+				t.Error("expected the excluded version to be logged")
+			}
+		})
+	}
+}
+
+func TestFindModule_MajorVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake go requires a unix shell")
+	}
+
+	// The fake go only downloads the module at the major version path.
+	modcache := t.TempDir()
+	dir := filepath.Join(modcache, "github.com", "influxdata", "flux", "v2@v2.1.0")
+	if err := os.MkdirAll(filepath.Join(dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "libflux", "Cargo.toml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	download := filepath.Join(modcache, "cache", "download", "github.com", "influxdata", "flux", "v2", "@v")
+	if err := os.MkdirAll(download, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(download, "v2.1.0.ziphash"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\n[ \"$1 $2 $3 $4\" = \"mod download -json github.com/influxdata/flux/v2\" ] || exit 1\n" +
+		"echo '{\"Path\": \"github.com/influxdata/flux/v2\", \"Version\": \"v2.1.0\", \"Dir\": \"" + dir + "\"}'\n"
+	fakeGo := filepath.Join(t.TempDir(), "go")
+	if err := ioutil.WriteFile(fakeGo, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gocmd = fakeGo
+	defer func() { gocmd = "go" }()
+
+	data := "module example.com/app\n\n" +
+		"require github.com/influxdata/flux/v2 v2.1.0\n"
+	mod, err := modfile.Parse("go.mod", []byte(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ver, got, _, err := findModule(context.Background(), mod, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := (module.Version{Path: "github.com/influxdata/flux/v2", Version: "v2.1.0"}); ver != want {
+		t.Errorf("unexpected module: got %v, want %v", ver, want)
+	}
+	if got != dir {
+		t.Errorf("unexpected module directory: got %q, want %q", got, dir)
+	}
+	if v, err := getVersionFromPath(dir); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if v != "v2.1.0" {
+		t.Errorf("unexpected version from path: got %q, want %q", v, "v2.1.0")
+	}
+
+	for path, want := range map[string]string{
+		"github.com/influxdata/flux":         "github.com/influxdata/flux",
+		"github.com/InfluxCommunity/flux/v3": "github.com/InfluxCommunity/flux/v3",
+		"github.com/influxdata/flux/v1":      "",
+		"github.com/influxdata/flux-lsp":     "",
+	} {
+		if got := getModulePath(path); got != want {
+			t.Errorf("unexpected module path for %s: got %q, want %q", path, got, want)
+		}
+	}
+}
+
+// gitInit creates a git repository in dir with a single
+// commit tagged with the given tag.
+func gitInit(t *testing.T, dir, tag string) {
+	t.Helper()
+	git(t, dir, "init", "-q")
+	gitCommit(t, dir)
+	git(t, dir, "tag", "-a", tag, "-m", tag)
+}
+
+// gitCommit adds an empty commit to the git repository in dir.
+func gitCommit(t *testing.T, dir string) {
+	t.Helper()
+	git(t, dir, "commit", "-q", "--allow-empty", "-m", "commit")
+}
+
+func git(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test",
+		"GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test",
+		"GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+// fakeCargo sets CARGO to a fake cargo that fails every command
+// except the build, which it counts and then runs the script for.
+// The script can keep its records in $dir, the returned directory,
+// and builds reports how many times cargo build was run.
+func fakeCargo(t *testing.T, script string) (dir string, builds func() int) {
+	t.Helper()
+	dir = t.TempDir()
+	cargo := filepath.Join(dir, "cargo")
+	contents := "#!/bin/sh\ndir='" + dir + "'\n[ \"$1\" = build ] || exit 1\necho build >> \"$dir/builds\"\n" + script
+	if err := ioutil.WriteFile(cargo, []byte(contents), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CARGO", cargo)
+
+	builds = func() int {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "builds"))
+		if err != nil {
+			return 0
+		}
+		return strings.Count(string(data), "build\n")
+	}
+	return dir, builds
+}
+
+func TestCheckLibfluxDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkLibfluxDir(dir); err == nil {
+		t.Fatal("expected error for module without libflux")
+	} else if want := filepath.Join(dir, "libflux"); !strings.Contains(err.Error(), want) {
+		t.Errorf("expected error to name %s, got: %s", want, err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLibfluxDir(dir); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestNewLibrary_NoLibfluxCrate(t *testing.T) {
+	// The module has a libflux directory without a rust crate.
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ver := module.Version{Path: "github.com/influxdata/flux", Version: "v0.194.3"}
+	target := Target{OS: "linux", Arch: "amd64"}
+	if _, err := newLibrary(zap.NewNop(), Options{}, target, ver, dir, true); err == nil {
+		t.Fatal("expected error for module without the libflux crate")
+	} else if !strings.Contains(err.Error(), "no libflux Rust crate") {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// Only the headers are needed so there is nothing to build.
+	if _, err := newLibrary(zap.NewNop(), Options{HeadersOnly: true}, target, ver, dir, true); err != nil {
+		t.Errorf("unexpected error for headers only: %s", err)
+	}
+}
+
+func TestNewLibrary_RequireTagged(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "libflux", "Cargo.toml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := Target{OS: "linux", Arch: "amd64"}
+
+	for _, tt := range []struct {
+		version string
+		tagged  bool
+		env     string
+		wantErr bool
+	}{
+		{version: "v0.194.3", tagged: true, env: "1"},
+		{version: "v0.195.0-rc.1", tagged: true, env: "1"},
+		// Versions that look like releases but were not
+		// determined from a tag, such as the default version
+		// or a version bumped from the last tag by git.
+		{version: "v0.0.0", env: "1", wantErr: true},
+		{version: "v0.195.0", env: "1", wantErr: true},
+		{version: "v0.0.0", env: ""},
+	} {
+		t.Run(tt.version+"/"+tt.env, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_REQUIRE_TAGGED", tt.env)
+			ver := module.Version{Path: "github.com/influxdata/flux", Version: tt.version}
+			_, err := newLibrary(zap.NewNop(), Options{}, target, ver, dir, tt.tagged)
+			if tt.wantErr && err == nil {
+				t.Error("expected error for a version that is not tagged")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestLibrary_WritePackageConfigExtraLibs(t *testing.T) {
+	t.Setenv("GOCACHE", t.TempDir())
+	t.Setenv("PKG_CONFIG_EXTRA_LIBS", " -lm  -lstdc++ ")
+
+	extraLibs, err := getExtraLibs(zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	l := &Library{
+		Version:   "v0.194.3",
+		Dir:       t.TempDir(),
+		Target:    Target{OS: "linux", Arch: "amd64"},
+		ExtraLibs: extraLibs,
+	}
+
+	var buf bytes.Buffer
+	if err := l.WritePackageConfig(&buf, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := "Libs: -L${libdir} -lflux-${buildid} -ldl -lm -lm -lstdc++\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("expected package config to contain %q, got:\n%s", want, buf.String())
+	}
+}
+
+func TestLibrary_WritePackageConfigOmitSystemLibs(t *testing.T) {
+	t.Setenv("GOCACHE", t.TempDir())
+
+	for _, tt := range []struct {
+		name   string
+		target Target
+		omit   bool
+		want   string
+	}{
+		{name: "Linux", target: Target{OS: "linux", Arch: "amd64", Static: true}, want: "Libs: -L${libdir} -lflux-${buildid} -ldl -lpthread -lm\n"},
+		{name: "LinuxOmit", target: Target{OS: "linux", Arch: "amd64", Static: true}, omit: true, want: "Libs: -L${libdir} -lflux-${buildid} -lm\n"},
+		{name: "LinuxDynamicOmit", target: Target{OS: "linux", Arch: "amd64"}, omit: true, want: "Libs: -L${libdir} -lflux-${buildid} -lm\n"},
+		{name: "DarwinOmit", target: Target{OS: "darwin", Arch: "arm64"}, omit: true, want: "Libs: -L${libdir} -lflux-${buildid}\n"},
+		{name: "WindowsOmit", target: Target{OS: "windows", Arch: "amd64"}, omit: true, want: "Libs: -L${libdir} -lflux-${buildid} -lkernel32 -ladvapi32 -lbcrypt -lkernel32 -lntdll -luserenv -lws2_32 -lkernel32 -lws2_32 -lkernel32 -lntdll -lkernel32\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Library{
+				Version:        "v0.194.3",
+				Dir:            t.TempDir(),
+				Target:         tt.target,
+				OmitSystemLibs: tt.omit,
+			}
+
+			var buf bytes.Buffer
+			if err := l.WritePackageConfig(&buf, "abc"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !strings.Contains(buf.String(), tt.want) {
+				t.Errorf("expected package config to contain %q, got:\n%s", tt.want, buf.String())
+			}
+		})
+	}
+}
+
+func TestLibrary_WritePackageConfigManifest(t *testing.T) {
+	t.Setenv("GOCACHE", t.TempDir())
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{
+  "platforms": {
+    "linux": {"libs": ["-ldl", "-lrt"], "cflags": ["-DFLUX_LINUX"]},
+    "linux_amd64_static": {"libs": ["-ldl", "-lpthread", "-lrt"]},
+    "*": {"libs": ["-lc++"], "requires": ["zlib", "libzstd"]}
+  }
+}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "libflux", "pkgconfig.json"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		target Target
+		want   []string
+	}{
+		{
+			name:   "OS",
+			target: Target{OS: "linux", Arch: "amd64"},
+			want: []string{
+				"Libs: -L${libdir} -lflux-${buildid} -ldl -lrt\n",
+				"Cflags: -I${includedir} -DFLUX_LINUX\n",
+			},
+		},
+		{
+			name:   "Target",
+			target: Target{OS: "linux", Arch: "amd64", Static: true},
+			want: []string{
+				"Libs: -L${libdir} -lflux-${buildid} -ldl -lpthread -lrt\n",
+				"Cflags: -I${includedir}\n",
+			},
+		},
+		{
+			name:   "Any",
+			target: Target{OS: "darwin", Arch: "arm64"},
+			want: []string{
+				"Requires: zlib libzstd\n",
+				"Libs: -L${libdir} -lflux-${buildid} -lc++\n",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Library{
+				Version: "v0.194.3",
+				Dir:     dir,
+				Target:  tt.target,
+			}
+
+			var buf bytes.Buffer
+			if err := l.WritePackageConfig(&buf, "abc"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("expected package config to contain %q, got:\n%s", want, buf.String())
+				}
+			}
+		})
+	}
+
+	// An invalid manifest is reported rather than ignored.
+	if err := ioutil.WriteFile(filepath.Join(dir, "libflux", "pkgconfig.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := &Library{Version: "v0.194.3", Dir: dir, Target: Target{OS: "linux", Arch: "amd64"}}
+	if err := l.WritePackageConfig(ioutil.Discard, "abc"); err == nil {
+		t.Error("expected error for invalid manifest")
+	}
+}
+
+func TestGetExtraLibs_Invalid(t *testing.T) {
+	t.Setenv("PKG_CONFIG_EXTRA_LIBS", "-lm -Wl,--as-needed")
+	if _, err := getExtraLibs(zap.NewNop()); err == nil {
+		t.Error("expected error for flag that is not -l or -L")
+	}
+}
+
+func TestCargoBuildArgs_Locked(t *testing.T) {
+	for _, tt := range []struct {
+		locked string
+		want   []string
+		err    bool
+	}{
+		{locked: "", want: []string{"build", "--release", "--target", "x86_64-unknown-linux-gnu"}},
+		{locked: "0", want: []string{"build", "--release", "--target", "x86_64-unknown-linux-gnu"}},
+		{locked: "1", want: []string{"build", "--release", "--target", "x86_64-unknown-linux-gnu", "--locked"}},
+		{locked: "locked", want: []string{"build", "--release", "--target", "x86_64-unknown-linux-gnu", "--locked"}},
+		{locked: "frozen", want: []string{"build", "--release", "--target", "x86_64-unknown-linux-gnu", "--frozen"}},
+		{locked: "yes", err: true},
+	} {
+		t.Run(tt.locked, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_CARGO_LOCKED", tt.locked)
+			got, err := cargoBuildArgs("x86_64-unknown-linux-gnu")
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected args: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCargoBuildArgs_LTO(t *testing.T) {
+	t.Setenv("PKG_CONFIG_CARGO_LOCKED", "")
+	t.Setenv("PKG_CONFIG_CARGO_PROFILE_OVERRIDES", "")
+
+	for _, tt := range []struct {
+		lto  string
+		want []string
+		err  bool
+	}{
+		{lto: "", want: []string{"build", "--release"}},
+		{lto: "off", want: []string{"build", "--release"}},
+		{lto: "thin", want: []string{"build", "--release", "--config", `profile.release.lto="thin"`}},
+		{lto: "fat", want: []string{"build", "--release", "--config", `profile.release.lto="fat"`}},
+		{lto: "true", err: true},
+	} {
+		t.Run(tt.lto, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_LTO", tt.lto)
+			got, err := cargoBuildArgs("")
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected args: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCargoBuildArgs_Panic(t *testing.T) {
+	t.Setenv("PKG_CONFIG_CARGO_LOCKED", "")
+	t.Setenv("PKG_CONFIG_LTO", "")
+	t.Setenv("PKG_CONFIG_CARGO_PROFILE_OVERRIDES", "")
+
+	for _, tt := range []struct {
+		panic string
+		want  []string
+		err   bool
+	}{
+		{panic: "", want: []string{"build", "--release"}},
+		{panic: "abort", want: []string{"build", "--release", "--config", `profile.release.panic="abort"`}},
+		{panic: "unwind", want: []string{"build", "--release", "--config", `profile.release.panic="unwind"`}},
+		{panic: "halt", err: true},
+	} {
+		t.Run(tt.panic, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_PANIC", tt.panic)
+			got, err := cargoBuildArgs("")
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected args: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	const mb = 1024 * 1024
+	for _, tt := range []struct {
+		name      string
+		minDiskMB string
+		before    uint64
+		after     uint64
+		shared    bool
+		removed   bool
+		err       bool
+	}{
+		{name: "Disabled", minDiskMB: "", before: 0, after: 0},
+		{name: "SharedTargetDir", minDiskMB: "100", before: 10 * mb, after: 200 * mb, shared: true, err: true},
+		{name: "Enough", minDiskMB: "100", before: 100 * mb, after: 100 * mb},
+		{name: "CleanFreesSpace", minDiskMB: "100", before: 10 * mb, after: 200 * mb, removed: true},
+		{name: "Insufficient", minDiskMB: "100", before: 10 * mb, after: 50 * mb, removed: true, err: true},
+		{name: "Invalid", minDiskMB: "lots", err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_MIN_DISK_MB", tt.minDiskMB)
+
+			// Only a target directory in the copy area may be removed.
+			ownedDir := t.TempDir()
+			targetDir := filepath.Join(ownedDir, "target")
+			if tt.shared {
+				targetDir = filepath.Join(t.TempDir(), "target")
+			}
+			if err := os.Mkdir(targetDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			// Report more space once the target directory has been removed.
+			diskSpace = func(path string) (uint64, error) {
+				if _, err := os.Stat(targetDir); err != nil {
+					return tt.after, nil
+				}
+				return tt.before, nil
+			}
+			defer func() { diskSpace = availableDiskSpace }()
+
+			err := checkDiskSpace(zap.NewNop(), targetDir, ownedDir)
+			if tt.err && err == nil {
+				t.Error("expected error")
+			} else if !tt.err && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			_, statErr := os.Stat(targetDir)
+			if removed := os.IsNotExist(statErr); removed != tt.removed {
+				t.Errorf("unexpected target dir removal: got %v, want %v", removed, tt.removed)
+			}
+		})
+	}
+}
+
+func TestAvailableDiskSpace(t *testing.T) {
+	if n, err := availableDiskSpace(t.TempDir()); errors.Is(err, errDiskSpaceUnsupported) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if n == 0 {
+		t.Error("expected available disk space to be nonzero")
+	}
+}
+
+func TestResolveModule_Submodule(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	// The main module does not reference flux at all.
+	modroot := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(modroot, "go.mod"), []byte("module example.com/app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(modroot, "third_party", "flux")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	gitInit(t, dir, "v0.190.0")
+	gitCommit(t, dir)
+	t.Setenv("PKG_CONFIG_FLUX_SUBMODULE", filepath.Join("third_party", "flux"))
+
+	ver, got, _, err := resolveModule(context.Background(), modroot, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != dir {
+		t.Errorf("unexpected dir: got %q, want %q", got, dir)
+	}
+	if want := "v0.191.0"; ver.Version != want {
+		t.Errorf("unexpected version: got %q, want %q", ver.Version, want)
+	}
+}
+
+func TestLibrary_HeadersOnly(t *testing.T) {
+	t.Setenv("GOCACHE", t.TempDir())
+
+	// Any attempt to run cargo will fail.
+	t.Setenv("CARGO", filepath.Join(t.TempDir(), "missing-cargo"))
+
+	l := &Library{
+		Version:     "v0.194.3",
+		Dir:         t.TempDir(),
+		Target:      Target{OS: "linux", Arch: "amd64"},
+		HeadersOnly: true,
+	}
+	buildid, err := l.Install(context.Background(), zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := l.WritePackageConfig(&buf, buildid); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Contains(buf.String(), "Libs:") {
+		t.Errorf("expected no Libs in headers only package config, got:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "Cflags: -I${includedir}\n") {
+		t.Errorf("expected Cflags in headers only package config, got:\n%s", buf.String())
+	}
+}
+
+func TestTarget_DetermineCargoTarget(t *testing.T) {
+	for _, tt := range []struct {
+		target Target
+		want   string
+	}{
+		{target: Target{OS: "linux", Arch: "amd64"}, want: "x86_64-unknown-linux-gnu"},
+		{target: Target{OS: "linux", Arch: "amd64", Static: true}, want: "x86_64-unknown-linux-musl"},
+		{target: Target{OS: "linux", Arch: "arm", Arm: "7", Static: true}, want: "armv7-unknown-linux-musleabihf"},
+		{target: Target{OS: "linux", Arch: "mips"}, want: "mips-unknown-linux-gnu"},
+		{target: Target{OS: "linux", Arch: "mips", Static: true}, want: "mips-unknown-linux-musl"},
+		{target: Target{OS: "linux", Arch: "mipsle"}, want: "mipsel-unknown-linux-gnu"},
+		{target: Target{OS: "linux", Arch: "mipsle", Static: true}, want: "mipsel-unknown-linux-musl"},
+		{target: Target{OS: "darwin", Arch: "arm64", Static: true}, want: "aarch64-apple-darwin"},
+		{target: Target{OS: "linux", Arch: "386", Static: true}, want: ""},
+		{target: Target{OS: "freebsd", Arch: "amd64"}, want: ""},
+	} {
+		t.Run(tt.target.String(), func(t *testing.T) {
+			if got := tt.target.DetermineCargoTarget(zap.NewNop()); got != tt.want {
+				t.Errorf("unexpected cargo target: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTargetFromTriple(t *testing.T) {
+	for _, tt := range []struct {
+		triple string
+		want   string
+	}{
+		{triple: "x86_64-unknown-linux-musl", want: "linux_amd64_static"},
+		{triple: "x86_64-unknown-linux-gnu", want: "linux_amd64"},
+		{triple: "x86_64-apple-darwin", want: "darwin_amd64"},
+		{triple: "armv7-unknown-linux-musleabihf", want: "linux_armv7_static"},
+		{triple: "aarch64-pc-windows-msvc", want: "windows_arm64"},
+		{triple: "i686-unknown-linux-musl", want: "linux_386_static"},
+		{triple: "wasm32-unknown-unknown", want: "wasm32-unknown-unknown"},
+	} {
+		t.Run(tt.triple, func(t *testing.T) {
+			target := TargetFromTriple(tt.triple)
+			if got := target.String(); got != tt.want {
+				t.Errorf("unexpected target label: got %q, want %q", got, tt.want)
+			}
+			if got := target.DetermineCargoTarget(zap.NewNop()); got != tt.triple {
+				t.Errorf("unexpected cargo target: got %q, want %q", got, tt.triple)
+			}
+		})
+	}
+}
+
+func TestSupportedTargets(t *testing.T) {
+	targets := SupportedTargets()
+	if len(targets) != len(cargoTargets) {
+		t.Fatalf("unexpected number of targets: got %d, want %d", len(targets), len(cargoTargets))
+	}
+	for _, target := range targets {
+		got, err := ParseTarget(target.Spec())
+		if err != nil {
+			t.Errorf("unexpected error parsing %s: %s", target.Spec(), err)
+		} else if got != target {
+			t.Errorf("target does not round trip: got %+v, want %+v", got, target)
+		}
+	}
+}
+
+func TestLibrary_WritePackageConfigVersion(t *testing.T) {
+	t.Setenv("GOCACHE", t.TempDir())
+
+	for _, tt := range []struct {
+		version string
+		want    string
+		err     bool
+	}{
+		{version: "v0.194.3", want: "Version: 0.194.3\n"},
+		{version: "0.194.3", want: "Version: 0.194.3\n"},
+		{version: "", err: true},
+		{version: "v", err: true},
+	} {
+		t.Run(tt.version, func(t *testing.T) {
+			l := &Library{
+				Version: tt.version,
+				Dir:     t.TempDir(),
+				Target:  Target{OS: "linux", Arch: "amd64"},
+			}
+
+			var buf bytes.Buffer
+			err := l.WritePackageConfig(&buf, "abc")
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected error, got:\n%s", buf.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !strings.Contains(buf.String(), tt.want) {
+				t.Errorf("expected package config to contain %q, got:\n%s", tt.want, buf.String())
+			}
+		})
+	}
+}
+
+func TestGetVersionFromGit_FetchTags(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake git requires a unix shell")
+	}
+
+	// The fake git only finds a tag after the tags have been fetched.
+	tmpdir := t.TempDir()
+	fetched := filepath.Join(tmpdir, "fetched")
+	script := `#!/bin/sh
+case "$1" in
+describe)
+	if [ -f ` + fetched + ` ]; then
+		echo v0.190.0-3-gabcdef0
+		exit 0
+	fi
+	echo "fatal: No names found, cannot describe anything." >&2
+	exit 128
+	;;
+fetch)
+	[ "$*" = "fetch --tags --depth=1" ] || exit 1
+	touch ` + fetched + `
+	;;
+esac
+`
+	fakeGit := filepath.Join(tmpdir, "git")
+	if err := ioutil.WriteFile(fakeGit, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gitcmd = fakeGit
+	defer func() { gitcmd = "git" }()
+
+	t.Setenv("PKG_CONFIG_GIT_FETCH_TAGS", "")
+	if _, _, err := getVersionFromGit(context.Background(), tmpdir, zap.NewNop()); err == nil {
+		t.Fatal("expected error without fetching tags")
+	}
+	if _, err := os.Stat(fetched); err == nil {
+		t.Fatal("tags should not be fetched unless PKG_CONFIG_GIT_FETCH_TAGS is set")
+	}
+
+	t.Setenv("PKG_CONFIG_GIT_FETCH_TAGS", "1")
+	v, _, err := getVersionFromGit(context.Background(), tmpdir, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "v0.191.0"; v != want {
+		t.Errorf("unexpected version: got %q, want %q", v, want)
+	}
+}
+
+func TestConfigureVersion_Compare(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake go requires a unix shell")
+	}
+	cache := t.TempDir()
+	t.Setenv("GOCACHE", cache)
+
+	// The fake go downloads each version of flux into the module cache.
+	modcache := t.TempDir()
+	script := `#!/bin/sh
+[ "$1 $2 $3" = "mod download -json" ] || exit 1
+version=${4#*@}
+echo "{\"Path\": \"${4%@*}\", \"Version\": \"$version\", \"Dir\": \"` + modcache + `/flux@$version\"}"
+`
+	fakeGo := filepath.Join(t.TempDir(), "go")
+	if err := ioutil.WriteFile(fakeGo, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gocmd = fakeGo
+	defer func() { gocmd = "go" }()
+
+	versions := map[string]string{"flux-a": "v0.193.0", "flux-b": "v0.194.3"}
+	pkgConfigPath := t.TempDir()
+	for name, version := range versions {
+		if err := os.MkdirAll(filepath.Join(modcache, "flux@"+version, "libflux"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(modcache, "flux@"+version, "libflux", "Cargo.toml"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		opts := Options{Target: &Target{OS: "linux", Arch: "amd64"}, Variant: name}
+		l, err := ConfigureVersion(context.Background(), zap.NewNop(), opts, version)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if want := filepath.Join(modcache, "flux@"+version); l.Dir != want {
+			t.Errorf("unexpected dir for %s: got %q, want %q", name, l.Dir, want)
+		}
+
+		f, err := os.Create(filepath.Join(pkgConfigPath, name+".pc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.WritePackageConfig(f, "abc"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		_ = f.Close()
+	}
+
+	for name, version := range versions {
+		data, err := ioutil.ReadFile(filepath.Join(pkgConfigPath, name+".pc"))
+		if err != nil {
+			t.Fatalf("expected %s.pc to be written: %s", name, err)
+		}
+		if want := "Version: " + version[1:] + "\n"; !strings.Contains(string(data), want) {
+			t.Errorf("expected %s.pc to contain %q, got:\n%s", name, want, data)
+		}
+		// Each version is installed to its own libdir.
+		execPrefix := filepath.Join(cache, "pkgconfig", "linux_amd64-"+name)
+		if want := "exec_prefix=" + pcPath(execPrefix) + "\n"; !strings.Contains(string(data), want) {
+			t.Errorf("expected %s.pc to contain %q, got:\n%s", name, want, data)
+		}
+	}
+}
+
+func TestLookupGoCmd(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		binary string
+		goenv  string
+		want   string
+	}{
+		{name: "Default", want: "go"},
+		{name: "GO", goenv: "/usr/local/go/bin/go", want: "/usr/local/go/bin/go"},
+		{name: "Binary", binary: "/usr/local/go1.21/bin/go", want: "/usr/local/go1.21/bin/go"},
+		{name: "BinaryOverridesGO", binary: "/usr/local/go1.21/bin/go", goenv: "/usr/local/go/bin/go", want: "/usr/local/go1.21/bin/go"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_GO_BINARY", tt.binary)
+			t.Setenv("GO", tt.goenv)
+			if got := lookupGoCmd(); got != tt.want {
+				t.Errorf("unexpected go binary: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetGoCache_GoBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake go requires a unix shell")
+	}
+
+	// The stub go reports a fixed cache location.
+	stub := filepath.Join(t.TempDir(), "go")
+	if err := ioutil.WriteFile(stub, []byte("#!/bin/sh\necho /stub/cache\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PKG_CONFIG_GO_BINARY", stub)
+	t.Setenv("GOCACHE", "")
+
+	ResolveGoCmd()
+	defer func() { gocmd = "go" }()
+
+	if got, err := getGoCache(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if got != "/stub/cache" {
+		t.Errorf("unexpected cache: got %q, want %q", got, "/stub/cache")
+	}
+}
+
+func TestLibrary_WritePackageConfigRelocatable(t *testing.T) {
+	// Lay out a bundle with the sources, cache, and package config together.
+	bundle := t.TempDir()
+	cache := filepath.Join(bundle, "cache")
+	t.Setenv("GOCACHE", cache)
+
+	dir := filepath.Join(bundle, "flux")
+	pcdir := filepath.Join(bundle, "lib", "pkgconfig")
+	if err := os.MkdirAll(pcdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &Library{
+		Version: "v0.194.3",
+		Dir:     dir,
+		Target:  Target{OS: "linux", Arch: "amd64"},
+	}
+
+	pcfile := filepath.Join(pcdir, "flux.pc")
+	f, err := os.Create(pcfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WriteRelocatablePackageConfig(f, "abc", pcdir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_ = f.Close()
+
+	data, err := ioutil.ReadFile(pcfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "prefix=${pcfiledir}" + pcSep + strings.Join([]string{"..", "..", "flux", "libflux"}, pcSep) + "\n"
+	if !strings.Contains(string(data), want) {
+		t.Errorf("expected package config to contain %q, got:\n%s", want, data)
+	}
+	if strings.Contains(string(data), bundle) {
+		t.Errorf("expected no absolute paths in package config, got:\n%s", data)
+	}
+
+	// The variables should resolve to the real locations.
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Skip("pkg-config is not installed")
+	}
+	cmd := exec.Command(pkgConfigExec, "--variable=includedir", "flux")
+	cmd.Env = append(os.Environ(), "PKG_CONFIG_PATH="+pcdir)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := filepath.Clean(strings.TrimSpace(string(out))), filepath.Join(dir, "libflux", "include"); got != want {
+		t.Errorf("unexpected includedir: got %q, want %q", got, want)
+	}
+}
+
+func TestLibrary_WritePackageConfigExtraIncludeDirs(t *testing.T) {
+	t.Setenv("GOCACHE", t.TempDir())
+
+	arrowDir := filepath.Join(t.TempDir(), "arrow", "include")
+	if err := os.MkdirAll(arrowDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	missingDir := filepath.Join(t.TempDir(), "missing")
+	relativeDir := "testdata"
+	t.Setenv("PKG_CONFIG_EXTRA_INCLUDES", strings.Join([]string{arrowDir, missingDir, relativeDir}, string(os.PathListSeparator)))
+
+	core, logs := observer.New(zap.WarnLevel)
+	includeDirs, err := getExtraIncludeDirs(zap.New(core))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	l := &Library{
+		Version:          "v0.194.3",
+		Dir:              t.TempDir(),
+		Target:           Target{OS: "linux", Arch: "amd64"},
+		ExtraIncludeDirs: includeDirs,
+	}
+
+	var buf bytes.Buffer
+	if err := l.WritePackageConfig(&buf, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The relative directory is resolved from the working directory.
+	absDir, err := filepath.Abs(relativeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Cflags: -I${includedir} -I" + pcPath(arrowDir) + " -I" + pcPath(missingDir) + " -I" + pcPath(absDir) + "\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("expected package config to contain %q, got:\n%s", want, buf.String())
+	}
+
+	entries := logs.FilterMessage("Extra include directory does not exist").All()
+	if len(entries) != 1 {
+		t.Fatalf("expected one warning for the missing directory, got %d", len(entries))
+	}
+	if got := entries[0].ContextMap()["dir"]; got != missingDir {
+		t.Errorf("unexpected dir in warning: got %v, want %s", got, missingDir)
+	}
+}
+
+func TestLibrary_WritePackageConfigDefines(t *testing.T) {
+	t.Setenv("GOCACHE", t.TempDir())
+	t.Setenv("PKG_CONFIG_DEFINES", "FLUX_STATIC -DFLUX_FEATURE_STRICT=1")
+
+	defines, err := getDefines(zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	l := &Library{
+		Version: "v0.194.3",
+		Dir:     t.TempDir(),
+		Target:  Target{OS: "linux", Arch: "amd64"},
+		Defines: defines,
+	}
+
+	var buf bytes.Buffer
+	if err := l.WritePackageConfig(&buf, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := "Cflags: -I${includedir} -DFLUX_STATIC -DFLUX_FEATURE_STRICT=1\n"
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("expected package config to contain %q, got:\n%s", want, buf.String())
+	}
+
+	t.Setenv("PKG_CONFIG_DEFINES", "-Iinclude")
+	if _, err := getDefines(zap.NewNop()); err == nil {
+		t.Error("expected error for a flag that is not a definition")
+	}
+}
+
+func TestLibrary_WritePackageConfigInstallPrefix(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("GOCACHE", cache)
+
+	staging := t.TempDir()
+	installPrefix := filepath.Join(string(filepath.Separator)+"opt", "flux")
+	l := &Library{
+		Version: "v0.194.3",
+		Dir:     staging,
+		Target:  Target{OS: "linux", Arch: "amd64"},
+	}
+
+	var buf bytes.Buffer
+	if err := l.WriteInstalledPackageConfig(&buf, "abc", installPrefix); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, want := range []string{
+		"prefix=" + pcPath(installPrefix) + "\n",
+		"exec_prefix=${prefix}\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected package config to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+	for _, path := range []string{staging, cache} {
+		if strings.Contains(buf.String(), pcPath(path)) {
+			t.Errorf("unexpected staging path %s in package config:\n%s", path, buf.String())
+		}
+	}
+
+	// The package config the wrapper queries
+	// still points at the staged library.
+	buf.Reset()
+	if err := l.WritePackageConfig(&buf, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "prefix=" + pcPath(filepath.Join(staging, "libflux")) + "\n"; !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("expected package config to start with %q, got:\n%s", want, buf.String())
+	}
+}
+
+func TestLibrary_WritePackageConfigDebugInfo(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("GOCACHE", cache)
+
+	l := &Library{
+		Version:   "v0.194.3",
+		Dir:       t.TempDir(),
+		Target:    Target{OS: "linux", Arch: "amd64"},
+		DebugInfo: true,
+	}
+	want := "debuginfodir=${exec_prefix}" + pcSep + "debug" + pcSep + "${buildid}\n"
+
+	// No debug info was produced by the build.
+	var buf bytes.Buffer
+	if err := l.WritePackageConfig(&buf, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Contains(buf.String(), "debuginfodir=") {
+		t.Errorf("unexpected debuginfodir in package config:\n%s", buf.String())
+	}
+
+	// The build produced split debug info.
+	targetdir := t.TempDir()
+	for _, name := range []string{"libflux.a", "libflux.a.debug", "libother.a.debug"} {
+		if err := ioutil.WriteFile(filepath.Join(targetdir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(targetdir, "libflux.dSYM", "Contents"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(targetdir, "libflux.dSYM", "Contents", "Info.plist"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	debugdir := filepath.Join(cache, "pkgconfig", l.Target.String(), "debug", "abc")
+	n, err := linkDebugInfo(targetdir, debugdir, []string{"flux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if n != 2 {
+		t.Errorf("unexpected number of debug info artifacts: got %d, want 2", n)
+	}
+	for _, name := range []string{"libflux.a.debug", filepath.Join("libflux.dSYM", "Contents", "Info.plist")} {
+		if _, err := os.Stat(filepath.Join(debugdir, name)); err != nil {
+			t.Errorf("expected debug info to be linked: %s", err)
+		}
+	}
+
+	buf.Reset()
+	if err := l.WritePackageConfig(&buf, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("expected package config to contain %q, got:\n%s", want, buf.String())
+	}
+}
+
+func TestGetVersionFromGit_VersionBump(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake git requires a unix shell")
+	}
+
+	// The fake git describes a commit after the tag.
+	tmpdir := t.TempDir()
+	fakeGit := filepath.Join(tmpdir, "git")
+	if err := ioutil.WriteFile(fakeGit, []byte("#!/bin/sh\necho v0.190.2-3-gabcdef0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gitcmd = fakeGit
+	defer func() { gitcmd = "git" }()
+
+	for _, tt := range []struct {
+		bump string
+		want string
+		err  bool
+	}{
+		{bump: "", want: "v0.191.0"},
+		{bump: "minor", want: "v0.191.0"},
+		{bump: "patch", want: "v0.190.3"},
+		{bump: "none", want: "v0.190.2"},
+		{bump: "major", err: true},
+	} {
+		t.Run(tt.bump, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_VERSION_BUMP", tt.bump)
+			got, _, err := getVersionFromGit(context.Background(), tmpdir, zap.NewNop())
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("unexpected version: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetVersionFromGit_RefsTags(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake git requires a unix shell")
+	}
+
+	for _, tt := range []struct {
+		name     string
+		describe string
+		want     string
+		tagged   bool
+	}{
+		{name: "Tag", describe: "refs/tags/v0.190.2", want: "0.190.2", tagged: true},
+		{name: "AfterTag", describe: "refs/tags/v0.190.2-3-gabcdef0", want: "v0.191.0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpdir := t.TempDir()
+			fakeGit := filepath.Join(tmpdir, "git")
+			script := fmt.Sprintf("#!/bin/sh\necho %s\n", tt.describe)
+			if err := ioutil.WriteFile(fakeGit, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			gitcmd = fakeGit
+			defer func() { gitcmd = "git" }()
+
+			got, tagged, err := getVersionFromGit(context.Background(), tmpdir, zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("unexpected version: got %q, want %q", got, tt.want)
+			}
+			if tagged != tt.tagged {
+				t.Errorf("unexpected tagged: got %v, want %v", tagged, tt.tagged)
+			}
+		})
+	}
+}
+
+func TestGetVersionFromFile(t *testing.T) {
+	cargoToml := `[package]
+name = "flux"
+version = "0.194.3"
+edition = "2021"
+
+[dependencies]
+serde = { version = "1.0.106", features = ["derive"] }
+`
+
+	for _, tt := range []struct {
+		name  string
+		files map[string]string
+		want  string
+		err   bool
+		warn  bool
+	}{
+		{
+			name:  "CargoToml",
+			files: map[string]string{"libflux/Cargo.toml": cargoToml},
+			want:  "v0.194.3",
+		},
+		{
+			name:  "VersionFile",
+			files: map[string]string{"VERSION": "v0.195.0\n", "libflux/Cargo.toml": cargoToml},
+			want:  "v0.195.0",
+		},
+		{
+			name:  "InvalidVersionFile",
+			files: map[string]string{"VERSION": "main\n", "libflux/Cargo.toml": cargoToml},
+			want:  "v0.194.3",
+			warn:  true,
+		},
+		{
+			name:  "InvalidVersionFileOnly",
+			files: map[string]string{"VERSION": "main\n"},
+			err:   true,
+			warn:  true,
+		},
+		{
+			name:  "NoPackageVersion",
+			files: map[string]string{"libflux/Cargo.toml": "[workspace]\nmembers = [\"flux\"]\n\n[dependencies]\nversion = \"1.0.0\"\n"},
+			err:   true,
+		},
+		{
+			name: "Missing",
+			err:  true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, contents := range tt.files {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			core, logs := observer.New(zap.WarnLevel)
+			got, err := getVersionFromFile(dir, zap.New(core))
+			if n := logs.FilterMessageSnippet("VERSION").Len(); tt.warn != (n > 0) {
+				t.Errorf("unexpected warnings about the VERSION file: got %d", n)
+			}
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("unexpected version: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLibrary_InstallWindows(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+
+	// The fake cargo only succeeds for the build.
+	fakeCargo(t, "")
+
+	for _, tt := range []struct {
+		abi     string
+		triple  string
+		libname string
+		want    string
+		libs    string
+	}{
+		{
+			abi:     "",
+			triple:  "x86_64-pc-windows-gnu",
+			libname: "libflux.a",
+			want:    "libflux-%s.a",
+			libs:    "Libs: -L${libdir} -lflux-${buildid} -lkernel32",
+		},
+		{
+			abi:     "msvc",
+			triple:  "x86_64-pc-windows-msvc",
+			libname: "flux.lib",
+			want:    "flux-%s.lib",
+			libs:    "Libs: ${libdir}" + pcSep + "flux-${buildid}.lib kernel32.lib",
+		},
+	} {
+		t.Run(tt.triple, func(t *testing.T) {
+			cache := t.TempDir()
+			t.Setenv("GOCACHE", cache)
+			t.Setenv("PKG_CONFIG_WINDOWS_ABI", tt.abi)
+
+			l := &Library{
+				Path:    "github.com/influxdata/flux",
+				Version: "v0.194.3",
+				Dir:     t.TempDir(),
+				Target:  Target{OS: "windows", Arch: "amd64"},
+			}
+
+			// Create the library that cargo would have built.
+			releaseDir := filepath.Join(l.Dir, "libflux", "target", tt.triple, "release")
+			if err := os.MkdirAll(releaseDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(releaseDir, tt.libname), []byte("archive"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			buildid, err := l.Install(context.Background(), zap.NewNop())
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			dst := filepath.Join(cache, "pkgconfig", "windows_amd64", "lib", fmt.Sprintf(tt.want, buildid))
+			if _, err := os.Stat(dst); err != nil {
+				t.Errorf("expected library to be installed: %s", err)
+			}
+
+			var buf bytes.Buffer
+			if err := l.WritePackageConfig(&buf, buildid); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !strings.Contains(buf.String(), tt.libs) {
+				t.Errorf("expected package config to contain %q, got:\n%s", tt.libs, buf.String())
+			}
+		})
+	}
+}
+
+func TestLibrary_BuildCargoProfileOverrides(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+	t.Setenv("PKG_CONFIG_CARGO_LOCKED", "")
+
+	// The fake cargo records the arguments for the build.
+	tmpdir, _ := fakeCargo(t, "for arg in \"$@\"; do echo \"$arg\" >> \"$dir/args\"; done\n")
+	t.Setenv("PKG_CONFIG_CARGO_PROFILE_OVERRIDES", "codegen-units=1 opt-level=3 lto=true")
+
+	l := &Library{Dir: t.TempDir(), Target: Target{OS: "linux", Arch: "amd64"}}
+	if err := os.MkdirAll(filepath.Join(l.Dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.build(context.Background(), zap.NewNop(), t.TempDir()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(tmpdir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(string(data)), "\n")
+	want := []string{
+		"build", "--release", "--target", "x86_64-unknown-linux-gnu",
+		"--config", "profile.release.codegen-units=1",
+		"--config", "profile.release.opt-level=3",
+		"--config", "profile.release.lto=true",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected cargo args: got %v, want %v", got, want)
+	}
+}
+
+func TestCargoProfileOverrides(t *testing.T) {
+	for _, tt := range []struct {
+		env  string
+		want []string
+		err  bool
+	}{
+		{env: ""},
+		{env: "opt-level=s", want: []string{`profile.release.opt-level="s"`}},
+		{env: `debug="line-tables-only"`, want: []string{`profile.release.debug="line-tables-only"`}},
+		{env: "codegen-units", err: true},
+		{env: "codegen-units=", err: true},
+		{env: "profile.dev.opt-level=0", err: true},
+		{env: `debug=line"tables`, err: true},
+	} {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_CARGO_PROFILE_OVERRIDES", tt.env)
+			got, err := cargoProfileOverrides()
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected overrides: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeFakeModDownload writes a fake go that extracts the flux module
+// into the module cache when it is not already there and records each
+// download in the calls file.
+func writeFakeModDownload(t *testing.T, modcache, calls string) (dir string) {
+	dir = filepath.Join(modcache, "github.com", "influxdata", "flux@v0.194.3")
+	download := filepath.Join(modcache, "cache", "download", "github.com", "influxdata", "flux", "@v")
+	script := `#!/bin/sh
+[ "$1 $2 $3" = "mod download -json" ] || exit 1
+echo download >> ` + calls + `
+if [ ! -d ` + dir + ` ]; then
+	mkdir -p ` + dir + `/libflux ` + download + `
+	touch ` + dir + `/libflux/Cargo.toml ` + download + `/v0.194.3.ziphash
+	rm -f ` + download + `/v0.194.3.partial
+	chmod -R a-w ` + dir + `
+fi
+echo '{"Path": "github.com/influxdata/flux", "Version": "v0.194.3", "Dir": "` + dir + `"}'
+`
+	fakeGo := filepath.Join(t.TempDir(), "go")
+	if err := ioutil.WriteFile(fakeGo, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gocmd = fakeGo
+	t.Cleanup(func() {
+		gocmd = "go"
+		_ = removeModuleDir(dir)
+	})
+	return dir
+}
+
+func TestDownloadModule_Incomplete(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake go requires a unix shell")
+	}
+
+	modcache := t.TempDir()
+	dir := writeFakeModDownload(t, modcache, filepath.Join(t.TempDir(), "calls"))
+
+	// An interrupted download left the module extracted
+	// without the cargo manifest and the partial marker in place.
+	if err := os.MkdirAll(filepath.Join(dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	download := filepath.Join(modcache, "cache", "download", "github.com", "influxdata", "flux", "@v")
+	if err := os.MkdirAll(download, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(download, "v0.194.3.partial"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PKG_CONFIG_REPAIR_MODCACHE", "")
+	if _, _, err := downloadModule(context.Background(), "github.com/influxdata/flux@v0.194.3", zap.NewNop()); err == nil {
+		t.Fatal("expected error for incomplete module")
+	}
+
+	t.Setenv("PKG_CONFIG_REPAIR_MODCACHE", "1")
+	ver, got, err := downloadModule(context.Background(), "github.com/influxdata/flux@v0.194.3", zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != dir {
+		t.Errorf("unexpected dir: got %q, want %q", got, dir)
+	}
+	if want := (module.Version{Path: "github.com/influxdata/flux", Version: "v0.194.3"}); ver != want {
+		t.Errorf("unexpected version: got %v, want %v", ver, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "libflux", "Cargo.toml")); err != nil {
+		t.Errorf("expected module to be downloaded again: %s", err)
+	}
+}
+
+func TestDownloadModule_NoCrate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake go requires a unix shell")
+	}
+	t.Setenv("PKG_CONFIG_REPAIR_MODCACHE", "1")
+
+	modcache := t.TempDir()
+	calls := filepath.Join(t.TempDir(), "calls")
+	dir := writeFakeModDownload(t, modcache, calls)
+
+	// A complete download of a flux version without the libflux
+	// crate is valid and must not be downloaded again.
+	download := filepath.Join(modcache, "cache", "download", "github.com", "influxdata", "flux", "@v")
+	for _, d := range []string{filepath.Join(dir, "libflux"), download} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(download, "v0.194.3.ziphash"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, got, err := downloadModule(context.Background(), "github.com/influxdata/flux@v0.194.3", zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != dir {
+		t.Errorf("unexpected dir: got %q, want %q", got, dir)
+	}
+	data, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "download"); n != 1 {
+		t.Errorf("expected the module to be downloaded once, got %d downloads", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "libflux", "Cargo.toml")); !os.IsNotExist(err) {
+		t.Errorf("expected the module to be left as it was: %v", err)
+	}
+
+	// The missing crate is reported by the libflux checks instead.
+	if err := checkLibfluxCrate(dir); err == nil || !strings.Contains(err.Error(), "no libflux Rust crate") {
+		t.Errorf("expected the missing crate to be reported, got %v", err)
+	}
+}
+
+func TestGoModDownload_Proxy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake go requires a unix shell")
+	}
+
+	for _, tt := range []struct {
+		name  string
+		proxy string
+		want  string
+	}{
+		{name: "Override", proxy: "https://flux.example.com", want: "https://flux.example.com"},
+		{name: "Default", proxy: "", want: "https://proxy.example.com"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GOPROXY", "https://proxy.example.com")
+			t.Setenv("PKG_CONFIG_GOPROXY", tt.proxy)
+
+			// The fake go records the proxy it was given.
+			tmpdir := t.TempDir()
+			record := filepath.Join(tmpdir, "goproxy")
+			script := "#!/bin/sh\necho \"$GOPROXY\" > " + record + "\n" +
+				"echo '{\"Path\": \"github.com/influxdata/flux\", \"Version\": \"v0.194.3\", \"Dir\": \"" + tmpdir + "\"}'\n"
+			fakeGo := filepath.Join(tmpdir, "go")
+			if err := ioutil.WriteFile(fakeGo, []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			gocmd = fakeGo
+			defer func() { gocmd = "go" }()
+
+			if _, _, err := goModDownload(context.Background(), "github.com/influxdata/flux@v0.194.3", zap.NewNop()); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			data, err := ioutil.ReadFile(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(data)); got != tt.want {
+				t.Errorf("unexpected GOPROXY: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetVersion_NoGit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake git requires a unix shell")
+	}
+
+	// The fake git records that it was invoked.
+	tmpdir := t.TempDir()
+	invoked := filepath.Join(tmpdir, "invoked")
+	fakeGit := filepath.Join(tmpdir, "git")
+	script := "#!/bin/sh\ntouch " + invoked + "\necho v0.190.0\n"
+	if err := ioutil.WriteFile(fakeGit, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gitcmd = fakeGit
+	defer func() { gitcmd = "git" }()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cargoToml := "[package]\nname = \"flux\"\nversion = \"0.194.3\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "libflux", "Cargo.toml"), []byte(cargoToml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PKG_CONFIG_NO_GIT", "1")
+	v, tagged, err := getVersion(context.Background(), dir, zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "v0.194.3"; v != want {
+		t.Errorf("unexpected version: got %q, want %q", v, want)
+	}
+	if tagged {
+		t.Error("a version read from the sources should not be tagged")
+	}
+	if _, err := os.Stat(invoked); err == nil {
+		t.Error("git should not be invoked when PKG_CONFIG_NO_GIT is set")
+	}
+
+	t.Setenv("PKG_CONFIG_NO_GIT", "")
+	if _, _, err := getVersion(context.Background(), dir, zap.NewNop()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := os.Stat(invoked); err != nil {
+		t.Error("expected git to be invoked when PKG_CONFIG_NO_GIT is not set")
+	}
+}
+
+func TestLibrary_Provenance(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+	t.Setenv("PKG_CONFIG_NO_GIT", "")
+	cache := t.TempDir()
+	t.Setenv("GOCACHE", cache)
+
+	// The fake cargo only succeeds for the build.
+	fakeCargo(t, "")
+
+	l := &Library{
+		Path:    "github.com/influxdata/flux",
+		Version: "v0.194.3",
+		Dir:     t.TempDir(),
+		Target:  Target{OS: "linux", Arch: "amd64"},
+	}
+	gitInit(t, l.Dir, "v0.194.3")
+
+	// Create the library that cargo would have built.
+	releaseDir := filepath.Join(l.Dir, "libflux", "target", "x86_64-unknown-linux-gnu", "release")
+	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(releaseDir, "libflux.a"), []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buildid, err := l.Install(context.Background(), zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p, err := l.Provenance(buildid)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"path", "version", "dir", "commit", "target", "libraries"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("expected provenance to contain %q, got:\n%s", key, data)
+		}
+	}
+
+	if got, want := p.Target, "x86_64-unknown-linux-gnu"; got != want {
+		t.Errorf("unexpected target: got %q, want %q", got, want)
+	}
+	if len(p.Commit) != 40 {
+		t.Errorf("expected the git commit, got %q", p.Commit)
+	}
+	sum := sha256.Sum256([]byte("archive"))
+	want := map[string]string{
+		"libflux-" + buildid + ".a": hex.EncodeToString(sum[:]),
+	}
+	if !reflect.DeepEqual(p.Libraries, want) {
+		t.Errorf("unexpected libraries: got %v, want %v", p.Libraries, want)
+	}
+}
+
+func TestGitHeadCommit_Subdirectory(t *testing.T) {
+	t.Setenv("PKG_CONFIG_NO_GIT", "")
+	dir := t.TempDir()
+	gitInit(t, dir, "v0.194.3")
+
+	subdir := filepath.Join(dir, "vendor", "github.com", "influxdata", "flux")
+	if err := os.MkdirAll(subdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := gitHeadCommit(dir); len(got) != 40 {
+		t.Errorf("expected the git commit for the repository, got %q", got)
+	}
+	// The commit of the enclosing repository does not describe the sources.
+	if got := gitHeadCommit(subdir); got != "" {
+		t.Errorf("expected no commit for a subdirectory, got %q", got)
+	}
+}
+
+func TestLibrary_InstallArchTag(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+	cache := t.TempDir()
+	t.Setenv("GOCACHE", cache)
+
+	// The fake cargo only succeeds for the build.
+	fakeCargo(t, "")
+
+	l := &Library{
+		Path:    "github.com/influxdata/flux",
+		Version: "v0.194.3",
+		Dir:     t.TempDir(),
+		Target:  Target{OS: "linux", Arch: "amd64"},
+		ArchTag: "x86_64-linux-gnu",
+	}
+
+	// Create the library that cargo would have built.
+	releaseDir := filepath.Join(l.Dir, "libflux", "target", "x86_64-unknown-linux-gnu", "release")
+	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(releaseDir, "libflux.a"), []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buildid, err := l.Install(context.Background(), zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	execPrefix := filepath.Join(cache, "pkgconfig", "x86_64-linux-gnu")
+	if _, err := os.Stat(filepath.Join(execPrefix, "lib", "libflux-"+buildid+".a")); err != nil {
+		t.Errorf("expected library in the arch tag directory: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(cache, "pkgconfig", "linux_amd64")); !os.IsNotExist(err) {
+		t.Errorf("expected no directory for the target, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := l.WritePackageConfig(&buf, buildid); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "exec_prefix=" + pcPath(execPrefix) + "\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("expected package config to contain %q, got:\n%s", want, buf.String())
+	}
+
+	for _, tag := range []string{"..", "lib/x86_64-linux-gnu"} {
+		if _, err := getArchTag(Options{ArchTag: tag}); err == nil {
+			t.Errorf("expected error for arch tag %q", tag)
+		}
+	}
+}
+
+func TestLibrary_InstallPrunesCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+	t.Setenv("PKG_CONFIG_CACHE_GENERATIONS", "2")
+	cache := t.TempDir()
+	t.Setenv("GOCACHE", cache)
+
+	// The fake cargo only succeeds for the build.
+	fakeCargo(t, "")
+
+	l := &Library{
+		Path:    "github.com/influxdata/flux",
+		Version: "v0.194.3",
+		Dir:     t.TempDir(),
+		Target:  Target{OS: "linux", Arch: "amd64"},
+	}
+
+	// Create the library that cargo would have built.
+	releaseDir := filepath.Join(l.Dir, "libflux", "target", "x86_64-unknown-linux-gnu", "release")
+	if err := os.MkdirAll(releaseDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(releaseDir, "libflux.a"), []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Populate the cache with older generations, oldest first.
+	libdir := filepath.Join(cache, "pkgconfig", "linux_amd64", "lib")
+	debugdir := filepath.Join(cache, "pkgconfig", "linux_amd64", "debug")
+	now := time.Now()
+	for i, id := range []string{"a", "b", "c"} {
+		modTime := now.Add(time.Duration(i-3) * time.Hour)
+		copyDir := filepath.Join(cache, "pkgconfig", "github.com", "influxdata", fmt.Sprintf("flux@v0.190.%d", i))
+		for _, path := range []string{copyDir, libdir, filepath.Join(debugdir, id)} {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		lib := filepath.Join(libdir, "libflux-"+id+".a")
+		if err := ioutil.WriteFile(lib, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{copyDir, lib} {
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	buildid, err := l.Install(context.Background(), zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tt := range []struct {
+		pattern string
+		want    []string
+	}{
+		{
+			pattern: filepath.Join(cache, "pkgconfig", "github.com", "influxdata", "flux@*"),
+			want:    []string{"flux@v0.190.1", "flux@v0.190.2"},
+		},
+		{
+			pattern: filepath.Join(libdir, "*"),
+			want:    []string{"libflux-" + buildid + ".a", "libflux-c.a"},
+		},
+		{
+			pattern: filepath.Join(debugdir, "*"),
+			want:    []string{"c"},
+		},
+	} {
+		matches, err := filepath.Glob(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(matches))
+		for i, match := range matches {
+			got[i] = filepath.Base(match)
+		}
+		sort.Strings(got)
+		sort.Strings(tt.want)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("unexpected cache entries for %s: got %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestLibrary_PruneCacheLockedSources(t *testing.T) {
+	t.Setenv("CARGO_TARGET_DIR", "")
+	t.Setenv("PKG_CONFIG_COPY_DIR", "")
+	t.Setenv("PKG_CONFIG_CACHE_GENERATIONS", "1")
+	defer func() { fileLocked = isFileLocked }()
+
+	for _, tt := range []struct {
+		name   string
+		locked bool
+		want   []string
+	}{
+		{name: "Unlocked", want: []string{"flux@v0.194.3"}},
+		{name: "Locked", locked: true, want: []string{"flux@v0.190.0", "flux@v0.194.3"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := t.TempDir()
+			l := &Library{
+				Path:    "github.com/influxdata/flux",
+				Version: "v0.194.3",
+				Target:  Target{OS: "linux", Arch: "amd64"},
+			}
+
+			old := time.Now().Add(-time.Hour)
+			for _, dir := range []string{filepath.Join(copyRoot(cache), "github.com", "influxdata", "flux@v0.190.0"), l.copyDir(cache)} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(dir, old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Another build of one of the copies holds the lock on the target.
+			lockDir := filepath.Join(l.copyTargetDir(cache), "x86_64-unknown-linux-gnu", "release")
+			if err := os.MkdirAll(lockDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(lockDir, ".cargo-lock"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			fileLocked = func(string) (bool, error) { return tt.locked, nil }
+
+			l.pruneCache(zap.NewNop(), cache, "abc")
+
+			matches, err := filepath.Glob(filepath.Join(copyRoot(cache), "github.com", "influxdata", "flux@*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, len(matches))
+			for i, match := range matches {
+				got[i] = filepath.Base(match)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected cached sources: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLibrary_CopyIfReadOnlyMarksCopyUsed(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("PKG_CONFIG_COPY_DIR", "")
+
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chmod(dir, 0755) }()
+
+	// The sources were copied by an earlier build.
+	l := &Library{Path: "github.com/influxdata/flux", Version: "v0.194.3", Dir: dir}
+	srcdir := l.copyDir(cache)
+	if err := os.MkdirAll(srcdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(srcdir, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.copyIfReadOnly(context.Background(), zap.NewNop(), cache); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if l.Dir != srcdir {
+		t.Fatalf("unexpected source dir: got %q, want %q", l.Dir, srcdir)
+	}
+	info, err := os.Stat(srcdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().After(old.Add(time.Hour)) {
+		t.Errorf("expected the copy to be marked as used, got modification time %s", info.ModTime())
+	}
+}
+
+func TestConfigureVersion_Cancel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake go requires a unix shell")
+	}
+	t.Setenv("GOCACHE", t.TempDir())
+
+	// The fake go hangs while downloading the module.
+	fakeGo := filepath.Join(t.TempDir(), "go")
+	if err := ioutil.WriteFile(fakeGo, []byte("#!/bin/sh\nexec sleep 30\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gocmd = fakeGo
+	defer func() { gocmd = "go" }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	opts := Options{Target: &Target{OS: "linux", Arch: "amd64"}}
+	if _, err := ConfigureVersion(ctx, zap.NewNop(), opts, "v0.194.3"); err != context.Canceled {
+		t.Errorf("expected context canceled error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected configure to return promptly after cancellation, took %s", elapsed)
+	}
+}
+
+func TestGetTarget_TargetFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "target")
+	contents := "# Written by the toolchain.\nGOOS=linux\nGOARCH=arm\nGOARM=7\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PKG_CONFIG_TARGET_FILE", path)
+	t.Setenv("GOOS", "")
+	t.Setenv("GOARCH", "")
+	t.Setenv("GOARM", "")
+
+	got, err := getTarget(true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := (Target{OS: "linux", Arch: "arm", Arm: "7", Static: true}); got != want {
+		t.Errorf("unexpected target: got %+v, want %+v", got, want)
+	}
+
+	// The environment takes precedence over the file.
+	t.Setenv("GOARM", "6")
+	got, err = getTarget(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := (Target{OS: "linux", Arch: "arm", Arm: "6"}); got != want {
+		t.Errorf("unexpected target: got %+v, want %+v", got, want)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("CGO_ENABLED=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getTarget(false); err == nil {
+		t.Error("expected error for unknown variable in target file")
+	}
+}
+
+func TestGetTarget_StrayGoarm(t *testing.T) {
+	t.Setenv("PKG_CONFIG_TARGET_FILE", "")
+	t.Setenv("GOOS", "linux")
+	t.Setenv("GOARCH", "amd64")
+	t.Setenv("GOARM", "7")
+
+	got, err := getTarget(false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := (Target{OS: "linux", Arch: "amd64"}); got != want {
+		t.Errorf("unexpected target: got %+v, want %+v", got, want)
+	}
+
+	// A target constructed with a stray arm version ignores it.
+	stray := Target{OS: "linux", Arch: "amd64", Arm: "7"}
+	if got, want := stray.String(), "linux_amd64"; got != want {
+		t.Errorf("unexpected string: got %q, want %q", got, want)
+	}
+	if got, want := stray.Spec(), "linux/amd64"; got != want {
+		t.Errorf("unexpected spec: got %q, want %q", got, want)
+	}
+	if got, want := stray.cargoTarget(), "x86_64-unknown-linux-gnu"; got != want {
+		t.Errorf("unexpected cargo target: got %q, want %q", got, want)
+	}
+	if parsed, err := ParseTarget(stray.Spec()); err != nil {
+		t.Errorf("unexpected error parsing spec: %s", err)
+	} else if want := (Target{OS: "linux", Arch: "amd64"}); parsed != want {
+		t.Errorf("unexpected parsed target: got %+v, want %+v", parsed, want)
+	}
+	if got, err := configureTarget(Options{Target: &stray}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if got.Arm != "" {
+		t.Errorf("expected the arm version to be cleared, got %q", got.Arm)
+	}
+}
+
+func TestConfigure_FluxRef(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake go requires a unix shell")
+	}
+	t.Setenv("GOCACHE", t.TempDir())
+
+	// The fake go resolves the main branch to a pseudo-version.
+	const pseudoVersion = "v0.194.4-0.20240105162345-abcdef012345"
+	modcache := t.TempDir()
+	dir := filepath.Join(modcache, "flux@"+pseudoVersion)
+	script := `#!/bin/sh
+[ "$*" = "mod download -json github.com/influxdata/flux@main" ] || exit 1
+echo '{"Path": "github.com/influxdata/flux", "Version": "` + pseudoVersion + `", "Dir": "` + dir + `"}'
+`
+	fakeGo := filepath.Join(t.TempDir(), "go")
+	if err := ioutil.WriteFile(fakeGo, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gocmd = fakeGo
+	defer func() { gocmd = "go" }()
+
+	if err := os.MkdirAll(filepath.Join(dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "libflux", "Cargo.toml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PKG_CONFIG_FLUX_REF", "main")
+	opts := Options{Target: &Target{OS: "linux", Arch: "amd64"}}
+	l, err := Configure(context.Background(), zap.NewNop(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if l.Dir != dir {
+		t.Errorf("unexpected dir: got %q, want %q", l.Dir, dir)
+	}
+
+	var buf bytes.Buffer
+	if err := l.WritePackageConfig(&buf, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "Version: " + strings.TrimPrefix(pseudoVersion, "v") + "\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("expected package config to contain %q, got:\n%s", want, buf.String())
+	}
+}
+
+func TestLibrary_BuildSkipsUnchangedSources(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+
+	l := &Library{Dir: t.TempDir(), Target: Target{OS: "linux", Arch: "amd64"}}
+	libfluxDir := filepath.Join(l.Dir, "libflux")
+	releaseDir := filepath.Join(libfluxDir, "target", "x86_64-unknown-linux-gnu", "release")
+
+	// The fake cargo counts the builds and produces the library.
+	_, builds := fakeCargo(t, "mkdir -p "+releaseDir+"\necho archive > "+releaseDir+"/libflux.a\n")
+
+	source := filepath.Join(libfluxDir, "src", "lib.rs")
+	if err := os.MkdirAll(filepath.Dir(source), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(source, []byte("fn main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	build := func() {
+		t.Helper()
+		if _, err := l.build(context.Background(), zap.NewNop(), t.TempDir()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	build()
+	build()
+	if got := builds(); got != 1 {
+		t.Errorf("expected unchanged sources to skip the build, got %d builds", got)
+	}
+
+	if err := ioutil.WriteFile(source, []byte("fn main() { println!(\"changed\"); }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	build()
+	if got := builds(); got != 2 {
+		t.Errorf("expected changed sources to trigger the build, got %d builds", got)
+	}
+}
+
+func TestLibrary_BuildRustcMismatch(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+	t.Setenv("PKG_CONFIG_STRICT_ABI", "")
+
+	l := &Library{Dir: t.TempDir(), Target: Target{OS: "linux", Arch: "amd64"}}
+	releaseDir := filepath.Join(l.Dir, "libflux", "target", "x86_64-unknown-linux-gnu", "release")
+	if err := os.MkdirAll(filepath.Join(l.Dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake cargo counts the builds and produces the library.
+	// The fake rustc reports the version written to a file.
+	tmpdir, builds := fakeCargo(t, "mkdir -p "+releaseDir+"\necho archive > "+releaseDir+"/libflux.a\n")
+	versionFile := filepath.Join(tmpdir, "version")
+	rustc := filepath.Join(tmpdir, "rustc")
+	if err := ioutil.WriteFile(rustc, []byte("#!/bin/sh\ncat "+versionFile+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RUSTC", rustc)
+	setRustcVersion := func(version string) {
+		t.Helper()
+		if err := ioutil.WriteFile(versionFile, []byte(version+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build := func(logger *zap.Logger) {
+		t.Helper()
+		if _, err := l.build(context.Background(), logger, t.TempDir()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	// The cached library was built with an older rustc.
+	setRustcVersion("rustc 1.70.0")
+	build(zap.NewNop())
+	setRustcVersion("rustc 1.72.0")
+
+	core, logs := observer.New(zap.WarnLevel)
+	build(zap.New(core))
+	if got := builds(); got != 1 {
+		t.Errorf("expected the cached library to be used, got %d builds", got)
+	}
+	if logs.FilterMessage("Cached library was built with a different rustc version. Set PKG_CONFIG_STRICT_ABI=1 to rebuild it.").Len() != 1 {
+		t.Error("expected a warning for the rustc version mismatch")
+	}
+
+	t.Setenv("PKG_CONFIG_STRICT_ABI", "1")
+	build(zap.NewNop())
+	if got := builds(); got != 2 {
+		t.Errorf("expected strict abi to rebuild the library, got %d builds", got)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(releaseDir, rustcVersionFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "rustc 1.72.0"; got != want {
+		t.Errorf("unexpected recorded rustc version: got %q, want %q", got, want)
+	}
+
+	// The rebuilt library matches the current rustc.
+	build(zap.NewNop())
+	if got := builds(); got != 2 {
+		t.Errorf("expected the rebuilt library to be used, got %d builds", got)
+	}
+}
+
+func TestLibrary_BuildInputsChanged(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake cargo requires a unix shell")
+	}
+	t.Setenv("CARGO_TARGET_DIR", "")
+	t.Setenv("RUSTFLAGS", "")
+	t.Setenv("CARGO_HOME", t.TempDir())
+
+	l := &Library{Dir: t.TempDir(), Target: Target{OS: "linux", Arch: "amd64"}}
+	releaseDir := filepath.Join(l.Dir, "libflux", "target", "x86_64-unknown-linux-gnu", "release")
+	stdlib := filepath.Join(l.Dir, "stdlib", "universe", "universe.flux")
+	for _, dir := range []string{filepath.Join(l.Dir, "libflux"), filepath.Dir(stdlib)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(stdlib, []byte("package universe\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake cargo counts the builds and produces the library.
+	_, builds := fakeCargo(t, "mkdir -p "+releaseDir+"\necho archive > "+releaseDir+"/libflux.a\n")
+
+	build := func() {
+		t.Helper()
+		if _, err := l.build(context.Background(), zap.NewNop(), t.TempDir()); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	build()
+	build()
+	if got := builds(); got != 1 {
+		t.Fatalf("expected the cached library to be used, got %d builds", got)
+	}
+
+	for i, change := range []func(){
+		func() { t.Setenv("RUSTFLAGS", "-C opt-level=2") },
+		func() {
+			if err := ioutil.WriteFile(stdlib, []byte("package universe\n\nbuiltin now : () => time\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func() { t.Setenv("CFLAGS_x86_64_unknown_linux_gnu", "-O1") },
+		func() {
+			config := filepath.Join(l.Dir, "libflux", ".cargo", "config.toml")
+			if err := os.MkdirAll(filepath.Dir(config), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(config, []byte("[build]\nincremental = false\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		change()
+		build()
+		if got, want := builds(), i+2; got != want {
+			t.Errorf("expected change %d to rebuild the library, got %d builds, want %d", i, got, want)
+		}
+	}
+}
+
+func TestVerifyModuleSum(t *testing.T) {
+	gosum := filepath.Join(t.TempDir(), "go.sum")
+	content := `github.com/influxdata/flux v0.194.3 h1:AAAA=
+github.com/influxdata/flux v0.194.3/go.mod h1:BBBB=
+github.com/influxdata/other v0.1.0 h1:CCCC=
+`
+	if err := ioutil.WriteFile(gosum, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		version  string
+		sum      string
+		goModSum string
+		wantErr  bool
+	}{
+		{name: "Match", version: "v0.194.3", sum: "h1:AAAA=", goModSum: "h1:BBBB="},
+		{name: "MismatchedSum", version: "v0.194.3", sum: "h1:XXXX=", goModSum: "h1:BBBB=", wantErr: true},
+		{name: "MismatchedGoModSum", version: "v0.194.3", sum: "h1:AAAA=", goModSum: "h1:XXXX=", wantErr: true},
+		{name: "MissingEntry", version: "v0.194.4", sum: "h1:AAAA=", wantErr: true},
+		{name: "NoSumReported", version: "v0.194.3", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ver := module.Version{Path: "github.com/influxdata/flux", Version: tt.version}
+			err := verifyModuleSum(gosum, ver, tt.sum, tt.goModSum)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestInstallFile_Concurrent(t *testing.T) {
+	srcdir, libdir := t.TempDir(), t.TempDir()
+	var srcs []string
+	for i := 0; i < 4; i++ {
+		src := filepath.Join(srcdir, fmt.Sprintf("libflux%d.a", i))
+		if err := ioutil.WriteFile(src, []byte("libflux"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		srcs = append(srcs, src)
+	}
+
+	// Each invocation links its own build into the same libdir.
+	dst := filepath.Join(libdir, "libflux-abc.a")
+	var wg sync.WaitGroup
+	errs := make(chan error, len(srcs)*50)
+	for _, src := range srcs {
+		wg.Add(1)
+		go func(src string) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := installFile(src, dst); err != nil {
+					errs <- err
+					return
+				}
+				if data, err := ioutil.ReadFile(dst); err != nil {
+					errs <- err
+					return
+				} else if string(data) != "libflux" {
+					errs <- fmt.Errorf("unexpected content: %q", data)
+					return
+				}
+			}
+		}(src)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// No temporary files are left behind.
+	entries, err := ioutil.ReadDir(libdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "libflux-abc.a" {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Errorf("unexpected files in libdir: %v", names)
+	}
+}
+
+func TestLibrary_BuildLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake rustc requires a unix shell")
+	}
+
+	tmpdir := t.TempDir()
+	writeTool := func(name, version string) string {
+		path := filepath.Join(tmpdir, name)
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\necho '"+version+"'\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// The fake rustc reports the toolchain pinned
+	// by flux when it is run from the crate.
+	rustc := filepath.Join(tmpdir, "rustc")
+	script := "#!/bin/sh\nif [ -f rust-toolchain ]; then echo 'rustc 1.68.0 (2c8cc3432 2023-03-06)'; else echo 'rustc 1.72.0'; fi\n"
+	if err := ioutil.WriteFile(rustc, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RUSTC", rustc)
+	t.Setenv("CARGO", writeTool("cargo", "cargo 1.68.0 (115f34552 2023-02-26)"))
+
+	newLibrary := func() *Library {
+		dir := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dir, "libflux"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, contents := range map[string]string{"Cargo.lock": "# lock\n", "rust-toolchain": "1.68\n"} {
+			if err := ioutil.WriteFile(filepath.Join(dir, "libflux", name), []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &Library{
+			Path:    "github.com/influxdata/flux",
+			Version: "v0.194.3",
+			Dir:     dir,
+			Target:  Target{OS: "linux", Arch: "amd64"},
+		}
+	}
+	l := newLibrary()
+	recorded, err := l.BuildLock(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sum := sha256.Sum256([]byte("# lock\n"))
+	want := &BuildLock{
+		Version:   "v0.194.3",
+		Target:    "x86_64-unknown-linux-gnu",
+		CargoLock: hex.EncodeToString(sum[:]),
+		Rustc:     "rustc 1.68.0 (2c8cc3432 2023-03-06)",
+		Cargo:     "cargo 1.68.0 (115f34552 2023-02-26)",
+	}
+	if !reflect.DeepEqual(recorded, want) {
+		t.Errorf("unexpected build lock:\n got: %+v\nwant: %+v", recorded, want)
+	}
+
+	// The same inputs in another location match the lock.
+	if lock, err := newLibrary().BuildLock(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if diff := lock.Diff(recorded); len(diff) != 0 {
+		t.Errorf("unexpected diff for the same inputs in another location: %v", diff)
+	}
+
+	// A different rustc trips the verification.
+	t.Setenv("RUSTC", writeTool("rustc", "rustc 1.69.0 (84c898d65 2023-04-16)"))
+	lock, err := l.BuildLock(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	diff := lock.Diff(recorded)
+	if len(diff) != 1 || !strings.HasPrefix(diff[0], "rustc:") {
+		t.Errorf("unexpected diff: %v", diff)
+	}
+}
+
+func TestCrossCompileEnv(t *testing.T) {
+	triple := "aarch64-unknown-linux-gnu"
+	for _, tt := range []struct {
+		name     string
+		cc       string
+		sysroot  string
+		existing string
+		want     []string
+	}{
+		{name: "Unset"},
+		{
+			name: "CrossCC",
+			cc:   "aarch64-linux-gnu-gcc",
+			want: []string{"CC_aarch64_unknown_linux_gnu=aarch64-linux-gnu-gcc"},
+		},
+		{
+			name:    "Sysroot",
+			cc:      "aarch64-linux-gnu-gcc",
+			sysroot: "/opt/sysroot",
+			want: []string{
+				"CC_aarch64_unknown_linux_gnu=aarch64-linux-gnu-gcc",
+				"CFLAGS_aarch64_unknown_linux_gnu=--sysroot=/opt/sysroot -I" + filepath.Join("/opt/sysroot", "include"),
+			},
+		},
+		{
+			name:     "ExistingCflags",
+			sysroot:  "/opt/sysroot",
+			existing: "-O2",
+			want: []string{
+				"CFLAGS_aarch64_unknown_linux_gnu=--sysroot=/opt/sysroot -I" + filepath.Join("/opt/sysroot", "include") + " -O2",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_CROSS_CC", tt.cc)
+			t.Setenv("PKG_CONFIG_SYSROOT", tt.sysroot)
+			t.Setenv("CFLAGS_aarch64_unknown_linux_gnu", tt.existing)
+			if got := crossCompileEnv(triple); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected environment:\n got: %q\nwant: %q", got, tt.want)
+			}
+		})
+	}
+
+	// The default target does not need a cross compiler.
+	t.Setenv("PKG_CONFIG_CROSS_CC", "aarch64-linux-gnu-gcc")
+	if got := crossCompileEnv(""); got != nil {
+		t.Errorf("unexpected environment for the default target: %q", got)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	t.Run("ModuleNotFound", func(t *testing.T) {
+		mod, err := modfile.Parse("go.mod", []byte("module example.com/app\n\nrequire github.com/influxdata/other v0.1.0\n"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := findModule(context.Background(), mod, zap.NewNop()); !errors.Is(err, ErrModuleNotFound) {
+			t.Errorf("expected ErrModuleNotFound, got %v", err)
+		}
+	})
+
+	t.Run("BuildFailed", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("fake cargo requires a unix shell")
+		}
+		t.Setenv("CARGO_TARGET_DIR", "")
+
+		fakeCargo(t, "echo 'error: could not compile `flux`' >&2\nexit 101\n")
+
+		cache := t.TempDir()
+		l := &Library{
+			Path:    "github.com/influxdata/flux",
+			Version: "v0.194.3",
+			Target:  Target{OS: "linux", Arch: "amd64"},
+		}
+		l.Dir = l.copyDir(cache)
+		if err := os.MkdirAll(filepath.Join(l.Dir, "libflux"), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := l.build(context.Background(), zap.NewNop(), cache)
+		if !errors.Is(err, ErrBuildFailed) {
+			t.Fatalf("expected ErrBuildFailed, got %v", err)
+		}
+		var buildErr *BuildError
+		if !errors.As(err, &buildErr) {
+			t.Fatalf("expected *BuildError, got %T", err)
+		}
+		if got, want := string(buildErr.Stderr), "error: could not compile `flux`\n"; got != want {
+			t.Errorf("unexpected stderr: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("VersionUndetermined", func(t *testing.T) {
+		t.Setenv("GOCACHE", t.TempDir())
+		l := &Library{Dir: t.TempDir(), Target: Target{OS: "linux", Arch: "amd64"}}
+		if err := l.WritePackageConfig(ioutil.Discard, "abc"); !errors.Is(err, ErrVersionUndetermined) {
+			t.Errorf("expected ErrVersionUndetermined, got %v", err)
+		}
+	})
+}
+
+func TestLibrary_RunPostBuildHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook script requires a unix shell")
+	}
+
+	tmpdir := t.TempDir()
+	record := filepath.Join(tmpdir, "env")
+	hook := filepath.Join(tmpdir, "hook")
+	script := "#!/bin/sh\necho \"$FLUX_LIBDIR $FLUX_VERSION $FLUX_TARGET $FLUX_BUILDID\" > " + record + "\n"
+	if err := ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	failing := filepath.Join(tmpdir, "failing")
+	if err := ioutil.WriteFile(failing, []byte("#!/bin/sh\necho 'signing failed'\nexit 3\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &Library{
+		Version: "v0.194.3",
+		Target:  Target{OS: "linux", Arch: "amd64", Static: true},
+	}
+	libdir := filepath.Join(tmpdir, "lib")
+	if err := l.runPostBuildHook(context.Background(), zap.NewNop(), hook, libdir, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data, err := ioutil.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(data)), libdir+" v0.194.3 linux_amd64_static abc"; got != want {
+		t.Errorf("unexpected hook environment: got %q, want %q", got, want)
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	if err := l.runPostBuildHook(context.Background(), zap.New(core), failing, libdir, "abc"); err == nil {
+		t.Error("expected error for failing hook")
+	}
+	if logs.FilterMessage("signing failed").Len() != 1 {
+		t.Error("expected the hook output to be logged")
+	}
+}
+
+func TestStripLibrary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake strip requires a unix shell")
+	}
+
+	target := Target{OS: "linux", Arch: "s390x"}
+	if runtime.GOOS == target.OS && runtime.GOARCH == target.Arch {
+		target.Arch = "mips"
+	}
+	triple := target.cargoTarget()
+	for _, tt := range []struct {
+		name   string
+		target Target
+		env    map[string]string
+		want   string
+	}{
+		{name: "Host", target: Target{OS: runtime.GOOS, Arch: runtime.GOARCH}, want: "strip"},
+		{name: "Triple", target: target, want: triple + "-strip"},
+		{
+			name:   "CrossCC",
+			target: target,
+			env:    map[string]string{"PKG_CONFIG_CROSS_CC": "/opt/cross/bin/s390x-linux-gnu-gcc"},
+			want:   "/opt/cross/bin/s390x-linux-gnu-strip",
+		},
+		{
+			name:   "TargetCC",
+			target: target,
+			env:    map[string]string{"CC_" + strings.ReplaceAll(triple, "-", "_"): "s390x-linux-gnu-gcc -march=z13"},
+			want:   "s390x-linux-gnu-strip",
+		},
+		{
+			name:   "UnprefixedCC",
+			target: target,
+			env:    map[string]string{"PKG_CONFIG_CROSS_CC": "clang"},
+			want:   triple + "-strip",
+		},
+		{
+			name:   "Override",
+			target: target,
+			env:    map[string]string{"PKG_CONFIG_CROSS_CC": "s390x-linux-gnu-gcc", "PKG_CONFIG_STRIP_CMD": "llvm-strip"},
+			want:   "llvm-strip",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"PKG_CONFIG_STRIP_CMD", "PKG_CONFIG_CROSS_CC", "CC_" + triple, "CC_" + strings.ReplaceAll(triple, "-", "_")} {
+				t.Setenv(key, tt.env[key])
+			}
+			if got := tt.target.stripCmd(); got != tt.want {
+				t.Errorf("unexpected strip command: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("PKG_CONFIG_CROSS_CC", "s390x-linux-gnu-gcc")
+	strip := target.stripCmd()
+
+	// The fake strip records its arguments and writes the output file.
+	bindir := t.TempDir()
+	record := filepath.Join(bindir, "args")
+	script := "#!/bin/sh\necho \"$@\" > " + record + "\necho stripped > \"$3\"\n"
+	if err := ioutil.WriteFile(filepath.Join(bindir, strip), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bindir)
+
+	libdir := t.TempDir()
+	path := filepath.Join(libdir, "libflux-abc.a")
+	if err := ioutil.WriteFile(path, []byte("unstripped"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := stripLibrary(context.Background(), zap.NewNop(), strip, path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	args, err := ioutil.ReadFile(record)
+	if err != nil {
+		t.Fatalf("expected %s to be invoked: %s", strip, err)
+	}
+	if fields := strings.Fields(string(args)); len(fields) != 4 || fields[0] != "-S" || fields[3] != path {
+		t.Errorf("unexpected strip arguments: %q", args)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if got := strings.TrimSpace(string(data)); got != "stripped" {
+		t.Errorf("expected the library to be replaced, got %q", got)
+	}
+	if entries, err := ioutil.ReadDir(libdir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Errorf("expected temporary files to be removed, found %d entries", len(entries))
+	}
+
+	// A missing strip binary is skipped.
+	core, logs := observer.New(zap.InfoLevel)
+	if err := stripLibrary(context.Background(), zap.New(core), "missing-strip", path); err != nil {
+		t.Errorf("unexpected error for missing strip: %s", err)
+	}
+	if logs.FilterMessage("Unable to find strip, skipping").Len() != 1 {
+		t.Error("expected a warning for the missing strip")
+	}
+}
+
+func TestCheckPrerequisites(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake tools require a unix shell")
+	}
+
+	tools := map[string]string{
+		"cargo":  "#!/bin/sh\necho cargo 1.72.0\n",
+		"rustc":  "#!/bin/sh\necho rustc 1.72.0\n",
+		"rustup": "#!/bin/sh\necho x86_64-unknown-linux-gnu\necho aarch64-unknown-linux-gnu\n",
+		"git":    "#!/bin/sh\necho git version 2.40.0\n",
+	}
+	for _, tt := range []struct {
+		name    string
+		missing string
+		target  Target
+		want    []Prerequisite
+	}{
+		{
+			name:   "Present",
+			target: Target{OS: "linux", Arch: "arm64"},
+			want: []Prerequisite{
+				{Name: "cargo", Detail: "cargo 1.72.0", OK: true},
+				{Name: "rustc", Detail: "rustc 1.72.0", OK: true},
+				{Name: "rust target", Detail: "aarch64-unknown-linux-gnu", OK: true},
+				{Name: "git", Detail: "git version 2.40.0", OK: true},
+			},
+		},
+		{
+			name:    "MissingCargo",
+			missing: "cargo",
+			target:  Target{OS: "linux", Arch: "arm64"},
+			want: []Prerequisite{
+				{Name: "cargo"},
+				{Name: "rustc", Detail: "rustc 1.72.0", OK: true},
+				{Name: "rust target", Detail: "aarch64-unknown-linux-gnu", OK: true},
+				{Name: "git", Detail: "git version 2.40.0", OK: true},
+			},
+		},
+		{
+			name:   "TargetNotInstalled",
+			target: Target{OS: "linux", Arch: "arm64", Static: true},
+			want: []Prerequisite{
+				{Name: "cargo", Detail: "cargo 1.72.0", OK: true},
+				{Name: "rustc", Detail: "rustc 1.72.0", OK: true},
+				{Name: "rust target", Detail: "aarch64-unknown-linux-musl is not installed, run rustup target add aarch64-unknown-linux-musl"},
+				{Name: "git", Detail: "git version 2.40.0", OK: true},
+			},
+		},
+		{
+			name:    "MissingGit",
+			missing: "git",
+			target:  Target{OS: "linux", Arch: "arm64"},
+			want: []Prerequisite{
+				{Name: "cargo", Detail: "cargo 1.72.0", OK: true},
+				{Name: "rustc", Detail: "rustc 1.72.0", OK: true},
+				{Name: "rust target", Detail: "aarch64-unknown-linux-gnu", OK: true},
+				{Name: "git"},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			bindir := t.TempDir()
+			for name, script := range tools {
+				if name == tt.missing {
+					continue
+				}
+				if err := ioutil.WriteFile(filepath.Join(bindir, name), []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PATH", bindir)
+			t.Setenv("CARGO", "")
+			t.Setenv("RUSTC", "")
+
+			got, err := CheckPrerequisites(context.Background(), Options{Target: &tt.target})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("unexpected number of prerequisites: got %d, want %d", len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				// The reason a tool is missing depends on the platform.
+				if !want.OK && want.Detail == "" {
+					want.Detail = got[i].Detail
+				}
+				if got[i] != want {
+					t.Errorf("unexpected prerequisite: got %+v, want %+v", got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckCargoLocks(t *testing.T) {
+	defer func() { fileLocked = isFileLocked }()
+	defer func(poll time.Duration) { cargoLockPoll = poll }(cargoLockPoll)
+	cargoLockPoll = time.Millisecond
+
+	for _, tt := range []struct {
+		name    string
+		checks  int
+		clear   string
+		waiting bool
+		removed bool
+		wantErr bool
+	}{
+		{name: "Unlocked"},
+		{name: "Released", checks: 3, waiting: true},
+		{name: "DeadProcess", checks: -1, waiting: true, wantErr: true},
+		{name: "ClearDeadProcess", checks: -1, clear: "1", waiting: true, removed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_CARGO_LOCK_TIMEOUT", "50ms")
+			t.Setenv("PKG_CONFIG_CLEAR_CARGO_LOCK", tt.clear)
+
+			// The lock is held for the given number of checks
+			// or forever when it is negative.
+			checks := 0
+			fileLocked = func(string) (bool, error) {
+				checks++
+				return tt.checks < 0 || checks <= tt.checks, nil
+			}
+
+			cargoTargetDir := t.TempDir()
+			targetDir := filepath.Join(cargoTargetDir, "x86_64-unknown-linux-musl", "release")
+			if err := os.MkdirAll(targetDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			lock := filepath.Join(targetDir, ".cargo-lock")
+			if err := ioutil.WriteFile(lock, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			core, logs := observer.New(zap.InfoLevel)
+			err := checkCargoLocks(context.Background(), zap.New(core), cargoTargetDir, targetDir)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "locked by a dead process") {
+					t.Errorf("expected an error for the lock held by a dead process, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			waiting := logs.FilterMessage("Waiting for another build to release the cargo target").Len() == 1
+			if waiting != tt.waiting {
+				t.Errorf("unexpected waiting message: got %v, want %v", waiting, tt.waiting)
+			}
+
+			// The lock of a running build is never removed.
+			if _, err := os.Stat(lock); os.IsNotExist(err) != tt.removed {
+				t.Errorf("unexpected lock removal: got %v, want %v", os.IsNotExist(err), tt.removed)
+			}
+		})
+	}
+
+	t.Setenv("PKG_CONFIG_CARGO_LOCK_TIMEOUT", "soon")
+	if err := checkCargoLocks(context.Background(), zap.NewNop(), t.TempDir(), t.TempDir()); err == nil {
+		t.Error("expected error for an invalid timeout")
+	}
+}
+
+func TestConfigureSystem(t *testing.T) {
+	prefix := t.TempDir()
+	t.Setenv("PKG_CONFIG_SYSTEM_FLUX_PREFIX", prefix)
+	for _, name := range []string{"PKG_CONFIG_EXTRA_LIBS", "PKG_CONFIG_EXTRA_INCLUDES", "PKG_CONFIG_DEFINES", "PKG_CONFIG_OMIT_SYSTEM_LIBS"} {
+		t.Setenv(name, "")
+	}
+	host := Target{OS: runtime.GOOS, Arch: runtime.GOARCH}
+	opts := Options{Target: &host}
+
+	// Only the headers are installed.
+	if err := os.MkdirAll(filepath.Join(prefix, "include", "influxdata"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(prefix, "include", "influxdata", "flux.h"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConfigureSystem(zap.NewNop(), opts); err == nil {
+		t.Error("expected error for incomplete system installation")
+	}
+
+	// The library and version file complete the installation.
+	if err := os.MkdirAll(filepath.Join(prefix, "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(prefix, "lib", "libflux.a"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(prefix, "share", "flux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(prefix, "share", "flux", "VERSION"), []byte("v0.194.3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := ConfigureSystem(zap.NewNop(), opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if buildid, err := l.Install(context.Background(), zap.NewNop()); err != nil || buildid != "" {
+		t.Errorf("unexpected install result: %q, %v", buildid, err)
+	}
+
+	var buf bytes.Buffer
+	if err := l.WritePackageConfig(&buf, ""); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, want := range []string{
+		"prefix=" + pcPath(prefix) + "\n",
+		"Version: 0.194.3\n",
+		"Libs: -L${libdir} -lflux" + host.systemLibs() + "\n",
+		"Cflags: -I${includedir}\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected package config to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestConfigureSystem_CrossTarget(t *testing.T) {
+	prefix := t.TempDir()
+	t.Setenv("PKG_CONFIG_SYSTEM_FLUX_PREFIX", prefix)
+	for _, path := range []string{
+		filepath.Join(prefix, "include", "influxdata", "flux.h"),
+		filepath.Join(prefix, "lib", "libflux.a"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The system library was built for the host.
+	cross := Target{OS: "linux", Arch: "s390x"}
+	if cross.isHost() {
+		cross.Arch = "mips"
+	}
+	if _, err := ConfigureSystem(zap.NewNop(), Options{Target: &cross}); err == nil {
+		t.Error("expected error for a target other than the host")
+	}
+}
+
+func TestSystemLibrary_WritePackageConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		lib  SystemLibrary
+		libs string
+		want string
+	}{
+		{
+			name: "HeadersOnly",
+			lib:  SystemLibrary{HeadersOnly: true},
+			want: "Cflags: -I${includedir}\n",
+		},
+		{
+			name: "OmitSystemLibs",
+			lib:  SystemLibrary{OmitSystemLibs: true},
+			libs: "Libs: -L${libdir} -lflux -lm\n",
+		},
+		{
+			name: "ExtraLibs",
+			lib:  SystemLibrary{ExtraLibs: []string{"-L/opt/lib", "-lz"}},
+			libs: "Libs: -L${libdir} -lflux -ldl -lm -L/opt/lib -lz\n",
+		},
+		{
+			name: "Defines",
+			lib:  SystemLibrary{ExtraIncludeDirs: []string{"/opt/include"}, Defines: []string{"FLUX_STATIC"}},
+			libs: "Libs: -L${libdir} -lflux -ldl -lm\n",
+			want: "Cflags: -I${includedir} -I/opt/include -DFLUX_STATIC\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := tt.lib
+			l.Prefix, l.Version, l.Target = "/usr", "v0.194.3", Target{OS: "linux", Arch: "amd64"}
+
+			var buf bytes.Buffer
+			if err := l.WritePackageConfig(&buf, ""); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got := buf.String()
+			if tt.libs == "" && strings.Contains(got, "Libs:") {
+				t.Errorf("expected no libraries in the package config, got:\n%s", got)
+			} else if !strings.Contains(got, tt.libs) {
+				t.Errorf("expected package config to contain %q, got:\n%s", tt.libs, got)
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("expected package config to contain %q, got:\n%s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package flux
+
+// isFileLocked reports whether another process holds the lock
+// on the file. Checking the lock is not supported on this platform,
+// such as windows, so it is never reported as held.
+func isFileLocked(path string) (bool, error) {
+	return false, nil
+}
+
+// lockFile takes an exclusive lock on the file at path. Locking is
+// not supported on this platform so nothing is locked.
+func lockFile(path string) (unlock func(), err error) {
+	return func() {}, nil
+}
@@ -4,7 +4,7 @@ import "regexp"
 
 // fluxVersionRegexp is used to extract the version of flux pulled down by `go mod` by inspecting
 // its path on the filesystem.
-var fluxVersionRegexp = regexp.MustCompile(`\\github\.com\\[^\\]+\\flux@(v\d+\.\d+\.\d+.*)$`)
+var fluxVersionRegexp = regexp.MustCompile(`\\github\.com\\[^\\]+\\flux(?:\\v\d+)?@(v\d+\.\d+\.\d+.*)$`)
 
 // pcSep is the separator used between components in all the path-fields written into `flux.pc`
 // by our `pkg-config` wrapper. On Windows we have to double-escape the OS's path separator because:
@@ -0,0 +1,84 @@
+package flux
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/influxdata/pkg-config/internal/modload"
+	"go.uber.org/zap"
+)
+
+// Tool describes a tool that was looked up for the diagnostics.
+// Error is set instead of Version when the tool is unusable.
+type Tool struct {
+	Path    string `json:"path,omitempty"`
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ModuleStatus describes whether the flux module
+// can be resolved from the main module.
+type ModuleStatus struct {
+	Resolvable bool   `json:"resolvable"`
+	Version    string `json:"version,omitempty"`
+	Dir        string `json:"dir,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Diagnostics describes the environment flux would be built in.
+type Diagnostics struct {
+	Cargo  Tool         `json:"cargo"`
+	Rustc  Tool         `json:"rustc"`
+	Go     Tool         `json:"go"`
+	GOOS   string       `json:"goos"`
+	GOARCH string       `json:"goarch"`
+	Flux   ModuleStatus `json:"flux"`
+}
+
+// Diagnose collects the versions of the tools used to build flux,
+// the target from the go environment and whether the flux module
+// can be resolved from the current directory. Nothing is built.
+// A problem with any part is recorded rather than returned.
+func Diagnose(ctx context.Context, logger *zap.Logger, opts Options) *Diagnostics {
+	d := &Diagnostics{
+		Cargo: toolStatus(ctx, lookupCargoCmd(), "--version"),
+		Rustc: toolStatus(ctx, lookupRustcCmd(), "--version"),
+		Go:    toolStatus(ctx, gocmd, "version"),
+	}
+
+	if target, err := configureTarget(opts); err != nil {
+		logger.Warn("Unable to determine the target", zap.Error(err))
+	} else {
+		d.GOOS, d.GOARCH = target.OS, target.Arch
+	}
+
+	if !modload.HasModRoot() {
+		d.Flux.Error = "no go.mod found in the current directory or any parent"
+	} else if ver, dir, _, err := resolveModule(ctx, modload.ModRoot(), logger); err != nil {
+		d.Flux.Error = err.Error()
+	} else {
+		d.Flux = ModuleStatus{Resolvable: true, Version: ver.Version, Dir: dir}
+	}
+	return d
+}
+
+// toolStatus runs the tool with the arguments
+// that make it report its version.
+func toolStatus(ctx context.Context, name string, args ...string) Tool {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return Tool{Error: err.Error()}
+	}
+	out, err := exec.CommandContext(ctx, path, args...).Output()
+	if err != nil {
+		return Tool{Path: path, Error: err.Error()}
+	}
+	return Tool{Path: path, Version: strings.TrimSpace(string(out))}
+}
+
+// ToolStatus looks up the tool and reports
+// the version it prints for --version.
+func ToolStatus(ctx context.Context, name string) Tool {
+	return toolStatus(ctx, name, "--version")
+}
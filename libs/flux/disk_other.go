@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!windows
+
+package flux
+
+// availableDiskSpace is not supported on this platform
+// so the disk space check is skipped.
+func availableDiskSpace(path string) (uint64, error) {
+	return 0, errDiskSpaceUnsupported
+}
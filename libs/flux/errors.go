@@ -0,0 +1,37 @@
+package flux
+
+import "errors"
+
+var (
+	// ErrModuleNotFound is returned when the flux module
+	// is not a dependency of the main module.
+	ErrModuleNotFound = errors.New("could not find module")
+
+	// ErrBuildFailed is returned when cargo fails to build
+	// the library. The error is a *BuildError.
+	ErrBuildFailed = errors.New("cargo build failed")
+
+	// ErrVersionUndetermined is returned when the version
+	// of the flux module could not be determined.
+	ErrVersionUndetermined = errors.New("version is empty")
+)
+
+// BuildError is returned when cargo fails to build the library.
+// It holds the output of cargo for inspection.
+type BuildError struct {
+	Err    error
+	Stderr []byte
+}
+
+func (e *BuildError) Error() string {
+	return ErrBuildFailed.Error() + ": " + e.Err.Error()
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is ErrBuildFailed.
+func (e *BuildError) Is(target error) bool {
+	return target == ErrBuildFailed
+}
@@ -0,0 +1,78 @@
+package flux
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// BuildLock records the resolved inputs of a build so
+// a later build can verify it uses the same inputs.
+type BuildLock struct {
+	Version   string `json:"version"`
+	Target    string `json:"target"`
+	CargoLock string `json:"cargo_lock"`
+	Rustc     string `json:"rustc"`
+	Cargo     string `json:"cargo"`
+}
+
+// BuildLock returns the resolved inputs for building the library.
+// The Cargo.lock checksum is empty when the crate has no lock file.
+func (l *Library) BuildLock(ctx context.Context) (*BuildLock, error) {
+	lock := &BuildLock{
+		Version: l.Version,
+		Target:  l.Target.cargoTarget(),
+	}
+
+	sum, err := checksumFiles(filepath.Join(l.Dir, "libflux", "Cargo.lock"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lock.CargoLock = sum
+
+	// The tools are run from the crate so the
+	// rust-toolchain file of flux selects them.
+	libflux := filepath.Join(l.Dir, "libflux")
+	if lock.Rustc, err = toolVersion(ctx, libflux, lookupRustcCmd()); err != nil {
+		return nil, err
+	}
+	if lock.Cargo, err = toolVersion(ctx, libflux, lookupCargoCmd()); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Diff returns a description of each input that differs
+// between the recorded lock and this one.
+func (b *BuildLock) Diff(recorded *BuildLock) []string {
+	var diff []string
+	for _, field := range []struct {
+		name      string
+		want, got string
+	}{
+		{name: "version", want: recorded.Version, got: b.Version},
+		{name: "target", want: recorded.Target, got: b.Target},
+		{name: "cargo_lock", want: recorded.CargoLock, got: b.CargoLock},
+		{name: "rustc", want: recorded.Rustc, got: b.Rustc},
+		{name: "cargo", want: recorded.Cargo, got: b.Cargo},
+	} {
+		if field.want != field.got {
+			diff = append(diff, fmt.Sprintf("%s: recorded %q, got %q", field.name, field.want, field.got))
+		}
+	}
+	return diff
+}
+
+// toolVersion returns the version reported by the tool when it is run in dir.
+func toolVersion(ctx context.Context, dir, name string) (string, error) {
+	cmd := exec.CommandContext(ctx, name, "--version")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("could not determine the version of %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
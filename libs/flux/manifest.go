@@ -0,0 +1,65 @@
+package flux
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// manifestFile is the file in the libflux directory where flux
+// declares the flags needed to link against it.
+const manifestFile = "pkgconfig.json"
+
+// packageManifest declares the package config flags for each platform.
+// The platforms are keyed by the target, such as linux_amd64_static,
+// by the operating system, such as linux, or by * for any platform.
+// The most specific entry for the target is used.
+//
+//	{
+//	  "platforms": {
+//	    "linux": {"libs": ["-ldl", "-lm"]},
+//	    "linux_amd64_static": {"libs": ["-ldl", "-lpthread", "-lm"]},
+//	    "*": {"cflags": ["-DFLUX_NO_STD"], "requires": ["zlib"]}
+//	  }
+//	}
+type packageManifest struct {
+	Platforms map[string]manifestEntry `json:"platforms"`
+}
+
+type manifestEntry struct {
+	// Libs are the system libraries linked after the flux library.
+	Libs []string `json:"libs"`
+
+	// Cflags are added to the compiler flags after the include directory.
+	Cflags []string `json:"cflags"`
+
+	// Requires are the packages that flux depends on.
+	Requires []string `json:"requires"`
+}
+
+// readManifest reads the manifest entry for the target from the libflux
+// directory. It returns nil when flux does not provide a manifest or
+// the manifest has no entry for the target.
+func readManifest(dir string, target Target) (*manifestEntry, error) {
+	path := filepath.Join(dir, "libflux", manifestFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var m packageManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid package manifest %s: %w", path, err)
+	}
+	for _, key := range []string{target.String(), target.OS, "*"} {
+		if entry, ok := m.Platforms[key]; ok {
+			return &entry, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,91 @@
+package flux
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Prerequisite is the result of checking for one
+// of the tools needed to build the library.
+type Prerequisite struct {
+	// Name identifies the prerequisite.
+	Name string
+
+	// Detail is the version of the tool that was found
+	// or a description of why the check failed.
+	Detail string
+
+	// OK reports whether the prerequisite is present.
+	OK bool
+}
+
+// CheckPrerequisites checks that cargo, rustc, the standard library
+// for the cargo target triple and git are installed. Every
+// prerequisite is checked even when an earlier one is missing.
+func CheckPrerequisites(ctx context.Context, opts Options) ([]Prerequisite, error) {
+	target, err := configureTarget(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var prereqs []Prerequisite
+	for _, tool := range []struct {
+		name, cmd string
+	}{
+		{name: "cargo", cmd: lookupCargoCmd()},
+		{name: "rustc", cmd: lookupRustcCmd()},
+	} {
+		prereqs = append(prereqs, checkToolVersion(ctx, tool.name, tool.cmd))
+	}
+	prereqs = append(prereqs, checkRustTarget(ctx, target.cargoTarget()))
+	prereqs = append(prereqs, checkToolVersion(ctx, "git", gitcmd))
+	return prereqs, nil
+}
+
+// checkToolVersion checks that the tool is
+// installed by asking it for its version.
+func checkToolVersion(ctx context.Context, name, cmd string) Prerequisite {
+	version, err := toolVersion(ctx, "", cmd)
+	if err != nil {
+		return Prerequisite{Name: name, Detail: err.Error()}
+	}
+	return Prerequisite{Name: name, Detail: version, OK: true}
+}
+
+// checkRustTarget checks that rustup has installed the standard
+// library for the target triple. The host is always installed
+// so there is nothing to check when the triple is unknown.
+func checkRustTarget(ctx context.Context, triple string) Prerequisite {
+	name := "rust target"
+	if triple == "" {
+		return Prerequisite{Name: name, Detail: "default host target", OK: true}
+	}
+
+	out, err := exec.CommandContext(ctx, "rustup", "target", "list", "--installed").Output()
+	if err != nil {
+		return Prerequisite{Name: name, Detail: fmt.Sprintf("could not list the installed targets: %s", err)}
+	}
+	for _, installed := range strings.Fields(string(out)) {
+		if installed == triple {
+			return Prerequisite{Name: name, Detail: triple, OK: true}
+		}
+	}
+	return Prerequisite{
+		Name:   name,
+		Detail: fmt.Sprintf("%s is not installed, run rustup target add %s", triple, triple),
+	}
+}
+
+// lookupCargoCmd returns the value of the environment
+// variable CARGO if it is non-empty. Otherwise it is "cargo".
+func lookupCargoCmd() string {
+	return envCargo.Get()
+}
+
+// lookupRustcCmd returns the value of the environment
+// variable RUSTC if it is non-empty. Otherwise it is "rustc".
+func lookupRustcCmd() string {
+	return envRustc.Get()
+}
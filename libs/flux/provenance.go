@@ -0,0 +1,91 @@
+package flux
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Provenance describes the sources and build products
+// of an installed library for generating an SBOM.
+type Provenance struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Dir     string `json:"dir"`
+	Commit  string `json:"commit,omitempty"`
+	Target  string `json:"target"`
+
+	// Libraries maps the filename of each installed
+	// library to the SHA-256 checksum of its contents.
+	Libraries map[string]string `json:"libraries"`
+}
+
+// Provenance returns the provenance of the library installed
+// with the given build id. The git commit is only included
+// when the sources are within a git repository.
+func (l *Library) Provenance(buildid string) (*Provenance, error) {
+	p := &Provenance{
+		Path:      l.Path,
+		Version:   l.Version,
+		Dir:       l.Dir,
+		Commit:    gitHeadCommit(l.Dir),
+		Target:    l.Target.cargoTarget(),
+		Libraries: map[string]string{},
+	}
+	if l.HeadersOnly {
+		return p, nil
+	}
+
+	cache, err := getGoCache()
+	if err != nil {
+		return nil, err
+	}
+	libdir := filepath.Join(cache, "pkgconfig", l.archDir(), "lib")
+	for _, name := range []string{"flux"} {
+		filename := libraryFilename(p.Target, name+"-"+buildid)
+		sum, err := checksumFiles(filepath.Join(libdir, filename))
+		if err != nil {
+			return nil, err
+		}
+		p.Libraries[filename] = sum
+	}
+	return p, nil
+}
+
+// gitHeadCommit returns the commit checked out in the directory or
+// an empty string if the directory is not the top of a git repository.
+// Sources within another repository, such as a module vendored into
+// the repository of the main module, are not described by its commit.
+func gitHeadCommit(dir string) string {
+	if envNoGit.Get() == "1" {
+		return ""
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(gitcmd, "rev-parse", "--show-toplevel", "HEAD")
+	cmd.Stdout = &stdout
+	cmd.Dir = dir
+	if err := cmd.Run(); err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 || !sameDir(lines[0], dir) {
+		return ""
+	}
+	return strings.TrimSpace(lines[1])
+}
+
+// sameDir reports whether the paths refer to the same directory.
+func sameDir(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
@@ -0,0 +1,50 @@
+package flux
+
+import "github.com/influxdata/pkg-config/internal/settings"
+
+// The environment variables that configure how flux is resolved,
+// built, and described by its package config.
+var (
+	envArchTag               = settings.New("PKG_CONFIG_ARCH_TAG", "")
+	envCacheGenerations      = settings.New("PKG_CONFIG_CACHE_GENERATIONS", "")
+	envCargo                 = settings.New("CARGO", "cargo")
+	envCargoIncremental      = settings.New("PKG_CONFIG_CARGO_INCREMENTAL", "")
+	envCargoLockTimeout      = settings.New("PKG_CONFIG_CARGO_LOCK_TIMEOUT", "10m")
+	envCargoLocked           = settings.New("PKG_CONFIG_CARGO_LOCKED", "")
+	envCargoProfileOverrides = settings.New("PKG_CONFIG_CARGO_PROFILE_OVERRIDES", "")
+	envCargoTargetDir        = settings.New("CARGO_TARGET_DIR", "")
+	envCargoVendorDir        = settings.New("PKG_CONFIG_CARGO_VENDOR_DIR", "")
+	envClearCargoLock        = settings.New("PKG_CONFIG_CLEAR_CARGO_LOCK", "")
+	envCopyDir               = settings.New("PKG_CONFIG_COPY_DIR", "")
+	envCrossCC               = settings.New("PKG_CONFIG_CROSS_CC", "")
+	envDebugInfo             = settings.New("PKG_CONFIG_DEBUGINFO", "")
+	envDefines               = settings.New("PKG_CONFIG_DEFINES", "")
+	envExtraIncludes         = settings.New("PKG_CONFIG_EXTRA_INCLUDES", "")
+	envExtraLibs             = settings.New("PKG_CONFIG_EXTRA_LIBS", "")
+	envFluxRef               = settings.New("PKG_CONFIG_FLUX_REF", "")
+	envFluxSubmodule         = settings.New("PKG_CONFIG_FLUX_SUBMODULE", "")
+	envGitFetchTags          = settings.New("PKG_CONFIG_GIT_FETCH_TAGS", "")
+	envGo                    = settings.New("GO", "")
+	envGoBinary              = settings.New("PKG_CONFIG_GO_BINARY", "")
+	envGoProxy               = settings.New("PKG_CONFIG_GOPROXY", "")
+	envLTO                   = settings.New("PKG_CONFIG_LTO", "")
+	envMinDiskMB             = settings.New("PKG_CONFIG_MIN_DISK_MB", "")
+	envNoGit                 = settings.New("PKG_CONFIG_NO_GIT", "")
+	envOffline               = settings.New("PKG_CONFIG_OFFLINE", "")
+	envOmitSystemLibs        = settings.New("PKG_CONFIG_OMIT_SYSTEM_LIBS", "")
+	envPanic                 = settings.New("PKG_CONFIG_PANIC", "")
+	envPostBuildHook         = settings.New("PKG_CONFIG_POST_BUILD_HOOK", "")
+	envRepairModcache        = settings.New("PKG_CONFIG_REPAIR_MODCACHE", "")
+	envRequireTagged         = settings.New("PKG_CONFIG_REQUIRE_TAGGED", "")
+	envRustc                 = settings.New("RUSTC", "rustc")
+	envStrictABI             = settings.New("PKG_CONFIG_STRICT_ABI", "")
+	envStrip                 = settings.New("PKG_CONFIG_STRIP", "")
+	envStripCmd              = settings.New("PKG_CONFIG_STRIP_CMD", "")
+	envSysroot               = settings.New("PKG_CONFIG_SYSROOT", "")
+	envSystemFluxPrefix      = settings.New("PKG_CONFIG_SYSTEM_FLUX_PREFIX", "/usr")
+	envTargetCPU             = settings.New("PKG_CONFIG_TARGET_CPU", "")
+	envTargetFile            = settings.New("PKG_CONFIG_TARGET_FILE", "")
+	envVerifySum             = settings.New("PKG_CONFIG_VERIFY_SUM", "")
+	envVersionBump           = settings.New("PKG_CONFIG_VERSION_BUMP", "")
+	envWindowsABI            = settings.New("PKG_CONFIG_WINDOWS_ABI", "")
+)
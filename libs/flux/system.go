@@ -0,0 +1,115 @@
+package flux
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// SystemLibrary is a flux library that was installed
+// into a system location rather than built from source.
+type SystemLibrary struct {
+	Prefix  string
+	Version string
+	Target  Target
+
+	// The flags added to the package config are
+	// the same as for a Library built from source.
+	ExtraLibs        []string
+	ExtraIncludeDirs []string
+	Defines          []string
+	HeadersOnly      bool
+	OmitSystemLibs   bool
+}
+
+// ConfigureSystem configures the flux library installed under the
+// prefix from PKG_CONFIG_SYSTEM_FLUX_PREFIX, which defaults to /usr.
+// The library is expected at lib/libflux.a and the headers at
+// include/influxdata/flux.h under the prefix. The version is read from
+// share/flux/VERSION. An error is returned when the installation
+// is incomplete or the target is not the host, since the system
+// library is built for the host, so flux can be built from source instead.
+func ConfigureSystem(logger *zap.Logger, opts Options) (*SystemLibrary, error) {
+	prefix := envSystemFluxPrefix.Get()
+
+	target, err := configureTarget(opts)
+	if err != nil {
+		return nil, err
+	}
+	if !target.isHost() {
+		return nil, fmt.Errorf("system flux is built for the host and cannot be used for the target %s", target)
+	}
+
+	var required []string
+	if !opts.HeadersOnly {
+		required = append(required, filepath.Join(prefix, "lib", libraryFilename(target.cargoTarget(), "flux")))
+	}
+	required = append(required, filepath.Join(prefix, "include", "influxdata", "flux.h"))
+	for _, path := range required {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("system flux installation is incomplete: %w", err)
+		}
+	}
+
+	version := "v0.0.0"
+	if data, err := ioutil.ReadFile(filepath.Join(prefix, "share", "flux", "VERSION")); err != nil {
+		logger.Info("Could not determine the version of the system flux. Using the default.", zap.Error(err))
+	} else if version, err = parseFileVersion(strings.TrimSpace(string(data))); err != nil {
+		return nil, err
+	}
+
+	extraLibs, err := getExtraLibs(logger)
+	if err != nil {
+		return nil, err
+	}
+	includeDirs, err := getExtraIncludeDirs(logger)
+	if err != nil {
+		return nil, err
+	}
+	defines, err := getDefines(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Using system flux", zap.String("prefix", prefix), zap.String("version", version))
+	return &SystemLibrary{
+		Prefix:           prefix,
+		Version:          version,
+		Target:           target,
+		ExtraLibs:        extraLibs,
+		ExtraIncludeDirs: includeDirs,
+		Defines:          defines,
+		HeadersOnly:      opts.HeadersOnly,
+		OmitSystemLibs:   envOmitSystemLibs.Get() == "1",
+	}, nil
+}
+
+// Install does nothing since the library is already installed.
+func (l *SystemLibrary) Install(ctx context.Context, logger *zap.Logger) (string, error) {
+	return "", nil
+}
+
+// WritePackageConfig writes the package config
+// that refers to the system locations.
+func (l *SystemLibrary) WritePackageConfig(w io.Writer, buildid string) error {
+	fields := map[string]string{
+		"Name":        "Flux",
+		"Version":     strings.TrimPrefix(l.Version, "v"),
+		"Description": "Library for the InfluxData Flux engine",
+		"Cflags":      pcCflags(nil, l.ExtraIncludeDirs, l.Defines),
+	}
+	if !l.HeadersOnly {
+		fields["Libs"] = pcLibs(l.Target, "flux", nil, l.OmitSystemLibs, l.ExtraLibs)
+	}
+	return writePcFile(w, []string{
+		"prefix=" + pcPath(l.Prefix),
+		"libdir=${prefix}" + pcSep + "lib",
+		"includedir=${prefix}" + pcSep + "include",
+	}, fields)
+}
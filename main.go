@@ -3,14 +3,25 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 
+	"github.com/influxdata/pkg-config/internal/logutil"
+	"github.com/influxdata/pkg-config/internal/modload"
+	"github.com/influxdata/pkg-config/internal/settings"
 	"github.com/influxdata/pkg-config/libs/flux"
 	"github.com/spf13/pflag"
 	"go.uber.org/zap"
@@ -40,7 +51,7 @@ func getArg0Path() string {
 	// variable and assume that we are them.
 	// If we are wrong, it will get sorted out on the next call
 	// to this executable.
-	if pkgconfig := os.Getenv("PKG_CONFIG"); pkgconfig != "" {
+	if pkgconfig := envPkgConfig.Get(); pkgconfig != "" {
 		// This gets unset in modifyPath.
 		return pkgconfig
 	}
@@ -58,183 +69,1370 @@ func getArg0Path() string {
 }
 
 func modifyPath(arg0path string) error {
-	if pkgconfig := os.Getenv("PKG_CONFIG"); pkgconfig == arg0path {
+	if pkgconfig := envPkgConfig.Get(); pkgconfig == arg0path {
 		return os.Unsetenv("PKG_CONFIG")
 	}
+
+	// Resolve the currently executing executable so entries that refer
+	// to it through a different path, such as a symlink, are recognized.
+	// When it cannot be resolved, such as a dangling symlink, only the
+	// entries that name it by the same path are recognized.
+	arg0, _ := filepath.Abs(arg0path)
+	arg0info, err := os.Stat(arg0)
+	if err != nil {
+		logger.Info("Unable to resolve the pkg-config executable, comparing paths lexically", zap.String("path", arg0), zap.Error(err))
+	}
+
+	// Remove each entry on the path that contains the currently executing
+	// executable so we do not find ourselves. Other entries are kept in
+	// their original order so a pkg-config that is between two entries for
+	// this executable is still found.
 	path := os.Getenv("PATH")
 	list := filepath.SplitList(path)
-	// Search the path to see if the currently executing executable
-	// is on the path. We will only select pkg-config implementations that
-	// are in the list after our current one.
-	// We work backwards so we can find the last entry for the executable in case
-	// the same path is on the path twice.
-	for i, dir := range list {
+	keep := list[:0]
+	for _, entry := range list {
+		dir := entry
 		if dir == "" {
 			// Unix shell semantics: path element "" means "."
 			dir = "."
 		}
 
 		dir, _ = filepath.Abs(dir)
-		path := filepath.Join(dir, pkgConfigExecName)
-		if arg0path == path {
-			// Modify the list to exclude the current element and break out of the loop.
-			if i < len(list)-1 {
-				copy(list[i:], list[i+1:])
-			}
-			list = list[:len(list)-1]
+		if isSameExecutable(filepath.Join(dir, pkgConfigExecName), arg0, arg0info) {
+			continue
 		}
+		keep = append(keep, entry)
 	}
-	path = strings.Join(list, string(filepath.ListSeparator))
+	path = strings.Join(keep, string(filepath.ListSeparator))
 	return os.Setenv("PATH", path)
 }
 
+// isSameExecutable reports whether path refers to the executable at arg0.
+// The files are compared when arg0 exists so links to it are detected.
+func isSameExecutable(path, arg0 string, arg0info os.FileInfo) bool {
+	if path == arg0 {
+		return true
+	}
+	if arg0info == nil {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && os.SameFile(info, arg0info)
+}
+
 var (
 	logger *zap.Logger
-	stderr bytes.Buffer
+
+	// stderr holds the most recent console output
+	// so it can be written after a failure.
+	stderr = tailBuffer{limit: defaultLogBufferSize}
+
+	// warnings collects the warnings logged during a run.
+	warnings *warningCollector
+
+	// stdin and stdout are forwarded to the real pkg-config.
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
 )
 
-func configureLogger(logger **zap.Logger) error {
-	cores := make([]zapcore.Core, 0, 2)
-	cores = append(cores, zapcore.NewCore(
-		zapcore.NewConsoleEncoder(zapcore.EncoderConfig{
+// quiet reports whether PKG_CONFIG_QUIET is set. In quiet mode, only
+// errors are logged to the console and a failure is reported with a
+// single line.
+func quiet() bool {
+	return envQuiet.Get() == "1"
+}
+
+func configureLogger(logger **zap.Logger) {
+	consoleLevel := zap.InfoLevel
+	if quiet() {
+		consoleLevel = zap.ErrorLevel
+	}
+
+	bufferSize, bufferErr := logBufferSize()
+	stderr.SetLimit(bufferSize)
+
+	warnings = &warningCollector{}
+	cores := make([]zapcore.Core, 0, 5)
+	cores = append(cores, warnings)
+	cores = append(cores, &consoleCore{
+		LevelEnabler: consoleLevel,
+		enc: zapcore.NewConsoleEncoder(zapcore.EncoderConfig{
 			MessageKey: "msg",
 		}),
-		zapcore.AddSync(&stderr),
-		zap.InfoLevel,
-	))
-	if logPath := os.Getenv("PKG_CONFIG_LOG"); logPath != "" {
-		f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		buf: &stderr,
+	})
+
+	var logErr error
+	if logPath := envLog.Get(); logPath != "" {
+		logPath = expandPath(logPath)
+		core, err := newLogFileCore(logPath)
 		if err != nil {
-			return err
+			logErr = err
+		} else {
+			cores = append(cores, core)
+		}
+	}
+
+	if envGHAAnnotations.Get() == "1" {
+		cores = append(cores, newAnnotationCore(annotationOutput))
+	}
+
+	var syslogErr error
+	if addr := envLogSyslog.Get(); addr != "" {
+		core, err := newSyslogCore(addr)
+		if err != nil {
+			syslogErr = err
+		} else {
+			cores = append(cores, core)
 		}
-		cores = append(cores, zapcore.NewCore(
-			zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
-			f,
-			zap.InfoLevel,
-		))
 	}
 	*logger = zap.New(zapcore.NewTee(cores...))
+
+	// Failing to open the log file should not prevent pkg-config
+	// from running so only report it.
+	if logErr != nil {
+		(*logger).Warn("Unable to open PKG_CONFIG_LOG file, logging to stderr only", zap.Error(logErr))
+	}
+	if syslogErr != nil {
+		(*logger).Warn("Unable to connect to syslog for PKG_CONFIG_LOG_SYSLOG", zap.Error(syslogErr))
+	}
+	if bufferErr != nil {
+		(*logger).Warn("Invalid PKG_CONFIG_LOG_BUFFER_KB, using the default", zap.Error(bufferErr))
+	}
+}
+
+// defaultLogBufferSize is the amount of console output
+// that is retained for reporting a failure.
+const defaultLogBufferSize = 256 * 1024
+
+// logBufferSize reads the amount of console output to retain
+// from PKG_CONFIG_LOG_BUFFER_KB.
+func logBufferSize() (int, error) {
+	v := envLogBufferKB.Get()
+	kb, err := strconv.Atoi(v)
+	if err != nil || kb <= 0 {
+		return defaultLogBufferSize, fmt.Errorf("invalid value %q", v)
+	}
+	return kb * 1024, nil
+}
+
+// newLogFileCore creates the core that writes JSON log records
+// to the log file at the given path. The log file may be shared by
+// many pkg-config processes running in parallel. The core encodes
+// each record in full before writing it with a single write and the
+// file is opened with O_APPEND so records are not interleaved.
+func newLogFileCore(path string) (zapcore.Core, error) {
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		f,
+		zap.InfoLevel,
+	), nil
+}
+
+// tailBuffer retains the most recent log records written to it
+// up to its limit in bytes. Records written directly to the buffer
+// are treated as info records.
+type tailBuffer struct {
+	mu      sync.Mutex
+	records []logRecord
+	size    int
+	limit   int
+}
+
+// logRecord is an encoded log record with the level it was logged at.
+type logRecord struct {
+	level zapcore.Level
+	text  string
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.writeRecord(zapcore.InfoLevel, string(p))
+	return len(p), nil
+}
+
+func (b *tailBuffer) writeRecord(level zapcore.Level, text string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records = append(b.records, logRecord{level: level, text: text})
+	b.size += len(text)
+
+	// The most recent record is always retained.
+	for b.size > b.limit && len(b.records) > 1 {
+		b.size -= len(b.records[0].text)
+		b.records = b.records[1:]
+	}
+}
+
+// SetLimit sets the number of bytes the buffer retains.
+func (b *tailBuffer) SetLimit(limit int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var sb strings.Builder
+	for _, r := range b.records {
+		sb.WriteString(r.text)
+	}
+	return sb.String()
+}
+
+// FailureOutput returns the records that explain a failure. These are
+// the warnings and errors along with the last infoTail records logged
+// below the warning level, in the order they were logged.
+func (b *tailBuffer) FailureOutput(infoTail int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	info := 0
+	for _, r := range b.records {
+		if r.level < zapcore.WarnLevel {
+			info++
+		}
+	}
+
+	var sb strings.Builder
+	if omitted := info - infoTail; omitted > 0 {
+		_, _ = fmt.Fprintf(&sb, "(%d earlier log lines omitted)\n", omitted)
+	}
+	for _, r := range b.records {
+		if r.level < zapcore.WarnLevel {
+			if info > infoTail {
+				info--
+				continue
+			}
+		}
+		sb.WriteString(r.text)
+	}
+	return sb.String()
+}
+
+func (b *tailBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.records = nil
+	b.size = 0
+}
+
+// consoleCore encodes log records for the console
+// and writes them to the buffer with their level.
+type consoleCore struct {
+	zapcore.LevelEnabler
+	enc zapcore.Encoder
+	buf *tailBuffer
+}
+
+func (c *consoleCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	return &consoleCore{LevelEnabler: c.LevelEnabler, enc: enc, buf: c.buf}
+}
+
+func (c *consoleCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *consoleCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	c.buf.writeRecord(ent.Level, buf.String())
+	buf.Free()
 	return nil
 }
 
+func (c *consoleCore) Sync() error {
+	return nil
+}
+
+// annotationOutput is where the workflow commands for
+// PKG_CONFIG_GHA_ANNOTATIONS are written. This can be replaced for testing.
+var annotationOutput io.Writer = os.Stderr
+
+// annotationCore writes warnings and errors as GitHub Actions
+// workflow commands so they are shown as annotations on the workflow
+// run. The commands are written as they are logged rather than
+// buffered with the console output so they are seen even on success.
+type annotationCore struct {
+	zapcore.LevelEnabler
+	enc zapcore.Encoder
+	w   io.Writer
+}
+
+func newAnnotationCore(w io.Writer) *annotationCore {
+	return &annotationCore{
+		LevelEnabler: zap.WarnLevel,
+		enc: zapcore.NewConsoleEncoder(zapcore.EncoderConfig{
+			MessageKey: "msg",
+		}),
+		w: w,
+	}
+}
+
+func (c *annotationCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	return &annotationCore{LevelEnabler: c.LevelEnabler, enc: enc, w: c.w}
+}
+
+func (c *annotationCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *annotationCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+
+	command := "error"
+	if ent.Level == zapcore.WarnLevel {
+		command = "warning"
+	}
+	_, err = fmt.Fprintf(c.w, "::%s title=pkg-config::%s\n", command, escapeAnnotation(strings.TrimRight(buf.String(), "\n")))
+	return err
+}
+
+func (c *annotationCore) Sync() error {
+	return nil
+}
+
+// escapeAnnotation escapes the characters that have
+// a special meaning in the data of a workflow command.
+func escapeAnnotation(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// warningCollector is a core that records the message of each warning
+// so they can be summarized at the end of a run.
+type warningCollector struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (c *warningCollector) Enabled(level zapcore.Level) bool {
+	return level == zapcore.WarnLevel
+}
+
+func (c *warningCollector) With([]zapcore.Field) zapcore.Core {
+	return c
+}
+
+func (c *warningCollector) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *warningCollector) Write(ent zapcore.Entry, _ []zapcore.Field) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, ent.Message)
+	return nil
+}
+
+func (c *warningCollector) Sync() error {
+	return nil
+}
+
+// Summary returns a single line listing the distinct warnings
+// in the order they were first logged.
+func (c *warningCollector) Summary() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.messages) == 0 {
+		return ""
+	}
+
+	seen := make(map[string]bool, len(c.messages))
+	unique := make([]string, 0, len(c.messages))
+	for _, msg := range c.messages {
+		if !seen[msg] {
+			seen[msg] = true
+			unique = append(unique, strings.TrimSuffix(msg, "."))
+		}
+	}
+	noun := "warnings"
+	if len(c.messages) == 1 {
+		noun = "warning"
+	}
+	return fmt.Sprintf("%d %s: %s", len(c.messages), noun, strings.Join(unique, "; "))
+}
+
+// summaryOutput is where the summary of the warnings is written at
+// the end of a run. This can be replaced for testing.
+var summaryOutput io.Writer = os.Stderr
+
+// writeWarningSummary writes the summary of the warnings that were
+// logged during the run. It is written directly rather than logged so
+// it is seen even when the log output is buffered or sent elsewhere.
+func writeWarningSummary(w io.Writer) {
+	if summary := warnings.Summary(); summary != "" {
+		_, _ = fmt.Fprintf(w, "pkg-config completed with %s\n", summary)
+	}
+}
+
+// dialSyslog connects to syslog using the network and address.
+// An empty network connects to the local syslog daemon.
+// This can be replaced for testing.
+var dialSyslog = dialSyslogWriter
+
+// newSyslogCore creates the core that writes JSON log records to syslog.
+// The address is either 1 for the local syslog daemon or a network
+// address in the form network://address, such as udp://localhost:514.
+func newSyslogCore(addr string) (zapcore.Core, error) {
+	var network, raddr string
+	if addr != "1" {
+		parts := strings.SplitN(addr, "://", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid syslog address %q: expected 1 or network://address", addr)
+		}
+		network, raddr = parts[0], parts[1]
+	}
+
+	w, err := dialSyslog(network, raddr, filepath.Base(os.Args[0]))
+	if err != nil {
+		return nil, err
+	}
+	return zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(w),
+		zap.InfoLevel,
+	), nil
+}
+
+// openLogFile opens the log file for appending and creates
+// the parent directory if it does not exist.
+func openLogFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// expandPath expands a leading ~ to the home directory
+// and any environment variables within the path.
+func expandPath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, "~"+string(os.PathSeparator)) {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = home + path[1:]
+		}
+	}
+	return filepath.Clean(os.ExpandEnv(path))
+}
+
 type Flags struct {
-	Cflags     bool
-	Libs       bool
-	Static     bool
-	ModVersion string
+	Cflags             bool
+	Libs               bool
+	Static             bool
+	Uninstalled        bool
+	ModVersion         string
+	MaxVersion         string
+	PrintFluxDir       bool
+	NeedsBuild         bool
+	PrintIncludeDir    bool
+	ListTargets        bool
+	PrintPkgConfigPath bool
+	PrintWrapperConfig bool
+	Print0             bool
+	OutputSeparator    string
+	Format             string
+	Provenance         string
+	InstallPrefix      string
+	ArchTag            string
+	PcOutdir           string
+	WriteLock          string
+	VerifyLock         string
+	ShowPc             bool
+	NoBuild            bool
+	CheckPrereqs       bool
+	SelfCheck          bool
+	PackageNames       map[string]string
+	PcPaths            []string
+	Compare            []string
+	Target             *flux.Target
+
+	// Order is the order the flags forwarded to pkg-config
+	// were given on the command line.
+	Order []string
+
+	// KeepGoing continues building the remaining
+	// libraries when one of them fails.
+	KeepGoing bool
+
+	// Passthrough are the flags that are not known to us
+	// and are passed through to pkg-config unchanged.
+	Passthrough []string
+
+	// flagSet is the flag set the flags were parsed with.
+	flagSet *pflag.FlagSet
 }
 
+// forwardedFlags are the flags that are passed through to pkg-config.
+// This is the order they are passed when the original order is unknown.
+var forwardedFlags = []string{"cflags", "libs", "static", "uninstalled", "max-version"}
+
 func parseFlags(name string, args []string) ([]string, Flags, error) {
 	var flags Flags
 	flagSet := pflag.NewFlagSet(name, pflag.ContinueOnError)
 	flagSet.BoolVar(&flags.Cflags, "cflags", false, "output all pre-processor and compiler flags")
 	flagSet.BoolVar(&flags.Libs, "libs", false, "output all linker flags")
 	flagSet.BoolVar(&flags.Static, "static", false, "output linker flags for static linking")
+	flagSet.BoolVar(&flags.Uninstalled, "uninstalled", false, "check whether uninstalled packages will be used")
 	flagSet.StringVar(&flags.ModVersion, "modversion", "", "output version for package")
-	if err := flagSet.Parse(args); err != nil {
+	flagSet.StringVar(&flags.MaxVersion, "max-version", "", "require given version of package at most")
+	flagSet.BoolVar(&flags.PrintFluxDir, "print-flux-dir", false, "output the flux source directory without building")
+	flagSet.BoolVar(&flags.NeedsBuild, "needs-build", false, "output whether flux needs to be built and exit with 0 when it is up to date or 1 when it needs to be built")
+	flagSet.BoolVar(&flags.PrintIncludeDir, "print-includedir", false, "output the include directory for package")
+	flagSet.BoolVar(&flags.ListTargets, "list-targets", false, "output the supported targets and their cargo target triples")
+	flagSet.BoolVar(&flags.PrintPkgConfigPath, "print-pkg-config-path", false, "output the PKG_CONFIG_PATH used to invoke pkg-config")
+	flagSet.BoolVar(&flags.PrintWrapperConfig, "print-wrapper-config", false, "output every setting used by the wrapper and where it came from")
+	flagSet.BoolVar(&flags.Print0, "print0", false, "output each flag terminated by a nul character instead of separated by spaces")
+	flagSet.StringVar(&flags.OutputSeparator, "output-separator", "", "output the flags joined by the separator instead of spaces")
+	flagSet.StringVar(&flags.Format, "format", "", "output the cflags and libs rendered with the go template, such as '{{.Cflags}} {{.Libs}}'")
+	flagSet.StringVar(&flags.Provenance, "provenance", "", "write the provenance of the built libraries to the file")
+	flagSet.StringVar(&flags.InstallPrefix, "install-prefix", "", "write the package config output by --show-pc and --pc-outdir for flux installed under this prefix, with the library in lib and the headers in include")
+	flagSet.StringVar(&flags.ArchTag, "arch-tag", "", "install the library to a directory with this name instead of the target, such as x86_64-linux-gnu")
+	flagSet.StringVar(&flags.PcOutdir, "pc-outdir", "", "also write the package configs to a subdirectory of the directory named for the target")
+	flagSet.StringVar(&flags.WriteLock, "write-lock", "", "write the resolved build inputs of the libraries to the lock file")
+	flagSet.StringVar(&flags.VerifyLock, "verify-lock", "", "fail if the resolved build inputs differ from the lock file")
+	flagSet.BoolVarP(&flags.KeepGoing, "keep-going", "k", false, "continue building the remaining libraries when one fails")
+	flagSet.BoolVar(&flags.ShowPc, "show-pc", false, "output the generated package config instead of running pkg-config")
+	flagSet.BoolVar(&flags.NoBuild, "no-build", false, "skip building the library when used with --show-pc")
+	flagSet.BoolVar(&flags.SelfCheck, "selfcheck", false, "output a JSON report of the tools and environment without building")
+	flagSet.BoolVar(&flags.CheckPrereqs, "check-prereqs", false, "check that the tools needed to build the libraries are installed")
+	flagSet.StringToStringVar(&flags.PackageNames, "package-name", nil, "generate the package config for a library with a different package name, such as flux=flux-dev")
+	flagSet.StringArrayVar(&flags.PcPaths, "with-pc-path", nil, "search the directory for package configs after the generated ones (repeatable)")
+	flagSet.StringSliceVar(&flags.Compare, "compare", nil, "build two flux versions as the flux-a and flux-b packages")
+	target := flagSet.String("target", "", "build for the target os/arch[/arm][/static] instead of the go environment")
+	rustTarget := flagSet.String("rust-target", "", "build for the cargo target triple instead of the go environment")
+	args, flags.Passthrough = splitUnknownFlags(flagSet, args)
+	if err := flagSet.ParseAll(args, func(flag *pflag.Flag, value string) error {
+		if err := flagSet.Set(flag.Name, value); err != nil {
+			return err
+		}
+		for _, name := range forwardedFlags {
+			if flag.Name == name && !containsString(flags.Order, name) {
+				flags.Order = append(flags.Order, name)
+			}
+		}
+		return nil
+	}); err != nil {
 		return nil, flags, err
 	}
-	return flagSet.Args(), flags, nil
+	flags.flagSet = flagSet
+	if flags.Print0 && flags.OutputSeparator != "" {
+		return nil, flags, fmt.Errorf("--print0 and --output-separator cannot be used together")
+	}
+	if flags.Format != "" && (flags.Print0 || flags.OutputSeparator != "" || flags.ModVersion != "" || flags.PrintIncludeDir) {
+		return nil, flags, fmt.Errorf("--format cannot be used with --print0, --output-separator, --modversion or --print-includedir")
+	}
+	if flags.NoBuild && !flags.ShowPc {
+		return nil, flags, fmt.Errorf("--no-build can only be used with --show-pc")
+	}
+	if flags.Compare != nil && len(flags.Compare) != 2 {
+		return nil, flags, fmt.Errorf("--compare requires exactly two versions, got %d", len(flags.Compare))
+	}
+	if *target != "" && *rustTarget != "" {
+		return nil, flags, fmt.Errorf("--target and --rust-target cannot be used together")
+	}
+	if *target != "" {
+		t, err := flux.ParseTarget(*target)
+		if err != nil {
+			return nil, flags, err
+		}
+		flags.Target = &t
+	} else if *rustTarget != "" {
+		t := flux.TargetFromTriple(*rustTarget)
+		flags.Target = &t
+	}
+	return flagSet.Args(), flags, nil
+}
+
+// splitUnknownFlags removes the long flags that are not defined in the
+// flag set from the arguments so they can be passed through to pkg-config.
+// This allows flags specific to the pkg-config implementation, such as
+// --maximum-traverse-depth for pkgconf, and --help for the real pkg-config. Whether an unknown flag takes a
+// value cannot be determined so the value must be given with an equals sign.
+func splitUnknownFlags(flagSet *pflag.FlagSet, args []string) (rest, unknown []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		} else if !strings.HasPrefix(arg, "--") {
+			rest = append(rest, arg)
+			continue
+		}
+
+		name := strings.SplitN(arg[2:], "=", 2)[0]
+		flag := flagSet.Lookup(name)
+		if flag == nil {
+			unknown = append(unknown, arg)
+			// The value of an unknown flag given as the next
+			// argument would otherwise be taken as a library.
+			if containsString(pkgConfigValueFlags, name) && !strings.Contains(arg, "=") && i+1 < len(args) {
+				i++
+				unknown = append(unknown, args[i])
+			}
+			continue
+		}
+		rest = append(rest, arg)
+
+		// Keep the value of a known flag with the flag
+		// so it is not mistaken for an unknown flag.
+		if flag != nil && flag.NoOptDefVal == "" && !strings.Contains(arg, "=") && i+1 < len(args) {
+			i++
+			rest = append(rest, args[i])
+		}
+	}
+	return rest, unknown
+}
+
+// pkgConfigValueFlags are the flags of pkg-config and pkgconf that
+// take a value. These are not defined by us so the value must be kept
+// with the flag when it is passed through.
+var pkgConfigValueFlags = []string{
+	"atleast-pkgconfig-version",
+	"atleast-version",
+	"define-variable",
+	"env",
+	"exact-version",
+	"fragment-filter",
+	"log-file",
+	"maximum-traverse-depth",
+	"prefix-variable",
+	"relocate",
+	"variable",
+	"with-path",
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// composePkgConfigPath constructs the PKG_CONFIG_PATH used to invoke
+// the real pkg-config. The directory with our generated pkgconfig files
+// is first, followed by the directories from --with-pc-path in the order
+// they were given, and then the existing PKG_CONFIG_PATH entries. If
+// PKG_CONFIG_APPEND_PATH is set, the existing entries are first instead.
+func composePkgConfigPath(pkgConfigPath string, pcPaths []string) string {
+	var paths []string
+	if pkgConfigPath != "" {
+		paths = append(paths, pkgConfigPath)
+	}
+	paths = append(paths, pcPaths...)
+	if pathEnv := envPath.Get(); pathEnv != "" {
+		if envAppendPath.Get() == "1" {
+			paths = append([]string{pathEnv}, paths...)
+		} else {
+			paths = append(paths, pathEnv)
+		}
+	}
+	return strings.Join(paths, string(os.PathListSeparator))
+}
+
+// pkgConfigEnv constructs the environment for invoking the real
+// pkg-config. PKG_CONFIG_LIBDIR replaces the default search path of
+// pkg-config, so when it is set the directory with our generated
+// pkgconfig files is also prepended to it. This keeps the generated
+// files first for implementations that only consult PKG_CONFIG_LIBDIR.
+func pkgConfigEnv(pkgConfigPath string, pcPaths []string) []string {
+	env := append(os.Environ(), fmt.Sprintf("PKG_CONFIG_PATH=%s", composePkgConfigPath(pkgConfigPath, pcPaths)))
+	if libdir, ok := envLibdir.Lookup(); ok {
+		libdirs := pkgConfigPath
+		if libdir != "" {
+			libdirs += string(os.PathListSeparator) + libdir
+		}
+		env = append(env, fmt.Sprintf("PKG_CONFIG_LIBDIR=%s", libdirs))
+	}
+	return env
+}
+
+// printPkgConfigPath writes the PKG_CONFIG_PATH that would be
+// used to invoke the real pkg-config.
+func printPkgConfigPath(w io.Writer, pkgConfigPath string, pcPaths []string) {
+	_, _ = fmt.Fprintln(w, composePkgConfigPath(pkgConfigPath, pcPaths))
+}
+
+// packageName returns the name of the package config generated for the
+// library. This is the library name unless it was renamed with --package-name.
+func packageName(lib string, flags Flags) string {
+	if name, ok := flags.PackageNames[lib]; ok && name != "" {
+		return name
+	}
+	return lib
+}
+
+func runPkgConfig(execCmd, pkgConfigPath string, libs []string, flags Flags) error {
+	args := make([]string, 0, len(libs)+len(flags.Passthrough)+5)
+	args = append(args, flags.Passthrough...)
+
+	// Query pkg-config for the package names the configs were generated with.
+	names := make([]string, len(libs))
+	for i, lib := range libs {
+		names[i] = packageName(lib, flags)
+	}
+	libs = names
+
+	if flags.Format != "" {
+		return formatPkgConfig(execCmd, pkgConfigPath, args, libs, flags)
+	}
+
+	// The modversion flag will report the versions of a comma separated list of
+	// package names, making it mutually exclusive to the various linking flags.
+	if len(flags.ModVersion) > 0 {
+		modVersion := strings.Split(flags.ModVersion, ",")
+		for i, lib := range modVersion {
+			modVersion[i] = packageName(lib, flags)
+		}
+		args = append(args, "--modversion")
+		args = append(args, strings.Join(modVersion, ","))
+	} else if flags.PrintIncludeDir {
+		// The include directory is printed as the bare path
+		// so it can be consumed by build systems that do not
+		// understand compiler flags.
+		args = append(args, "--variable=includedir", "--")
+		args = append(args, libs...)
+	} else {
+		args = append(args, forwardedArgs(flags)...)
+		args = append(args, "--")
+		args = append(args, libs...)
+	}
+
+	cmd := exec.Command(execCmd, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = pkgConfigEnv(pkgConfigPath, flags.PcPaths)
+	if !flags.Print0 && flags.OutputSeparator == "" {
+		return cmd.Run()
+	}
+
+	// Capture the output so the flags can be written
+	// with the requested separator.
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	fields := splitPkgConfigOutput(out.String())
+	if flags.Print0 {
+		for _, field := range fields {
+			_, _ = io.WriteString(stdout, field+"\x00")
+		}
+	} else if len(fields) > 0 {
+		_, _ = fmt.Fprintln(stdout, strings.Join(fields, flags.OutputSeparator))
+	}
+	return err
+}
+
+// forwardedArgs returns the arguments for the flags that are forwarded
+// to pkg-config. The flags are in the order they were given since some
+// consumers depend on the order of the output.
+func forwardedArgs(flags Flags) []string {
+	order := flags.Order
+	if order == nil {
+		order = forwardedFlags
+	}
+	var args []string
+	for _, name := range order {
+		switch name {
+		case "cflags":
+			if flags.Cflags {
+				args = append(args, "--cflags")
+			}
+		case "libs":
+			if flags.Libs {
+				args = append(args, "--libs")
+			}
+		case "static":
+			if flags.Static {
+				args = append(args, "--static")
+			}
+		case "uninstalled":
+			if flags.Uninstalled {
+				args = append(args, "--uninstalled")
+			}
+		case "max-version":
+			if flags.MaxVersion != "" {
+				args = append(args, "--max-version="+flags.MaxVersion)
+			}
+		}
+	}
+	return args
+}
+
+// formatData is the data the --format template is rendered with.
+type formatData struct {
+	Cflags string
+	Libs   string
+}
+
+// formatPkgConfig queries pkg-config for the cflags and the libs
+// separately and writes them rendered with the --format template.
+func formatPkgConfig(execCmd, pkgConfigPath string, args, libs []string, flags Flags) error {
+	tmpl, err := template.New("format").Parse(flags.Format)
+	if err != nil {
+		return fmt.Errorf("invalid --format template: %w", err)
+	}
+	// The cflags and libs are queried separately so only
+	// the flags that modify the queries are forwarded.
+	modifiers := flags
+	modifiers.Cflags, modifiers.Libs = false, false
+	args = append(args, forwardedArgs(modifiers)...)
+
+	query := func(flag string) (string, error) {
+		cmdArgs := append(append([]string(nil), args...), flag, "--")
+		cmd := exec.Command(execCmd, append(cmdArgs, libs...)...)
+		cmd.Stdin = stdin
+		cmd.Stderr = os.Stderr
+		cmd.Env = pkgConfigEnv(pkgConfigPath, flags.PcPaths)
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+
+	var data formatData
+	if data.Cflags, err = query("--cflags"); err != nil {
+		return err
+	}
+	if data.Libs, err = query("--libs"); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("could not render --format template: %w", err)
+	}
+	_, _ = fmt.Fprintln(stdout, buf.String())
+	return nil
+}
+
+// splitPkgConfigOutput splits the output of pkg-config into the individual
+// flags. Whitespace that pkg-config escaped with a backslash is part of the
+// flag and the escape is removed.
+func splitPkgConfigOutput(s string) []string {
+	var (
+		fields []string
+		field  strings.Builder
+		inside bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s) && (s[i+1] == ' ' || s[i+1] == '\t' || s[i+1] == '\\'):
+			i++
+			field.WriteByte(s[i])
+			inside = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inside {
+				fields = append(fields, field.String())
+				field.Reset()
+				inside = false
+			}
+		default:
+			field.WriteByte(c)
+			inside = true
+		}
+	}
+	if inside {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// selfTest runs pkg-config against the generated package config for
+// the library to verify it can be parsed and reports the flags.
+// This catches a malformed package config when it is generated
+// instead of when the consumer tries to use the flags.
+func selfTest(execCmd, pkgConfigPath string, pcPaths []string, lib string) error {
+	var out, errOut bytes.Buffer
+	cmd := exec.Command(execCmd, "--cflags", "--libs", "--", lib)
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+	cmd.Env = pkgConfigEnv(pkgConfigPath, pcPaths)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pkg-config could not parse the generated package config: %w: %s", err, strings.TrimSpace(errOut.String()))
+	}
+
+	flags := strings.TrimSpace(out.String())
+	if flags == "" {
+		return fmt.Errorf("pkg-config returned empty flags for the generated package config")
+	}
+	logger.Info("Self-test of generated package config passed", zap.String("name", lib), zap.String("flags", flags))
+	return nil
+}
+
+func getLibraryFor(ctx context.Context, name string, flags Flags) (Library, bool, error) {
+	switch name {
+	case "flux":
+		// Use the flux installed on the system instead
+		// of building it when it is complete.
+		if envUseSystemFlux.Get() == "1" {
+			l, err := flux.ConfigureSystem(logger, fluxOptions(flags))
+			if err == nil {
+				return l, true, nil
+			}
+			logger.Info("Unable to use system flux, building from source", zap.Error(err))
+		}
+		l, err := flux.Configure(ctx, logger, fluxOptions(flags))
+		if err != nil {
+			return nil, true, err
+		}
+		return l, true, nil
+	case "flux-a", "flux-b":
+		// These are only known when comparing two versions of flux.
+		if len(flags.Compare) != 2 {
+			return nil, false, nil
+		}
+		version := flags.Compare[0]
+		if name == "flux-b" {
+			version = flags.Compare[1]
+		}
+		// Each version is installed to its own libdir so
+		// the package configs do not link the same library.
+		opts := fluxOptions(flags)
+		opts.Variant = name
+		l, err := flux.ConfigureVersion(ctx, logger, opts, version)
+		if err != nil {
+			return nil, true, err
+		}
+		return l, true, nil
+	}
+
+	// Libraries that are not built in may be built by a provider
+	// found on the PATH when providers have been enabled.
+	if envLibraryProviders.Get() != "1" {
+		return nil, false, nil
+	}
+	if l, ok := lookupProvider(name, flags); ok {
+		return l, true, nil
+	}
+	return nil, false, nil
+}
+
+// providerPrefix is the prefix of the name of the executables
+// that provide the libraries that are not built in.
+const providerPrefix = "pkg-config-lib-"
+
+// providerLibrary is a library that is built by an external provider.
+// The provider for a library is the executable named pkg-config-lib-<name>
+// on the PATH. Providers are only looked up when PKG_CONFIG_LIBRARY_PROVIDERS
+// is set to 1 so nothing on the PATH is run unless it was asked for.
+//
+// The provider is run with the operation as its only argument and a
+// providerRequest encoded as JSON on stdin. It writes a providerResponse
+// encoded as JSON to stdout and exits with a nonzero status on failure.
+// Anything written to stderr is logged. The operations are:
+//
+//	install         build and install the library and set buildid
+//	package-config  set package_config to the contents of the package config
+type providerLibrary struct {
+	name string
+	path string
+	req  providerRequest
+}
+
+// providerRequest is the input to a library provider.
+type providerRequest struct {
+	Name    string `json:"name"`
+	Target  string `json:"target,omitempty"`
+	Static  bool   `json:"static"`
+	BuildID string `json:"buildid,omitempty"`
+}
+
+// providerResponse is the output of a library provider.
+type providerResponse struct {
+	BuildID       string `json:"buildid,omitempty"`
+	PackageConfig string `json:"package_config,omitempty"`
+}
+
+// lookupProvider finds the provider for the library on the PATH.
+func lookupProvider(name string, flags Flags) (*providerLibrary, bool) {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, false
+	}
+	path, err := exec.LookPath(providerPrefix + name)
+	if err != nil {
+		return nil, false
+	}
+	logger.Info("Found library provider", zap.String("name", name), zap.String("path", path))
+
+	req := providerRequest{Name: name, Static: flags.Static}
+	if flags.Target != nil {
+		req.Target = flags.Target.Spec()
+	}
+	return &providerLibrary{name: name, path: path, req: req}, true
+}
+
+func (l *providerLibrary) Install(ctx context.Context, logger *zap.Logger) (string, error) {
+	resp, err := l.run(ctx, logger, "install", l.req)
+	if err != nil {
+		return "", err
+	}
+	return resp.BuildID, nil
+}
+
+func (l *providerLibrary) WritePackageConfig(w io.Writer, buildid string) error {
+	req := l.req
+	req.BuildID = buildid
+	resp, err := l.run(context.Background(), logger, "package-config", req)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, resp.PackageConfig)
+	return err
+}
+
+// run runs the provider for the operation and decodes its response.
+func (l *providerLibrary) run(ctx context.Context, logger *zap.Logger, op string, req providerRequest) (*providerResponse, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var out, errOut bytes.Buffer
+	cmd := exec.CommandContext(ctx, l.path, op)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+
+	logger.Info("Running library provider", zap.String("name", l.name), zap.String("operation", op))
+	err = cmd.Run()
+	_ = logutil.LogOutput(&errOut, logger)
+	if err != nil {
+		return nil, fmt.Errorf("library provider %s failed to %s: %w", l.path, op, err)
+	}
+
+	var resp providerResponse
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("library provider %s returned an invalid response for %s: %w", l.path, op, err)
+	}
+	return &resp, nil
+}
+
+// fluxOptions constructs the options for configuring flux from the flags.
+func fluxOptions(flags Flags) flux.Options {
+	return flux.Options{
+		Static:      flags.Static,
+		Target:      flags.Target,
+		HeadersOnly: headersOnly(flags),
+		ArchTag:     flags.ArchTag,
+	}
+}
+
+// headersOnly reports whether only the compiler flags were requested
+// and PKG_CONFIG_HEADERS_ONLY permits skipping the library build.
+func headersOnly(flags Flags) bool {
+	if envHeadersOnly.Get() != "1" {
+		return false
+	}
+	return flags.Cflags && !flags.Libs && !flags.Static &&
+		flags.ModVersion == "" && flags.MaxVersion == "" &&
+		!flags.PrintIncludeDir
+}
+
+// listTargets writes each supported target along with its cargo target triple.
+func listTargets(w io.Writer) {
+	for _, t := range flux.SupportedTargets() {
+		_, _ = fmt.Fprintf(w, "%s\t%s\n", t.Spec(), t.DetermineCargoTarget(logger))
+	}
 }
 
-func runPkgConfig(execCmd, pkgConfigPath string, libs []string, flags Flags) error {
-	args := make([]string, 0, len(libs)+4)
+// checkPrereqs writes a report of the tools needed to build flux
+// for the target and reports whether all of them are present.
+func checkPrereqs(ctx context.Context, w io.Writer, flags Flags) (bool, error) {
+	prereqs, err := flux.CheckPrerequisites(ctx, fluxOptions(flags))
+	if err != nil {
+		return false, err
+	}
 
-	// The modversion flag will report the versions of a comma separated list of
-	// package names, making it mutually exclusive to the various linking flags.
-	if len(flags.ModVersion) > 0 {
-		args = append(args, "--modversion")
-		args = append(args, flags.ModVersion)
-	} else {
-		if flags.Cflags {
-			args = append(args, "--cflags")
-		}
-		if flags.Libs {
-			args = append(args, "--libs")
+	ok := true
+	for _, p := range prereqs {
+		status := "ok"
+		if !p.OK {
+			status, ok = "missing", false
 		}
-		if flags.Static {
-			args = append(args, "--static")
-		}
-		args = append(args, "--")
-		args = append(args, libs...)
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", status, p.Name, p.Detail)
 	}
+	return ok, nil
+}
 
-	pathEnv := os.Getenv("PKG_CONFIG_PATH")
-	if pathEnv != "" {
-		pathEnv = fmt.Sprintf("%s%c%s", pkgConfigPath, os.PathListSeparator, pathEnv)
+// selfCheckReport is the report written for --selfcheck.
+type selfCheckReport struct {
+	Version   string    `json:"version"`
+	PkgConfig flux.Tool `json:"pkg_config"`
+	*flux.Diagnostics
+}
+
+// writeSelfCheck writes a JSON report of the wrapper version, the real
+// pkg-config found on the PATH and the environment flux would be built
+// in. The lookupErr is the error from looking up pkg-config.
+func writeSelfCheck(ctx context.Context, w io.Writer, pkgConfigExec string, lookupErr error, flags Flags) error {
+	report := selfCheckReport{
+		Version:     wrapperVersion(),
+		Diagnostics: flux.Diagnose(ctx, logger, fluxOptions(flags)),
+	}
+	if lookupErr != nil {
+		report.PkgConfig.Error = lookupErr.Error()
 	} else {
-		pathEnv = pkgConfigPath
+		report.PkgConfig = flux.ToolStatus(ctx, pkgConfigExec)
 	}
 
-	cmd := exec.Command(execCmd, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = append(os.Environ(), fmt.Sprintf("PKG_CONFIG_PATH=%s", pathEnv))
-	return cmd.Run()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
 }
 
-func getLibraryFor(ctx context.Context, name string, static bool) (Library, bool, error) {
-	switch name {
-	case "flux":
-		l, err := flux.Configure(ctx, logger, static)
-		if err != nil {
-			return nil, true, err
-		}
-		return l, true, nil
+// wrapperVersion returns the version of this
+// module the binary was built from.
+func wrapperVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
 	}
-	return nil, false, nil
+	return "(devel)"
+}
+
+// printFluxDir writes the directory that flux will be built from
+// to the writer. The sources are not copied or built.
+func printFluxDir(ctx context.Context, w io.Writer, flags Flags) error {
+	l, err := flux.Configure(ctx, logger, fluxOptions(flags))
+	if err != nil {
+		return err
+	}
+
+	dir, err := l.SourceDir()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, dir)
+	return err
+}
+
+// needsBuild writes the reason flux does or does not need to be built.
+// Like make -q, only an up to date library exits with 0 so a failed
+// check never causes a caller to skip a build it needed.
+func needsBuild(ctx context.Context, w io.Writer, flags Flags) (bool, error) {
+	l, err := flux.Configure(ctx, logger, fluxOptions(flags))
+	if err != nil {
+		return false, err
+	}
+
+	needed, reason, err := l.NeedsBuild(ctx, logger)
+	if err != nil {
+		return false, err
+	}
+	_, err = fmt.Fprintln(w, reason)
+	return needed, err
 }
 
-func realMain() int {
-	if err := configureLogger(&logger); err != nil {
-		panic(err)
+func realMain() (retcode int) {
+	// The environment file may configure the logging and the go
+	// binary so it is loaded before either of them is set up.
+	var envErr error
+	if path := envFile(); path != "" {
+		envErr = loadEnvFile(path)
 	}
+	flux.ResolveGoCmd()
+
+	configureLogger(&logger)
 	defer func() { _ = logger.Sync() }()
+	defer writeWarningSummary(summaryOutput)
 
-	ctx := context.TODO()
+	// Stop the build and any commands it is running when interrupted.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dump := &debugDump{Args: os.Args[1:], Libraries: []debugLibrary{}}
+	if dumpPath := envDebugDump.Get(); dumpPath != "" {
+		defer func() {
+			dump.ExitCode = retcode
+			if err := dump.writeFile(expandPath(dumpPath)); err != nil {
+				logger.Warn("Unable to write PKG_CONFIG_DEBUG_DUMP file", zap.Error(err))
+			}
+		}()
+	}
 
 	arg0path := getArg0Path()
+	dump.Arg0 = arg0path
 	logger.Info("Started pkg-config", zap.String("arg0", arg0path), zap.Strings("args", os.Args[1:]))
+	if envErr != nil {
+		logger.Error("Unable to load environment file", zap.Error(envErr))
+		return 1
+	}
+	logEnvFileSettings()
 	origPath := os.Getenv("PATH")
 	if err := modifyPath(getArg0Path()); err != nil {
 		logger.Error("Unable to modify PATH variable", zap.Error(err))
 	}
+
+	libs, flags, err := parseFlags(os.Args[0], os.Args[1:])
+	if err != nil {
+		logger.Error("Failed to parse command-line flags", zap.Error(err))
+		return 1
+	}
+
+	if flags.PrintWrapperConfig {
+		printWrapperConfig(stdout, flags)
+		return 0
+	}
+
+	// A relocatable package config is relative to the directory
+	// it is written to, which standard output does not have.
+	if flags.ShowPc && envRelocatable.Get() == "1" {
+		logger.Error("PKG_CONFIG_RELOCATABLE cannot be used with --show-pc. Use --pc-outdir instead.")
+		return 1
+	}
+
 	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if flags.SelfCheck {
+		// The report describes a missing pkg-config
+		// rather than failing because of it.
+		os.Setenv("PATH", origPath)
+		if err := writeSelfCheck(ctx, stdout, pkgConfigExec, err, flags); err != nil {
+			logger.Error("Unable to write self-check report", zap.Error(err))
+			return 1
+		}
+		return 0
+	}
 	if err != nil {
 		logger.Error("Could not find pkg-config executable. Please make sure you have https://www.freedesktop.org/wiki/Software/pkg-config/ installed. This is not InfluxData's pkg-config!", zap.String("path", os.Getenv("PATH")), zap.Error(err))
 		return 1
 	}
 	logger.Info("Found pkg-config executable", zap.String("path", pkgConfigExec))
+	dump.PkgConfig, dump.Path = pkgConfigExec, os.Getenv("PATH")
 	os.Setenv("PATH", origPath)
 
-	libs, flags, err := parseFlags(os.Args[0], os.Args[1:])
-	if err != nil {
-		logger.Error("Failed to parse command-line flags", zap.Error(err))
-		return 1
+	if flags.ListTargets {
+		listTargets(stdout)
+		return 0
+	}
+
+	if flags.CheckPrereqs {
+		ok, err := checkPrereqs(ctx, stdout, flags)
+		if err != nil {
+			logger.Error("Unable to check build prerequisites", zap.Error(err))
+			return 1
+		} else if !ok {
+			logger.Error("Some build prerequisites are missing")
+			return 1
+		}
+		return 0
+	}
+
+	if flags.NeedsBuild {
+		needed, err := needsBuild(ctx, stdout, flags)
+		if err != nil {
+			logger.Error("Unable to determine whether flux needs to be built", zap.Error(err))
+			return exitCode(err)
+		} else if needed {
+			return 1
+		}
+		return 0
+	}
+
+	if flags.PrintFluxDir {
+		if err := printFluxDir(ctx, stdout, flags); err != nil {
+			logger.Error("Unable to determine flux source directory", zap.Error(err))
+			return 1
+		}
+		return 0
+	}
+
+	// Without any libraries there is nothing for us to build, so the
+	// real pkg-config is run with the pkg-config arguments. This keeps
+	// queries such as --version the same as the real pkg-config. The
+	// packages for --modversion are given as its value instead.
+	if len(libs) == 0 && flags.ModVersion == "" && !flags.PrintPkgConfigPath {
+		logger.Info("No libraries were given, running pkg-config with the original arguments")
+		return pkgConfigExitCode(execPkgConfig(pkgConfigExec, os.Args[1:], flags))
 	}
 
 	// Construct a temporary path where we will place all of the generated
 	// pkgconfig files.
-	pkgConfigPath, err := ioutil.TempDir("", "pkgconfig")
+	pkgConfigPath, err := makePkgConfigDir()
 	if err != nil {
 		logger.Error("Unable to create temporary directory for pkgconfig files", zap.Error(err))
 		return 1
 	}
 	defer func() { _ = os.RemoveAll(pkgConfigPath) }()
+	dump.PkgConfigPath = composePkgConfigPath(pkgConfigPath, flags.PcPaths)
+
+	if flags.PrintPkgConfigPath {
+		printPkgConfigPath(stdout, pkgConfigPath, flags.PcPaths)
+		return 0
+	}
+
+	var recordedLocks map[string]*flux.BuildLock
+	if flags.VerifyLock != "" {
+		if recordedLocks, err = readBuildLocks(flags.VerifyLock); err != nil {
+			logger.Error("Could not read lock file", zap.String("path", flags.VerifyLock), zap.Error(err))
+			return 1
+		}
+	}
 
 	// Construct the packages and write pkgconfig files to point to those packages.
-	for _, lib := range libs {
-		if l, ok, err := getLibraryFor(ctx, lib, flags.Static); err != nil {
+	provenance := make(map[string]*flux.Provenance)
+	locks := make(map[string]*flux.BuildLock)
+	configureLibrary := func(lib string) int {
+		l, ok, err := getLibraryFor(ctx, lib, flags)
+		if err != nil {
 			logger.Error("Error configuring library", zap.String("name", lib), zap.Error(err))
-			return 1
+			return exitCode(err)
+		}
+
+		// Check the build inputs before building so
+		// drift is reported without waiting on the build.
+		if fl, isFlux := l.(*flux.Library); isFlux && (flags.WriteLock != "" || flags.VerifyLock != "") {
+			lock, err := fl.BuildLock(ctx)
+			if err != nil {
+				logger.Error("Could not determine build inputs", zap.String("name", lib), zap.Error(err))
+				return 1
+			}
+			if flags.VerifyLock != "" {
+				if err := verifyBuildLock(recordedLocks, lib, lock); err != nil {
+					logger.Error("Build inputs do not match the lock file", zap.String("path", flags.VerifyLock), zap.Error(err))
+					return 1
+				}
+			}
+			locks[lib] = lock
+		}
+
+		if ok && flags.ShowPc {
+			if err := showPackageConfig(ctx, stdout, l, flags.NoBuild, flags.InstallPrefix); err != nil {
+				logger.Error("Error writing pkg-config configuration", zap.String("name", lib), zap.Error(err))
+				return exitCode(err)
+			}
 		} else if ok {
 			buildid, err := l.Install(ctx, logger)
 			if err != nil {
 				logger.Error("Error installing library", zap.String("name", lib), zap.Error(err))
-				return 1
+				return exitCode(err)
 			}
 
-			pkgfile := filepath.Join(pkgConfigPath, lib+".pc")
+			pkgfile := filepath.Join(pkgConfigPath, packageName(lib, flags)+".pc")
 			f, err := os.Create(pkgfile)
 			if err != nil {
 				logger.Error("Could not create pkg-config configuration file", zap.String("path", pkgfile), zap.Error(err))
@@ -243,22 +1441,514 @@ func realMain() int {
 
 			if err := l.WritePackageConfig(f, buildid); err != nil {
 				logger.Error("Error writing pkg-config configuration file", zap.String("path", pkgfile), zap.Error(err))
-				return 1
+				return exitCode(err)
+			}
+			dump.addLibrary(lib, l, pkgfile)
+
+			if flags.PcOutdir != "" {
+				path, err := writeTargetPackageConfig(flags.PcOutdir, packageName(lib, flags), l, buildid, flags.InstallPrefix)
+				if err != nil {
+					logger.Error("Could not write pkg-config configuration file for the target", zap.String("outdir", flags.PcOutdir), zap.Error(err))
+					return exitCode(err)
+				}
+				logger.Info("Wrote pkg-config configuration file for the target", zap.String("path", path))
+			}
+
+			if fl, ok := l.(*flux.Library); ok && flags.Provenance != "" {
+				p, err := fl.Provenance(buildid)
+				if err != nil {
+					logger.Error("Could not determine provenance", zap.String("name", lib), zap.Error(err))
+					return 1
+				}
+				provenance[lib] = p
+			}
+
+			if envSelfTest.Get() == "1" {
+				if err := selfTest(pkgConfigExec, pkgConfigPath, flags.PcPaths, packageName(lib, flags)); err != nil {
+					logger.Error("Self-test of pkg-config configuration file failed", zap.String("path", pkgfile), zap.Error(err))
+					return 1
+				}
 			}
 		}
+		return 0
+	}
+	if code := buildLibraries(libs, flags.KeepGoing, configureLibrary); code != 0 {
+		return code
+	}
+
+	if flags.ShowPc {
+		return 0
+	}
+
+	if flags.Provenance != "" {
+		if err := writeProvenance(flags.Provenance, provenance); err != nil {
+			logger.Error("Could not write provenance file", zap.String("path", flags.Provenance), zap.Error(err))
+			return 1
+		}
+	}
+
+	if flags.WriteLock != "" {
+		if err := writeBuildLocks(flags.WriteLock, locks); err != nil {
+			logger.Error("Could not write lock file", zap.String("path", flags.WriteLock), zap.Error(err))
+			return 1
+		}
 	}
 
 	// Run pkgconfig for the given libraries and flags.
-	if err := runPkgConfig(pkgConfigExec, pkgConfigPath, libs, flags); err != nil {
-		logger.Error("Running pkg-config failed", zap.Error(err))
+	return pkgConfigExitCode(runPkgConfig(pkgConfigExec, pkgConfigPath, libs, flags))
+}
+
+// pkgConfigExited is set when the exit code is the one the real
+// pkg-config exited with rather than a failure of the wrapper.
+var pkgConfigExited bool
+
+// pkgConfigExitCode returns the exit code for the result of
+// running the real pkg-config.
+func pkgConfigExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	// The consumer of the output closed it early, such as head.
+	// This is not a failure of pkg-config.
+	if isBrokenPipe(err) {
+		logger.Info("Output was closed before pkg-config finished writing")
+		return 0
+	}
+	// Propagate the exit code from pkg-config since callers
+	// rely on it to determine the result of their query.
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		logger.Info("pkg-config exited with a non-zero status", zap.Int("code", exitErr.ExitCode()))
+		pkgConfigExited = true
+		return exitErr.ExitCode()
+	}
+	logger.Error("Running pkg-config failed", zap.Error(err))
+	return 1
+}
+
+// execPkgConfig runs the real pkg-config with the arguments unchanged
+// and without any of the generated package configs. Only the flags for
+// the wrapper, which the real pkg-config would reject, are left out.
+// The directories from --with-pc-path are still searched.
+func execPkgConfig(execCmd string, args []string, flags Flags) error {
+	cmd := exec.Command(execCmd, withoutWrapperFlags(flags.flagSet, args)...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	if len(flags.PcPaths) > 0 {
+		cmd.Env = append(os.Environ(), "PKG_CONFIG_PATH="+composePkgConfigPath("", flags.PcPaths))
+	}
+	return cmd.Run()
+}
+
+// withoutWrapperFlags returns the arguments without the flags that are
+// defined by the wrapper and not forwarded to pkg-config, along with
+// their values. The other arguments are kept in the order they were given.
+func withoutWrapperFlags(flagSet *pflag.FlagSet, args []string) []string {
+	if flagSet == nil {
+		return args
+	}
+	var kept []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(kept, args[i:]...)
+		}
+
+		var flag *pflag.Flag
+		if strings.HasPrefix(arg, "--") {
+			flag = flagSet.Lookup(strings.SplitN(arg[2:], "=", 2)[0])
+		} else if len(arg) == 2 && arg[0] == '-' {
+			flag = flagSet.ShorthandLookup(arg[1:])
+		}
+		if flag == nil || containsString(forwardedFlags, flag.Name) {
+			kept = append(kept, arg)
+			continue
+		}
+		// The value given as the next argument belongs to the flag.
+		if flag.NoOptDefVal == "" && !strings.Contains(arg, "=") && i+1 < len(args) {
+			i++
+		}
+	}
+	return kept
+}
+
+// The exit codes for the failures that callers may want to
+// distinguish. These avoid the codes pkg-config itself uses.
+const (
+	exitModuleNotFound      = 3
+	exitBuildFailed         = 4
+	exitVersionUndetermined = 5
+)
+
+// exitCode returns the exit code for an error
+// configuring or installing a library.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, flux.ErrModuleNotFound):
+		return exitModuleNotFound
+	case errors.Is(err, flux.ErrBuildFailed):
+		return exitBuildFailed
+	case errors.Is(err, flux.ErrVersionUndetermined):
+		return exitVersionUndetermined
+	default:
 		return 1
 	}
-	return 0
+}
+
+// envFileName is the name of the file in the module root
+// that contains environment variables for the build.
+const envFileName = ".pkgconfig.env"
+
+// envFile returns the path to the environment file in the module
+// root or an empty string when there is no main module. This can be
+// replaced for testing.
+var envFile = defaultEnvFile
+
+func defaultEnvFile() string {
+	if !modload.HasModRoot() {
+		return ""
+	}
+	return filepath.Join(modload.ModRoot(), envFileName)
+}
+
+// loadEnvFile sets the environment variables from the key=value
+// lines in the file. Variables that are already set in the environment
+// take precedence over the file. Blank lines and lines starting with #
+// are ignored. It is not an error for the file to not exist. Nothing
+// is logged since the file may configure the logger.
+func loadEnvFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || strings.ContainsAny(key, " \t") {
+			return fmt.Errorf("%s:%d: expected key=value", path, i+1)
+		}
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		if err := settings.SetFromFile(key, value, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logEnvFileSettings logs each environment variable
+// that was set from the environment file.
+func logEnvFileSettings() {
+	for _, key := range settings.FromFile() {
+		path, _ := settings.FilePath(key)
+		logger.Info("Set environment variable from environment file", zap.String("key", key), zap.String("path", path))
+	}
+}
+
+// The environment variables that configure the wrapper itself.
+// The settings for flux are declared by its package.
+var (
+	envAppendPath       = settings.New("PKG_CONFIG_APPEND_PATH", "")
+	envDebugDump        = settings.New("PKG_CONFIG_DEBUG_DUMP", "")
+	envGHAAnnotations   = settings.New("PKG_CONFIG_GHA_ANNOTATIONS", "")
+	envHeadersOnly      = settings.New("PKG_CONFIG_HEADERS_ONLY", "")
+	envLibdir           = settings.New("PKG_CONFIG_LIBDIR", "")
+	envLibraryProviders = settings.New("PKG_CONFIG_LIBRARY_PROVIDERS", "")
+	envLog              = settings.New("PKG_CONFIG_LOG", "")
+	envLogBufferKB      = settings.New("PKG_CONFIG_LOG_BUFFER_KB", strconv.Itoa(defaultLogBufferSize/1024))
+	envLogSyslog        = settings.New("PKG_CONFIG_LOG_SYSLOG", "")
+	envPath             = settings.New("PKG_CONFIG_PATH", "")
+	envPkgConfig        = settings.New("PKG_CONFIG", "")
+	envQuiet            = settings.New("PKG_CONFIG_QUIET", "")
+	envRelocatable      = settings.New("PKG_CONFIG_RELOCATABLE", "")
+	envSelfTest         = settings.New("PKG_CONFIG_SELFTEST", "")
+	envTmpdir           = settings.New("PKG_CONFIG_TMPDIR", "")
+	envUseSystemFlux    = settings.New("PKG_CONFIG_USE_SYSTEM_FLUX", "")
+)
+
+// printWrapperConfig writes each flag and each declared setting the
+// wrapper uses with its effective value and where the value came
+// from. The source is flag, env or file when it was set on the
+// command line, in the environment or in the environment file, and
+// default otherwise.
+func printWrapperConfig(w io.Writer, flags Flags) {
+	flags.flagSet.VisitAll(func(flag *pflag.Flag) {
+		source := "default"
+		if flag.Changed {
+			source = "flag"
+		}
+		_, _ = fmt.Fprintf(w, "--%s\t%s\t%s\n", flag.Name, flag.Value, source)
+	})
+	for _, setting := range settings.All() {
+		value, source := setting.Value()
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", setting.Name, value, source)
+	}
+}
+
+// makePkgConfigDir creates the temporary directory for the generated
+// pkgconfig files. The directory is created within PKG_CONFIG_TMPDIR
+// when it is set instead of the system temporary directory.
+func makePkgConfigDir() (string, error) {
+	tmpdir := envTmpdir.Get()
+	if tmpdir != "" {
+		tmpdir = expandPath(tmpdir)
+		if err := os.MkdirAll(tmpdir, 0755); err != nil {
+			return "", fmt.Errorf("could not create PKG_CONFIG_TMPDIR: %w", err)
+		}
+	}
+
+	dir, err := ioutil.TempDir(tmpdir, "pkgconfig")
+	if err != nil && tmpdir != "" {
+		return "", fmt.Errorf("PKG_CONFIG_TMPDIR is not writable: %w", err)
+	}
+	return dir, err
+}
+
+// libraryTarget returns the name of the target the library is built for.
+func libraryTarget(l Library) (string, error) {
+	switch l := l.(type) {
+	case *flux.Library:
+		return l.Target.String(), nil
+	case *flux.SystemLibrary:
+		return l.Target.String(), nil
+	}
+	return "", fmt.Errorf("unable to determine the target of %T", l)
+}
+
+// writeTargetPackageConfig writes the package config for the library
+// to <outdir>/<target>/<name>.pc. Each target has its own directory
+// so a consumer can point PKG_CONFIG_PATH at the directory for the
+// target it is building and the package names stay the same. When
+// PKG_CONFIG_RELOCATABLE is set, the paths to flux are written
+// relative to that directory.
+func writeTargetPackageConfig(outdir, name string, l Library, buildid, installPrefix string) (string, error) {
+	target, err := libraryTarget(l)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(outdir, target)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name+".pc")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	fl, isFlux := l.(*flux.Library)
+	if isFlux && installPrefix == "" && envRelocatable.Get() == "1" {
+		err = fl.WriteRelocatablePackageConfig(f, buildid, dir)
+	} else {
+		err = writeOutputPackageConfig(f, l, buildid, installPrefix)
+	}
+	if err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// buildLibraries configures each library with the function and
+// returns the first nonzero exit code. When keepGoing is set, the
+// remaining libraries are still built after a failure and the status
+// of each library is reported once all of them have been attempted.
+func buildLibraries(libs []string, keepGoing bool, configure func(lib string) int) int {
+	var (
+		retcode           int
+		succeeded, failed []string
+	)
+	for _, lib := range libs {
+		code := configure(lib)
+		if code == 0 {
+			succeeded = append(succeeded, lib)
+			continue
+		} else if !keepGoing {
+			return code
+		}
+		if retcode == 0 {
+			retcode = code
+		}
+		failed = append(failed, lib)
+	}
+
+	if keepGoing && len(failed) > 0 {
+		for _, lib := range libs {
+			status := "succeeded"
+			if containsString(failed, lib) {
+				status = "failed"
+			}
+			logger.Info("Library build status", zap.String("name", lib), zap.String("status", status))
+		}
+		logger.Error("Some libraries failed to build", zap.Strings("succeeded", succeeded), zap.Strings("failed", failed))
+	}
+	return retcode
+}
+
+// showPackageConfig installs the library and writes its package
+// config to the writer. When noBuild is set, the library is not
+// installed and the package config is written without a build id.
+func showPackageConfig(ctx context.Context, w io.Writer, l Library, noBuild bool, installPrefix string) error {
+	var buildid string
+	if !noBuild {
+		id, err := l.Install(ctx, logger)
+		if err != nil {
+			return err
+		}
+		buildid = id
+	}
+	return writeOutputPackageConfig(w, l, buildid, installPrefix)
+}
+
+// writeOutputPackageConfig writes the package config that is output
+// for the library to be installed elsewhere. When installPrefix is set,
+// flux is written as installed under it. The package config the
+// wrapper queries itself always points at the staged library.
+func writeOutputPackageConfig(w io.Writer, l Library, buildid, installPrefix string) error {
+	if fl, ok := l.(*flux.Library); ok && installPrefix != "" {
+		return fl.WriteInstalledPackageConfig(w, buildid, installPrefix)
+	}
+	return l.WritePackageConfig(w, buildid)
+}
+
+// writeProvenance writes the provenance of each
+// library keyed by the package name as JSON.
+func writeProvenance(path string, provenance map[string]*flux.Provenance) error {
+	data, err := json.MarshalIndent(provenance, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// writeBuildLocks writes the build inputs of each
+// library to the lock file as JSON.
+func writeBuildLocks(path string, locks map[string]*flux.BuildLock) error {
+	data, err := json.MarshalIndent(locks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// readBuildLocks reads the build inputs recorded in the lock file.
+func readBuildLocks(path string) (map[string]*flux.BuildLock, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var locks map[string]*flux.BuildLock
+	if err := json.Unmarshal(data, &locks); err != nil {
+		return nil, err
+	}
+	return locks, nil
+}
+
+// verifyBuildLock verifies the build inputs for the library
+// match those recorded for it.
+func verifyBuildLock(recorded map[string]*flux.BuildLock, lib string, lock *flux.BuildLock) error {
+	want, ok := recorded[lib]
+	if !ok {
+		return fmt.Errorf("no build inputs recorded for %s", lib)
+	}
+	if diff := lock.Diff(want); len(diff) > 0 {
+		return fmt.Errorf("build inputs for %s changed:\n\t%s", lib, strings.Join(diff, "\n\t"))
+	}
+	return nil
+}
+
+// debugDump is a snapshot of the state resolved during a run that
+// is written to PKG_CONFIG_DEBUG_DUMP to be attached to bug reports.
+type debugDump struct {
+	Arg0          string         `json:"arg0"`
+	Args          []string       `json:"args"`
+	PkgConfig     string         `json:"pkg_config"`
+	Path          string         `json:"path"`
+	PkgConfigPath string         `json:"pkg_config_path"`
+	Libraries     []debugLibrary `json:"libraries"`
+	ExitCode      int            `json:"exit_code"`
+}
+
+type debugLibrary struct {
+	Name          string `json:"name"`
+	Path          string `json:"path,omitempty"`
+	Version       string `json:"version,omitempty"`
+	Dir           string `json:"dir,omitempty"`
+	Target        string `json:"target,omitempty"`
+	PackageConfig string `json:"package_config"`
+}
+
+// addLibrary records the resolved library and the
+// contents of the package config generated for it.
+func (d *debugDump) addLibrary(name string, l Library, pkgfile string) {
+	lib := debugLibrary{Name: name}
+	if fl, ok := l.(*flux.Library); ok {
+		lib.Path = fl.Path
+		lib.Version = fl.Version
+		lib.Dir = fl.Dir
+		lib.Target = fl.Target.Spec()
+	}
+	if data, err := ioutil.ReadFile(pkgfile); err == nil {
+		lib.PackageConfig = string(data)
+	}
+	d.Libraries = append(d.Libraries, lib)
+}
+
+func (d *debugDump) writeFile(path string) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// failureInfoLines is the number of the most recent info lines
+// that are written after a failure to give context to the errors.
+const failureInfoLines = 10
+
+// writeFailureOutput writes the buffered log output after a failure.
+// The warnings and errors are written with only the most recent info
+// lines so the cause of the failure is not lost among them. In quiet
+// mode, only the last line is written as a summary.
+func writeFailureOutput(w io.Writer) {
+	if !quiet() {
+		_, _ = io.WriteString(w, stderr.FailureOutput(failureInfoLines))
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if summary := lines[len(lines)-1]; summary != "" {
+		_, _ = fmt.Fprintln(w, summary)
+	}
 }
 
 func main() {
 	if retcode := realMain(); retcode != 0 {
-		_, _ = io.Copy(os.Stderr, &stderr)
+		// The real pkg-config reports its own result, such as a
+		// package that --exists does not find, so the log output
+		// is only written for the failures of the wrapper.
+		if !pkgConfigExited {
+			writeFailureOutput(os.Stderr)
+		}
 		os.Exit(retcode)
 	}
 }
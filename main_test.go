@@ -0,0 +1,1953 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/influxdata/pkg-config/internal/logutil"
+	"github.com/influxdata/pkg-config/libs/flux"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestPrintFluxDir(t *testing.T) {
+	logger = zap.NewNop()
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module github.com/influxdata/flux\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "libflux"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "libflux", "Cargo.toml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.Chdir(cwd) }()
+
+	var buf bytes.Buffer
+	if err := printFluxDir(context.Background(), &buf, Flags{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := strings.TrimSpace(buf.String()), dir; got != want {
+		t.Errorf("unexpected flux dir: got %q, want %q", got, want)
+	}
+}
+
+func TestRunPkgConfig_MaxVersion(t *testing.T) {
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Skip("pkg-config is not installed")
+	}
+
+	pkgConfigPath := t.TempDir()
+	pc := "Name: Flux\nVersion: 0.194.3\nDescription: Library for the InfluxData Flux engine\nLibs: -lflux\n"
+	if err := ioutil.WriteFile(filepath.Join(pkgConfigPath, "flux.pc"), []byte(pc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		maxVersion string
+		ok         bool
+	}{
+		{maxVersion: "0.194.2", ok: false},
+		{maxVersion: "0.194.3", ok: true},
+		{maxVersion: "0.195.0", ok: true},
+		{maxVersion: "1.0.0", ok: true},
+	} {
+		t.Run(tt.maxVersion, func(t *testing.T) {
+			err := runPkgConfig(pkgConfigExec, pkgConfigPath, []string{"flux"}, Flags{MaxVersion: tt.maxVersion})
+			if tt.ok && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			} else if !tt.ok {
+				if exitErr, ok := err.(*exec.ExitError); !ok {
+					t.Errorf("expected exit error, got %v", err)
+				} else if code := exitErr.ExitCode(); code != 1 {
+					t.Errorf("unexpected exit code: got %d, want 1", code)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigureLogger_ExpandPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("PKG_CONFIG_RUN", "run1")
+	t.Setenv("PKG_CONFIG_LOG", "~/logs/$PKG_CONFIG_RUN/pkg-config.json")
+
+	var l *zap.Logger
+	configureLogger(&l)
+	l.Info("Started pkg-config")
+	_ = l.Sync()
+
+	path := filepath.Join(home, "logs", "run1", "pkg-config.json")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected log file to be created: %s", err)
+	}
+	if !strings.Contains(string(data), "Started pkg-config") {
+		t.Errorf("expected log message in %s, got:\n%s", path, data)
+	}
+}
+
+func TestConfigureLogger_FallbackToStderr(t *testing.T) {
+	// A file cannot be used as a parent directory.
+	parent := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(parent, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PKG_CONFIG_LOG", filepath.Join(parent, "pkg-config.json"))
+
+	stderr.Reset()
+	defer stderr.Reset()
+
+	var l *zap.Logger
+	configureLogger(&l)
+	if l == nil {
+		t.Fatal("expected logger to be configured")
+	}
+	if !strings.Contains(stderr.String(), "Unable to open PKG_CONFIG_LOG file") {
+		t.Errorf("expected warning on stderr, got:\n%s", stderr.String())
+	}
+}
+
+func TestParseFlags_Target(t *testing.T) {
+	libs, flags, err := parseFlags("pkg-config", []string{"--cflags", "--target=linux/arm/7/static", "flux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(libs) != 1 || libs[0] != "flux" {
+		t.Errorf("unexpected libs: %v", libs)
+	}
+	want := flux.Target{OS: "linux", Arch: "arm", Arm: "7", Static: true}
+	if flags.Target == nil {
+		t.Fatal("expected target to be set")
+	} else if *flags.Target != want {
+		t.Errorf("unexpected target: got %+v, want %+v", *flags.Target, want)
+	}
+
+	if _, _, err := parseFlags("pkg-config", []string{"--target=linux", "flux"}); err == nil {
+		t.Error("expected error for invalid target")
+	}
+
+	_, flags, err = parseFlags("pkg-config", []string{"--rust-target=x86_64-unknown-linux-musl", "flux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want = flux.Target{OS: "linux", Arch: "amd64", Static: true, Triple: "x86_64-unknown-linux-musl"}
+	if flags.Target == nil {
+		t.Fatal("expected target to be set")
+	} else if *flags.Target != want {
+		t.Errorf("unexpected target: got %+v, want %+v", *flags.Target, want)
+	}
+
+	if _, _, err := parseFlags("pkg-config", []string{"--target=linux/amd64", "--rust-target=x86_64-unknown-linux-gnu", "flux"}); err == nil {
+		t.Error("expected error for both --target and --rust-target")
+	}
+}
+
+func TestRunPkgConfig_PrintIncludeDir(t *testing.T) {
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Skip("pkg-config is not installed")
+	}
+
+	pkgConfigPath := t.TempDir()
+	pc := "prefix=/opt/flux/libflux\nincludedir=${prefix}/include\n\nName: Flux\nVersion: 0.194.3\nDescription: Library for the InfluxData Flux engine\nCflags: -I${includedir}\n"
+	if err := ioutil.WriteFile(filepath.Join(pkgConfigPath, "flux.pc"), []byte(pc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	if err := runPkgConfig(pkgConfigExec, pkgConfigPath, []string{"flux"}, Flags{PrintIncludeDir: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := strings.TrimSpace(buf.String()), "/opt/flux/libflux/include"; got != want {
+		t.Errorf("unexpected include dir: got %q, want %q", got, want)
+	}
+}
+
+func TestComposePkgConfigPath(t *testing.T) {
+	sep := string(os.PathListSeparator)
+	for _, tt := range []struct {
+		name    string
+		path    string
+		append  string
+		pcPaths []string
+		want    string
+	}{
+		{name: "Empty", path: "", want: "/tmp/pkgconfig"},
+		{name: "Prepend", path: "/usr/lib/pkgconfig" + sep + "/opt/lib/pkgconfig", want: "/tmp/pkgconfig" + sep + "/usr/lib/pkgconfig" + sep + "/opt/lib/pkgconfig"},
+		{name: "Append", path: "/usr/lib/pkgconfig" + sep + "/opt/lib/pkgconfig", append: "1", want: "/usr/lib/pkgconfig" + sep + "/opt/lib/pkgconfig" + sep + "/tmp/pkgconfig"},
+		{name: "AppendEmpty", path: "", append: "1", want: "/tmp/pkgconfig"},
+		{name: "WithPcPath", path: "/usr/lib/pkgconfig", pcPaths: []string{"/opt/a", "/opt/b"}, want: "/tmp/pkgconfig" + sep + "/opt/a" + sep + "/opt/b" + sep + "/usr/lib/pkgconfig"},
+		{name: "WithPcPathAppend", path: "/usr/lib/pkgconfig", append: "1", pcPaths: []string{"/opt/a", "/opt/b"}, want: "/usr/lib/pkgconfig" + sep + "/tmp/pkgconfig" + sep + "/opt/a" + sep + "/opt/b"},
+		{name: "WithPcPathEmpty", path: "", pcPaths: []string{"/opt/a"}, want: "/tmp/pkgconfig" + sep + "/opt/a"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_PATH", tt.path)
+			t.Setenv("PKG_CONFIG_APPEND_PATH", tt.append)
+			if got := composePkgConfigPath("/tmp/pkgconfig", tt.pcPaths); got != tt.want {
+				t.Errorf("unexpected path: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	_, flags, err := parseFlags("pkg-config", []string{"--with-pc-path=/opt/a,b", "--with-pc-path", "/opt/c", "flux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := []string{"/opt/a,b", "/opt/c"}; !reflect.DeepEqual(flags.PcPaths, want) {
+		t.Errorf("unexpected pc paths: got %v, want %v", flags.PcPaths, want)
+	}
+}
+
+func TestRunPkgConfig_Stdin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub pkg-config requires a unix shell")
+	}
+
+	// The stub pkg-config echoes its input.
+	pkgConfigExec := filepath.Join(t.TempDir(), "pkg-config")
+	if err := ioutil.WriteFile(pkgConfigExec, []byte("#!/bin/sh\ncat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	stdin, stdout = strings.NewReader("from stdin\n"), &buf
+	defer func() { stdin, stdout = os.Stdin, os.Stdout }()
+
+	if err := runPkgConfig(pkgConfigExec, t.TempDir(), []string{"flux"}, Flags{Cflags: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := buf.String(), "from stdin\n"; got != want {
+		t.Errorf("unexpected output: got %q, want %q", got, want)
+	}
+}
+
+func TestRunPkgConfig_Passthrough(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub pkg-config requires a unix shell")
+	}
+
+	// The stub pkg-config echoes its arguments.
+	pkgConfigExec := filepath.Join(t.TempDir(), "pkg-config")
+	if err := ioutil.WriteFile(pkgConfigExec, []byte("#!/bin/sh\necho \"$@\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	libs, flags, err := parseFlags("pkg-config", []string{"--cflags", "--maximum-traverse-depth=5", "--max-version", "0.200.0", "flux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := []string{"flux"}; !reflect.DeepEqual(libs, want) {
+		t.Fatalf("unexpected libs: got %q, want %q", libs, want)
+	}
+	if want := []string{"--maximum-traverse-depth=5"}; !reflect.DeepEqual(flags.Passthrough, want) {
+		t.Fatalf("unexpected passthrough flags: got %q, want %q", flags.Passthrough, want)
+	}
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	if err := runPkgConfig(pkgConfigExec, t.TempDir(), libs, flags); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := buf.String(), "--maximum-traverse-depth=5 --cflags --max-version=0.200.0 -- flux\n"; got != want {
+		t.Errorf("unexpected arguments: got %q, want %q", got, want)
+	}
+}
+
+func TestParseFlags_PassthroughValues(t *testing.T) {
+	for _, tt := range []struct {
+		args        []string
+		libs        []string
+		passthrough []string
+	}{
+		{
+			args:        []string{"--variable", "prefix", "flux"},
+			libs:        []string{"flux"},
+			passthrough: []string{"--variable", "prefix"},
+		},
+		{
+			args:        []string{"--define-variable", "foo=bar", "--cflags", "flux"},
+			libs:        []string{"flux"},
+			passthrough: []string{"--define-variable", "foo=bar"},
+		},
+		{
+			args:        []string{"--variable=prefix", "flux"},
+			libs:        []string{"flux"},
+			passthrough: []string{"--variable=prefix"},
+		},
+		{
+			args:        []string{"--exists", "flux"},
+			libs:        []string{"flux"},
+			passthrough: []string{"--exists"},
+		},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			libs, flags, err := parseFlags("pkg-config", tt.args)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(libs, tt.libs) {
+				t.Errorf("unexpected libs: got %q, want %q", libs, tt.libs)
+			}
+			if !reflect.DeepEqual(flags.Passthrough, tt.passthrough) {
+				t.Errorf("unexpected passthrough flags: got %q, want %q", flags.Passthrough, tt.passthrough)
+			}
+		})
+	}
+}
+
+func TestRunPkgConfig_Format(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub pkg-config requires a unix shell")
+	}
+
+	// The stub pkg-config answers the cflags and libs queries separately
+	// and expects the other forwarded flags in their original order.
+	pkgConfigExec := filepath.Join(t.TempDir(), "pkg-config")
+	script := `#!/bin/sh
+case "$*" in
+"--static --max-version=0.200.0 --uninstalled --cflags -- flux") echo "-I/flux/include" ;;
+"--static --max-version=0.200.0 --uninstalled --libs -- flux") echo "-L/flux/lib -lflux -lm" ;;
+*) echo "unexpected arguments: $*" >&2; exit 1 ;;
+esac
+`
+	if err := ioutil.WriteFile(pkgConfigExec, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	libs, flags, err := parseFlags("pkg-config", []string{"--static", "--max-version=0.200.0", "--uninstalled", "--format", "CGO_CFLAGS='{{.Cflags}}' CGO_LDFLAGS='{{.Libs}}'", "flux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	if err := runPkgConfig(pkgConfigExec, t.TempDir(), libs, flags); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := buf.String(), "CGO_CFLAGS='-I/flux/include' CGO_LDFLAGS='-L/flux/lib -lflux -lm'\n"; got != want {
+		t.Errorf("unexpected output: got %q, want %q", got, want)
+	}
+
+	flags.Format = "{{.Cflags"
+	if err := runPkgConfig(pkgConfigExec, t.TempDir(), libs, flags); err == nil {
+		t.Error("expected error for an invalid template")
+	}
+	if _, _, err := parseFlags("pkg-config", []string{"--format", "{{.Libs}}", "--print0", "flux"}); err == nil {
+		t.Error("expected error for --format with --print0")
+	}
+}
+
+func TestConfigureLogger_Annotations(t *testing.T) {
+	t.Setenv("PKG_CONFIG_LOG", "")
+	t.Setenv("PKG_CONFIG_LOG_SYSLOG", "")
+	t.Setenv("PKG_CONFIG_GHA_ANNOTATIONS", "1")
+
+	var buf bytes.Buffer
+	annotationOutput = &buf
+	defer func() { annotationOutput = os.Stderr }()
+	defer stderr.Reset()
+
+	var l *zap.Logger
+	configureLogger(&l)
+	l.Info("Started pkg-config")
+	l.Warn("Unable to determine cargo target. Using the default.", zap.String("target", "linux_amd64"))
+	l.Error("Error installing library\n100% failed")
+
+	want := "::warning title=pkg-config::Unable to determine cargo target. Using the default.\t{\"target\": \"linux_amd64\"}\n" +
+		"::error title=pkg-config::Error installing library%0A100%25 failed\n"
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected annotations: got %q, want %q", got, want)
+	}
+}
+
+func TestWriteFailureOutput_Quiet(t *testing.T) {
+	t.Setenv("PKG_CONFIG_LOG", "")
+	t.Setenv("PKG_CONFIG_QUIET", "1")
+
+	stderr.Reset()
+	defer stderr.Reset()
+
+	var l *zap.Logger
+	configureLogger(&l)
+	l.Info("Started pkg-config")
+	l.Warn("Unable to determine cargo target. Using the default.")
+	l.Error("Error installing library", zap.String("name", "flux"))
+
+	var buf bytes.Buffer
+	writeFailureOutput(&buf)
+
+	if got, want := buf.String(), "Error installing library\t{\"name\": \"flux\"}\n"; got != want {
+		t.Errorf("unexpected output: got %q, want %q", got, want)
+	}
+}
+
+func TestHeadersOnly(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		env   string
+		flags Flags
+		want  bool
+	}{
+		{name: "Cflags", env: "1", flags: Flags{Cflags: true}, want: true},
+		{name: "CflagsLibs", env: "1", flags: Flags{Cflags: true, Libs: true}, want: false},
+		{name: "Libs", env: "1", flags: Flags{Libs: true}, want: false},
+		{name: "Disabled", env: "", flags: Flags{Cflags: true}, want: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_HEADERS_ONLY", tt.env)
+			if got := headersOnly(tt.flags); got != tt.want {
+				t.Errorf("unexpected headers only: got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListTargets(t *testing.T) {
+	logger = zap.NewNop()
+
+	var buf bytes.Buffer
+	listTargets(&buf)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if got, want := len(lines), len(flux.SupportedTargets()); got != want {
+		t.Fatalf("unexpected number of targets: got %d, want %d", got, want)
+	}
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			t.Errorf("malformed line: %q", line)
+			continue
+		}
+		target, err := flux.ParseTarget(fields[0])
+		if err != nil {
+			t.Errorf("unexpected error parsing listed target %q: %s", fields[0], err)
+			continue
+		}
+		if got := target.DetermineCargoTarget(logger); got != fields[1] {
+			t.Errorf("unexpected triple for %s: got %q, want %q", fields[0], fields[1], got)
+		}
+	}
+}
+
+func TestPrintPkgConfigPath(t *testing.T) {
+	sep := string(os.PathListSeparator)
+	t.Setenv("PKG_CONFIG_APPEND_PATH", "")
+	t.Setenv("PKG_CONFIG_PATH", "/usr/local/lib/pkgconfig"+sep+"/usr/lib/pkgconfig")
+
+	_, flags, err := parseFlags("pkg-config", []string{"--print-pkg-config-path"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if !flags.PrintPkgConfigPath {
+		t.Fatal("expected --print-pkg-config-path to be parsed")
+	}
+
+	var buf bytes.Buffer
+	printPkgConfigPath(&buf, "/tmp/pkgconfig123", nil)
+
+	want := "/tmp/pkgconfig123" + sep + "/usr/local/lib/pkgconfig" + sep + "/usr/lib/pkgconfig\n"
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected path: got %q, want %q", got, want)
+	}
+}
+
+func TestParseFlags_Compare(t *testing.T) {
+	_, flags, err := parseFlags("pkg-config", []string{"--compare=v0.193.0,v0.194.3", "--cflags", "flux-a"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := []string{"v0.193.0", "v0.194.3"}; len(flags.Compare) != 2 || flags.Compare[0] != want[0] || flags.Compare[1] != want[1] {
+		t.Errorf("unexpected compare versions: got %v, want %v", flags.Compare, want)
+	}
+
+	if _, _, err := parseFlags("pkg-config", []string{"--compare=v0.193.0", "flux-a"}); err == nil {
+		t.Error("expected error for a single compare version")
+	}
+}
+
+func TestRealMain_ExitCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub pkg-config requires a unix shell")
+	}
+
+	for _, code := range []int{1, 2} {
+		t.Run(fmt.Sprint(code), func(t *testing.T) {
+			// The stub pkg-config fails with the given exit code.
+			dir := t.TempDir()
+			script := fmt.Sprintf("#!/bin/sh\nexit %d\n", code)
+			if err := ioutil.WriteFile(filepath.Join(dir, "pkg-config"), []byte(script), 0755); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PATH", dir)
+			t.Setenv("PKG_CONFIG", "")
+			t.Setenv("PKG_CONFIG_LOG", "")
+
+			args := os.Args
+			os.Args = []string{filepath.Join(t.TempDir(), "pkg-config"), "--cflags", "notflux"}
+			defer func() { os.Args = args }()
+
+			stderr.Reset()
+			defer stderr.Reset()
+			pkgConfigExited = false
+			defer func() { pkgConfigExited = false }()
+
+			if got := realMain(); got != code {
+				t.Errorf("unexpected exit code: got %d, want %d", got, code)
+			}
+			if strings.Contains(stderr.String(), "Running pkg-config failed") {
+				t.Errorf("unexpected generic error in output:\n%s", stderr.String())
+			}
+			// The failure output is only written for the wrapper.
+			if !pkgConfigExited {
+				t.Error("expected the exit code to be reported as the one from pkg-config")
+			}
+		})
+	}
+
+	// Failing to run pkg-config at all is a failure of the wrapper.
+	logger = zap.NewNop()
+	pkgConfigExited = false
+	if got := pkgConfigExitCode(errors.New("exec: not found")); got != 1 || pkgConfigExited {
+		t.Errorf("unexpected result for a failure to run pkg-config: got %d, exited %v", got, pkgConfigExited)
+	}
+}
+
+func TestRealMain_NoLibraries(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub pkg-config requires a unix shell")
+	}
+
+	// The stub pkg-config echoes its arguments and whether
+	// it was given the generated package configs.
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"$@\"\necho \"PKG_CONFIG_PATH=$PKG_CONFIG_PATH\"\nexit 3\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "pkg-config"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	t.Setenv("PKG_CONFIG", "")
+	t.Setenv("PKG_CONFIG_LOG", "")
+	t.Setenv("PKG_CONFIG_PATH", "/usr/lib/pkgconfig")
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{
+			args: []string{"--version", "--cflags"},
+			want: "--version --cflags\nPKG_CONFIG_PATH=/usr/lib/pkgconfig\n",
+		},
+		{
+			args: []string{"--help"},
+			want: "--help\nPKG_CONFIG_PATH=/usr/lib/pkgconfig\n",
+		},
+		{
+			args: []string{"--cflags", "--maximum-traverse-depth=1", "--static", "--version"},
+			want: "--cflags --maximum-traverse-depth=1 --static --version\nPKG_CONFIG_PATH=/usr/lib/pkgconfig\n",
+		},
+		{
+			// The wrapper flags are not passed on but
+			// the directories to search are still used.
+			args: []string{"--list-all", "--with-pc-path=/x", "--target", "linux/arm64", "-k", "--print0"},
+			want: "--list-all\nPKG_CONFIG_PATH=/x" + string(os.PathListSeparator) + "/usr/lib/pkgconfig\n",
+		},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			args := os.Args
+			os.Args = append([]string{filepath.Join(t.TempDir(), "pkg-config")}, tt.args...)
+			defer func() { os.Args = args }()
+
+			var buf bytes.Buffer
+			stdout = &buf
+			defer func() { stdout = os.Stdout }()
+
+			if got := realMain(); got != 3 {
+				t.Errorf("unexpected exit code: got %d, want 3", got)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("unexpected output: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLogFileCore_Concurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pkg-config.log")
+
+	const (
+		loggers = 8
+		records = 50
+	)
+	// Each logger opens the file separately like
+	// separate pkg-config processes would.
+	cores := make([]zapcore.Core, loggers)
+	for i := range cores {
+		core, err := newLogFileCore(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		cores[i] = core
+	}
+
+	var wg sync.WaitGroup
+	for i, core := range cores {
+		wg.Add(1)
+		go func(i int, core zapcore.Core) {
+			defer wg.Done()
+			l := zap.New(core)
+			for j := 0; j < records; j++ {
+				l.Info("Running pkg-config",
+					zap.Int("logger", i),
+					zap.Int("record", j),
+					zap.String("args", strings.Repeat("--cflags ", 512)),
+				)
+			}
+			_ = l.Sync()
+		}(i, core)
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if got, want := len(lines), loggers*records; got != want {
+		t.Fatalf("unexpected number of log records: got %d, want %d", got, want)
+	}
+	for i, line := range lines {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("line %d is not valid json: %s", i+1, err)
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	logger = zap.NewNop()
+
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Skip("pkg-config is not installed")
+	}
+
+	for _, tt := range []struct {
+		name string
+		pc   string
+		err  bool
+	}{
+		{
+			name: "Valid",
+			pc:   "prefix=/opt/flux\nincludedir=${prefix}/include\n\nName: Flux\nDescription: Library for the InfluxData Flux engine\nVersion: 0.194.3\nLibs: -L${prefix}/lib -lflux\nCflags: -I${includedir}\n",
+		},
+		{
+			name: "Malformed",
+			pc:   "prefix=/opt/flux\nincludedir=${prefix}/include\n\nName: Flux\nDescription: Library for the InfluxData Flux engine\nVersion: 0.194.3\nCflags: -I\"${includedir}\n",
+			err:  true,
+		},
+		{
+			name: "Empty",
+			pc:   "Name: Flux\nDescription: Library for the InfluxData Flux engine\nVersion: 0.194.3\n",
+			err:  true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_PATH", "")
+			pkgConfigPath := t.TempDir()
+			if err := ioutil.WriteFile(filepath.Join(pkgConfigPath, "flux.pc"), []byte(tt.pc), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := selfTest(pkgConfigExec, pkgConfigPath, nil, "flux")
+			if tt.err && err == nil {
+				t.Error("expected self-test to fail")
+			} else if !tt.err && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestRunPkgConfig_FlagOrder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub pkg-config requires a unix shell")
+	}
+
+	// The stub pkg-config echoes its arguments.
+	pkgConfigExec := filepath.Join(t.TempDir(), "pkg-config")
+	if err := ioutil.WriteFile(pkgConfigExec, []byte("#!/bin/sh\necho \"$@\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"--libs", "--cflags", "flux"}, want: "--libs --cflags -- flux\n"},
+		{args: []string{"--cflags", "--libs", "flux"}, want: "--cflags --libs -- flux\n"},
+		{args: []string{"--static", "--libs", "--cflags", "--libs", "flux"}, want: "--static --libs --cflags -- flux\n"},
+		{args: []string{"--uninstalled", "flux"}, want: "--uninstalled -- flux\n"},
+		{args: []string{"--cflags", "--uninstalled", "flux"}, want: "--cflags --uninstalled -- flux\n"},
+	} {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			buf.Reset()
+			libs, flags, err := parseFlags("pkg-config", tt.args)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err := runPkgConfig(pkgConfigExec, t.TempDir(), libs, flags); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("unexpected arguments: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRealMain_DebugDump(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub pkg-config requires a unix shell")
+	}
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "pkg-config"), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	t.Setenv("PKG_CONFIG", "")
+	t.Setenv("PKG_CONFIG_LOG", "")
+
+	dumpPath := filepath.Join(t.TempDir(), "debug", "dump.json")
+	t.Setenv("PKG_CONFIG_DEBUG_DUMP", dumpPath)
+
+	args := os.Args
+	os.Args = []string{filepath.Join(t.TempDir(), "pkg-config"), "--cflags", "notflux"}
+	defer func() { os.Args = args }()
+
+	stderr.Reset()
+	defer stderr.Reset()
+
+	// The dump is written even when the run fails.
+	if got := realMain(); got != 1 {
+		t.Errorf("unexpected exit code: got %d, want 1", got)
+	}
+
+	data, err := ioutil.ReadFile(dumpPath)
+	if err != nil {
+		t.Fatalf("expected debug dump to be written: %s", err)
+	}
+	var dump map[string]interface{}
+	if err := json.Unmarshal(data, &dump); err != nil {
+		t.Fatalf("debug dump is not valid json: %s", err)
+	}
+	for _, key := range []string{"arg0", "args", "pkg_config", "path", "pkg_config_path", "libraries", "exit_code"} {
+		if _, ok := dump[key]; !ok {
+			t.Errorf("expected debug dump to contain %q, got:\n%s", key, data)
+		}
+	}
+	if got, want := dump["pkg_config"], filepath.Join(dir, "pkg-config"); got != want {
+		t.Errorf("unexpected pkg_config: got %v, want %s", got, want)
+	}
+	if got := dump["exit_code"]; got != float64(1) {
+		t.Errorf("unexpected exit_code: got %v, want 1", got)
+	}
+}
+
+func TestRealMain_TmpDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub pkg-config requires a unix shell")
+	}
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "pkg-config"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	t.Setenv("PKG_CONFIG", "")
+	t.Setenv("PKG_CONFIG_LOG", "")
+	t.Setenv("PKG_CONFIG_PATH", "")
+
+	// The directory does not exist yet and will be created.
+	tmpdir := filepath.Join(t.TempDir(), "custom", "tmp")
+	t.Setenv("PKG_CONFIG_TMPDIR", tmpdir)
+
+	args := os.Args
+	os.Args = []string{filepath.Join(t.TempDir(), "pkg-config"), "--print-pkg-config-path"}
+	defer func() { os.Args = args }()
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	if got := realMain(); got != 0 {
+		t.Fatalf("unexpected exit code: got %d, want 0", got)
+	}
+	if got := strings.TrimSpace(buf.String()); filepath.Dir(got) != tmpdir {
+		t.Errorf("expected pkgconfig directory within %s, got %q", tmpdir, got)
+	}
+}
+
+func TestMakePkgConfigDir_NotWritable(t *testing.T) {
+	// A file cannot be used as the temporary directory.
+	tmpdir := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(tmpdir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PKG_CONFIG_TMPDIR", tmpdir)
+
+	if dir, err := makePkgConfigDir(); err == nil {
+		t.Errorf("expected error, got %q", dir)
+	}
+}
+
+func TestRunPkgConfig_Print0(t *testing.T) {
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Skip("pkg-config is not installed")
+	}
+	t.Setenv("PKG_CONFIG_PATH", "")
+
+	pkgConfigPath := t.TempDir()
+	pc := `prefix=/opt/my\ flux/libflux
+includedir=${prefix}/include
+
+Name: Flux
+Version: 0.194.3
+Description: Library for the InfluxData Flux engine
+Libs: -L${prefix}/lib -lflux
+Cflags: -I${includedir}
+`
+	if err := ioutil.WriteFile(filepath.Join(pkgConfigPath, "flux.pc"), []byte(pc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	if err := runPkgConfig(pkgConfigExec, pkgConfigPath, []string{"flux"}, Flags{Cflags: true, Libs: true, Print0: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := "-I/opt/my flux/libflux/include\x00-L/opt/my flux/libflux/lib\x00-lflux\x00"
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected output: got %q, want %q", got, want)
+	}
+}
+
+func TestPrintWrapperConfig(t *testing.T) {
+	logger = zap.NewNop()
+
+	path := filepath.Join(t.TempDir(), envFileName)
+	if err := ioutil.WriteFile(path, []byte("PKG_CONFIG_OFFLINE=1\nPKG_CONFIG_LTO=fat\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The environment takes precedence over the file.
+	t.Setenv("PKG_CONFIG_LTO", "thin")
+	t.Setenv("PKG_CONFIG_LIBDIR", "/opt/lib/pkgconfig")
+	for _, key := range []string{"PKG_CONFIG_OFFLINE", "PKG_CONFIG_STRIP", "PKG_CONFIG_SYSTEM_FLUX_PREFIX", "RUSTC"} {
+		t.Setenv(key, "")
+		if err := os.Unsetenv(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loadEnvFile(path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	_, flags, err := parseFlags("pkg-config", []string{"--static", "--print-wrapper-config", "flux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	printWrapperConfig(&buf, flags)
+	for _, want := range []string{
+		"--static\ttrue\tflag\n",
+		"--libs\tfalse\tdefault\n",
+		"PKG_CONFIG_LIBDIR\t/opt/lib/pkgconfig\tenv\n",
+		"PKG_CONFIG_LTO\tthin\tenv\n",
+		"PKG_CONFIG_OFFLINE\t1\tfile\n",
+		"PKG_CONFIG_STRIP\t\tdefault\n",
+		"PKG_CONFIG_SYSTEM_FLUX_PREFIX\t/usr\tdefault\n",
+		"RUSTC\trustc\tdefault\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRealMain_EnvFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake tools require a unix shell")
+	}
+
+	bindir := t.TempDir()
+	fakeGo := filepath.Join(bindir, "custom-go")
+	if err := ioutil.WriteFile(fakeGo, []byte("#!/bin/sh\necho 'go version go1.99.0 linux/amd64'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bindir, "pkg-config"), []byte("#!/bin/sh\necho 1.8.1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bindir)
+	t.Setenv("PKG_CONFIG", "")
+
+	// The logging and the go binary are configured by the environment file.
+	logPath := filepath.Join(t.TempDir(), "pkg-config.log")
+	path := filepath.Join(t.TempDir(), envFileName)
+	contents := "PKG_CONFIG_LOG=" + logPath + "\nPKG_CONFIG_QUIET=1\nPKG_CONFIG_GO_BINARY=" + fakeGo + "\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"PKG_CONFIG_LOG", "PKG_CONFIG_QUIET", "PKG_CONFIG_GO_BINARY", "GO"} {
+		t.Setenv(key, "")
+		if err := os.Unsetenv(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	envFile = func() string { return path }
+	defer func() {
+		envFile = defaultEnvFile
+		flux.ResolveGoCmd()
+	}()
+
+	args := os.Args
+	os.Args = []string{filepath.Join(t.TempDir(), "pkg-config"), "--selfcheck"}
+	defer func() { os.Args = args }()
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	stderr.Reset()
+	defer stderr.Reset()
+
+	if got := realMain(); got != 0 {
+		t.Fatalf("unexpected exit code: got %d, want 0", got)
+	}
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("expected the log file to be written: %s", err)
+	}
+	if !strings.Contains(string(data), "Started pkg-config") {
+		t.Errorf("expected the log file to contain the start of the run, got:\n%s", data)
+	}
+	if strings.Contains(stderr.String(), "Started pkg-config") {
+		t.Errorf("expected info records to be quiet on the console, got:\n%s", stderr.String())
+	}
+	if !strings.Contains(buf.String(), "go1.99.0") {
+		t.Errorf("expected the go binary from the environment file to be used, got:\n%s", buf.String())
+	}
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	logger = zap.NewNop()
+
+	path := filepath.Join(t.TempDir(), envFileName)
+	contents := `# Cross build configuration.
+CARGO=/opt/cross/bin/cargo
+GOARCH = arm64
+RUSTFLAGS="-C target-cpu=native"
+
+PKG_CONFIG_CARGO_LOCKED=frozen
+`
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Variables set in the environment take precedence over the file.
+	t.Setenv("PKG_CONFIG_CARGO_LOCKED", "1")
+	for _, key := range []string{"CARGO", "GOARCH", "RUSTFLAGS"} {
+		t.Setenv(key, "")
+		if err := os.Unsetenv(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := loadEnvFile(path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for key, want := range map[string]string{
+		"CARGO":                   "/opt/cross/bin/cargo",
+		"GOARCH":                  "arm64",
+		"RUSTFLAGS":               "-C target-cpu=native",
+		"PKG_CONFIG_CARGO_LOCKED": "1",
+	} {
+		if got := os.Getenv(key); got != want {
+			t.Errorf("unexpected value for %s: got %q, want %q", key, got, want)
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte("CARGO\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadEnvFile(path); err == nil {
+		t.Error("expected error for line without a value")
+	}
+
+	if err := loadEnvFile(filepath.Join(t.TempDir(), envFileName)); err != nil {
+		t.Errorf("unexpected error for missing file: %s", err)
+	}
+}
+
+func TestConfigureLogger_Syslog(t *testing.T) {
+	t.Setenv("PKG_CONFIG_LOG", "")
+
+	type dial struct {
+		network, raddr, tag string
+	}
+	var (
+		dials []dial
+		buf   bytes.Buffer
+	)
+	dialSyslog = func(network, raddr, tag string) (io.Writer, error) {
+		dials = append(dials, dial{network: network, raddr: raddr, tag: tag})
+		return &buf, nil
+	}
+	defer func() { dialSyslog = dialSyslogWriter }()
+
+	stderr.Reset()
+	defer stderr.Reset()
+
+	for _, tt := range []struct {
+		addr string
+		want dial
+	}{
+		{addr: "1", want: dial{tag: filepath.Base(os.Args[0])}},
+		{addr: "udp://localhost:514", want: dial{network: "udp", raddr: "localhost:514", tag: filepath.Base(os.Args[0])}},
+	} {
+		t.Run(tt.addr, func(t *testing.T) {
+			dials, buf = nil, bytes.Buffer{}
+			t.Setenv("PKG_CONFIG_LOG_SYSLOG", tt.addr)
+
+			var l *zap.Logger
+			configureLogger(&l)
+			l.Info("Started pkg-config")
+			l.Error("Error installing library", zap.String("name", "flux"))
+
+			if len(dials) != 1 || dials[0] != tt.want {
+				t.Errorf("unexpected syslog connection: got %+v, want %+v", dials, tt.want)
+			}
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("expected two records to be sent to syslog, got:\n%s", buf.String())
+			}
+			for _, line := range lines {
+				var record map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Errorf("record is not valid json: %s", err)
+				}
+			}
+			if !strings.Contains(stderr.String(), "Started pkg-config") {
+				t.Errorf("expected records to still be logged to stderr, got:\n%s", stderr.String())
+			}
+		})
+	}
+
+	t.Setenv("PKG_CONFIG_LOG_SYSLOG", "localhost:514")
+	var l *zap.Logger
+	configureLogger(&l)
+	if !strings.Contains(stderr.String(), "Unable to connect to syslog") {
+		t.Errorf("expected warning for invalid address, got:\n%s", stderr.String())
+	}
+}
+
+func TestModifyPath_DuplicateWrapper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub pkg-config requires a unix shell")
+	}
+	t.Setenv("PKG_CONFIG", "")
+
+	// The wrapper is on the path twice, once through a symlink,
+	// with the real pkg-config between the two entries.
+	wrapperDir, systemDir, linkDir := t.TempDir(), t.TempDir(), t.TempDir()
+	wrapper := filepath.Join(wrapperDir, "pkg-config")
+	for _, path := range []string{wrapper, filepath.Join(systemDir, "pkg-config")} {
+		if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(wrapper, filepath.Join(linkDir, "pkg-config")); err != nil {
+		t.Fatal(err)
+	}
+
+	sep := string(os.PathListSeparator)
+	t.Setenv("PATH", wrapperDir+sep+systemDir+sep+linkDir)
+	if err := modifyPath(wrapper); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := os.Getenv("PATH"), systemDir; got != want {
+		t.Errorf("unexpected PATH: got %q, want %q", got, want)
+	}
+
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := filepath.Join(systemDir, "pkg-config"); pkgConfigExec != want {
+		t.Errorf("unexpected pkg-config: got %q, want %q", pkgConfigExec, want)
+	}
+}
+
+func TestModifyPath_UnresolvedWrapper(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on windows")
+	}
+	t.Setenv("PKG_CONFIG", "")
+
+	// The wrapper is invoked through a symlink that no longer resolves.
+	linkDir, systemDir := t.TempDir(), t.TempDir()
+	wrapper := filepath.Join(linkDir, "pkg-config")
+	if err := os.Symlink(filepath.Join(t.TempDir(), "missing"), wrapper); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(systemDir, "pkg-config"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger = zap.New(core)
+	defer func() { logger = zap.NewNop() }()
+
+	t.Setenv("PATH", linkDir+string(os.PathListSeparator)+systemDir)
+	if err := modifyPath(wrapper); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := os.Getenv("PATH"), systemDir; got != want {
+		t.Errorf("unexpected PATH: got %q, want %q", got, want)
+	}
+	if logs.FilterMessageSnippet("comparing paths lexically").Len() != 1 {
+		t.Error("expected the lexical comparison to be logged")
+	}
+}
+
+func TestConfigureLogger_WarningSummary(t *testing.T) {
+	t.Setenv("PKG_CONFIG_LOG", "")
+	t.Setenv("PKG_CONFIG_LOG_SYSLOG", "")
+
+	stderr.Reset()
+	defer stderr.Reset()
+
+	var l *zap.Logger
+	configureLogger(&l)
+	if got := warnings.Summary(); got != "" {
+		t.Errorf("expected no summary without warnings, got %q", got)
+	}
+
+	l.Info("Started pkg-config")
+	l.Warn("Unable to determine cargo target. Using the default.", zap.String("target", "freebsd_amd64"))
+	l.With(zap.String("dir", "/tmp")).Warn("Could not fetch git tags")
+	l.Warn("Unable to determine cargo target. Using the default.", zap.String("target", "freebsd_386"))
+	l.Error("Error installing library")
+
+	want := "3 warnings: Unable to determine cargo target. Using the default; Could not fetch git tags"
+	if got := warnings.Summary(); got != want {
+		t.Errorf("unexpected summary: got %q, want %q", got, want)
+	}
+
+	var buf bytes.Buffer
+	writeWarningSummary(&buf)
+	if got, want := buf.String(), "pkg-config completed with "+want+"\n"; got != want {
+		t.Errorf("unexpected summary output: got %q, want %q", got, want)
+	}
+	if strings.Contains(stderr.String(), "completed with") {
+		t.Errorf("expected the summary to not be logged, got:\n%s", stderr.String())
+	}
+}
+
+func TestRunPkgConfig_PackageName(t *testing.T) {
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Skip("pkg-config is not installed")
+	}
+
+	// A system flux.pc would be shadowed by a generated flux.pc.
+	systemPath := t.TempDir()
+	system := "Name: Flux\nVersion: 0.100.0\nDescription: System flux\nCflags: -I/usr/include/flux\n"
+	if err := ioutil.WriteFile(filepath.Join(systemPath, "flux.pc"), []byte(system), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PKG_CONFIG_PATH", systemPath)
+
+	libs, flags, err := parseFlags("pkg-config", []string{"--cflags", "--package-name=flux=flux-dev", "flux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pkgConfigPath := t.TempDir()
+	pkgfile := filepath.Join(pkgConfigPath, packageName("flux", flags)+".pc")
+	if want := filepath.Join(pkgConfigPath, "flux-dev.pc"); pkgfile != want {
+		t.Fatalf("unexpected package config file: got %q, want %q", pkgfile, want)
+	}
+	generated := "Name: Flux\nVersion: 0.194.3\nDescription: Library for the InfluxData Flux engine\nCflags: -I/opt/flux/include\n"
+	if err := ioutil.WriteFile(pkgfile, []byte(generated), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	if err := runPkgConfig(pkgConfigExec, pkgConfigPath, libs, flags); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := strings.TrimSpace(buf.String()), "-I/opt/flux/include"; got != want {
+		t.Errorf("unexpected output: got %q, want %q", got, want)
+	}
+}
+
+func TestRunPkgConfig_OutputSeparator(t *testing.T) {
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Skip("pkg-config is not installed")
+	}
+	t.Setenv("PKG_CONFIG_PATH", "")
+
+	pkgConfigPath := t.TempDir()
+	pc := `prefix=/opt/my\ flux/libflux
+
+Name: Flux
+Version: 0.194.3
+Description: Library for the InfluxData Flux engine
+Libs: -L${prefix}/lib -lflux -ldl
+Cflags: -I${prefix}/include
+`
+	if err := ioutil.WriteFile(filepath.Join(pkgConfigPath, "flux.pc"), []byte(pc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	libs, flags, err := parseFlags("pkg-config", []string{"--cflags", "--libs", "--output-separator=;", "flux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := runPkgConfig(pkgConfigExec, pkgConfigPath, libs, flags); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := "-I/opt/my flux/libflux/include;-L/opt/my flux/libflux/lib;-lflux;-ldl\n"
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected output: got %q, want %q", got, want)
+	}
+
+	if _, _, err := parseFlags("pkg-config", []string{"--libs", "--print0", "--output-separator=;", "flux"}); err == nil {
+		t.Error("expected error for --print0 with --output-separator")
+	}
+}
+
+func TestRealMain_BrokenPipe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub pkg-config requires a unix shell")
+	}
+
+	// The stub pkg-config writes more output than the consumer reads.
+	dir := t.TempDir()
+	script := "#!/bin/sh\nwhile :; do echo -lflux; done\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "pkg-config"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	t.Setenv("PKG_CONFIG", "")
+	t.Setenv("PKG_CONFIG_LOG", "")
+
+	// The consumer has already closed its end of the pipe.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Close()
+	defer func() { _ = w.Close() }()
+
+	stdout = w
+	defer func() { stdout = os.Stdout }()
+
+	args := os.Args
+	os.Args = []string{filepath.Join(t.TempDir(), "pkg-config"), "--libs", "notflux"}
+	defer func() { os.Args = args }()
+
+	stderr.Reset()
+	defer stderr.Reset()
+
+	if got := realMain(); got != 0 {
+		t.Errorf("unexpected exit code: got %d, want 0\n%s", got, stderr.String())
+	}
+	if strings.Contains(stderr.String(), "Running pkg-config failed") {
+		t.Errorf("unexpected error in output:\n%s", stderr.String())
+	}
+}
+
+type fakeLibrary struct {
+	installed bool
+}
+
+func (l *fakeLibrary) Install(ctx context.Context, logger *zap.Logger) (string, error) {
+	l.installed = true
+	return "abc123", nil
+}
+
+func (l *fakeLibrary) WritePackageConfig(w io.Writer, buildid string) error {
+	_, err := fmt.Fprintf(w, "Name: Flux\nLibs: -lflux-%s\n", buildid)
+	return err
+}
+
+func TestWriteTargetPackageConfig(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("GOCACHE", cache)
+
+	outdir := t.TempDir()
+	for _, target := range []flux.Target{
+		{OS: "linux", Arch: "amd64", Static: true},
+		{OS: "linux", Arch: "arm64"},
+	} {
+		l := &flux.Library{Version: "v0.194.3", Dir: t.TempDir(), Target: target}
+		path, err := writeTargetPackageConfig(outdir, "flux", l, "abc", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if want := filepath.Join(outdir, target.String(), "flux.pc"); path != want {
+			t.Errorf("unexpected path: got %q, want %q", path, want)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		execPrefix := "exec_prefix=" + filepath.ToSlash(filepath.Join(cache, "pkgconfig", target.String())) + "\n"
+		if !strings.Contains(string(data), execPrefix) {
+			t.Errorf("expected package config for %s to contain %q:\n%s", target, execPrefix, data)
+		}
+		prefix := "prefix=" + filepath.ToSlash(filepath.Join(l.Dir, "libflux")) + "\n"
+		if !strings.HasPrefix(string(data), prefix) {
+			t.Errorf("expected package config for %s to start with %q:\n%s", target, prefix, data)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(outdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for _, entry := range entries {
+		dirs = append(dirs, entry.Name())
+	}
+	if want := []string{"linux_amd64_static", "linux_arm64"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("unexpected target directories: got %v, want %v", dirs, want)
+	}
+
+	if _, err := writeTargetPackageConfig(outdir, "flux", &fakeLibrary{}, "abc", ""); err == nil {
+		t.Error("expected error for a library without a target")
+	}
+}
+
+func TestWriteTargetPackageConfig_InstallPrefix(t *testing.T) {
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Skip("pkg-config is not installed")
+	}
+	cache := t.TempDir()
+	t.Setenv("GOCACHE", cache)
+
+	l := &flux.Library{Version: "v0.194.3", Dir: t.TempDir(), Target: flux.Target{OS: "linux", Arch: "amd64"}}
+	outdir := t.TempDir()
+	path, err := writeTargetPackageConfig(outdir, "flux", l, "abc", "/opt/flux")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "prefix=/opt/flux\n") {
+		t.Errorf("expected the output package config to use the install prefix:\n%s", data)
+	}
+
+	// The package config the wrapper queries resolves to the staged library.
+	pkgConfigPath := t.TempDir()
+	f, err := os.Create(filepath.Join(pkgConfigPath, "flux.pc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WritePackageConfig(f, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(pkgConfigExec, "--cflags", "flux")
+	cmd.Env = append(os.Environ(), "PKG_CONFIG_PATH="+pkgConfigPath)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := strings.TrimSpace(string(out)), "-I"+filepath.Join(l.Dir, "libflux", "include"); got != want {
+		t.Errorf("unexpected cflags: got %q, want %q", got, want)
+	}
+}
+
+func TestWriteTargetPackageConfig_Relocatable(t *testing.T) {
+	// Lay out a bundle with the sources, cache, and package configs together.
+	bundle := t.TempDir()
+	t.Setenv("GOCACHE", filepath.Join(bundle, "cache"))
+	t.Setenv("PKG_CONFIG_RELOCATABLE", "1")
+
+	l := &flux.Library{Version: "v0.194.3", Dir: filepath.Join(bundle, "flux"), Target: flux.Target{OS: "linux", Arch: "amd64"}}
+	path, err := writeTargetPackageConfig(filepath.Join(bundle, "pkgconfig"), "flux", l, "abc", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "prefix=${pcfiledir}/../../flux/libflux\n"
+	if runtime.GOOS == "windows" {
+		want = `prefix=${pcfiledir}\\..\\..\\flux\\libflux` + "\n"
+	}
+	if !strings.HasPrefix(string(data), want) {
+		t.Errorf("expected package config to start with %q, got:\n%s", want, data)
+	}
+	if strings.Contains(string(data), bundle) {
+		t.Errorf("expected no absolute paths in package config, got:\n%s", data)
+	}
+
+	// The package config the wrapper queries itself is not relocatable.
+	var buf bytes.Buffer
+	if err := l.WritePackageConfig(&buf, "abc"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Contains(buf.String(), "${pcfiledir}") {
+		t.Errorf("unexpected relative paths in package config:\n%s", buf.String())
+	}
+}
+
+func TestRealMain_RelocatableShowPc(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub pkg-config requires a unix shell")
+	}
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "pkg-config"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	t.Setenv("PKG_CONFIG", "")
+	t.Setenv("PKG_CONFIG_LOG", "")
+	t.Setenv("PKG_CONFIG_RELOCATABLE", "1")
+
+	args := os.Args
+	os.Args = []string{filepath.Join(t.TempDir(), "pkg-config"), "--show-pc", "flux"}
+	defer func() { os.Args = args }()
+
+	stderr.Reset()
+	defer stderr.Reset()
+
+	if got := realMain(); got != 1 {
+		t.Errorf("unexpected exit code: got %d, want 1", got)
+	}
+	if !strings.Contains(stderr.String(), "PKG_CONFIG_RELOCATABLE cannot be used with --show-pc") {
+		t.Errorf("expected the combination to be rejected, got:\n%s", stderr.String())
+	}
+}
+
+func TestWriteSelfCheck(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake tools require a unix shell")
+	}
+	logger = zap.NewNop()
+
+	bindir := t.TempDir()
+	for name, version := range map[string]string{
+		"pkg-config": "1.8.1",
+		"cargo":      "cargo 1.72.0",
+		"rustc":      "rustc 1.72.0",
+		"go":         "go version go1.21.0 linux/amd64",
+	} {
+		script := "#!/bin/sh\necho '" + version + "'\n"
+		if err := ioutil.WriteFile(filepath.Join(bindir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bindir)
+	t.Setenv("CARGO", "")
+	t.Setenv("RUSTC", "")
+
+	var buf bytes.Buffer
+	flags := Flags{Target: &flux.Target{OS: "linux", Arch: "arm64"}}
+	if err := writeSelfCheck(context.Background(), &buf, filepath.Join(bindir, "pkg-config"), nil, flags); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var report map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("invalid report: %s\n%s", err, buf.String())
+	}
+	for _, key := range []string{"version", "pkg_config", "cargo", "rustc", "go", "goos", "goarch", "flux"} {
+		if _, ok := report[key]; !ok {
+			t.Errorf("expected report to contain %q:\n%s", key, buf.String())
+		}
+	}
+
+	var cargo flux.Tool
+	if err := json.Unmarshal(report["cargo"], &cargo); err != nil {
+		t.Fatal(err)
+	}
+	if want := "cargo 1.72.0"; cargo.Version != want {
+		t.Errorf("unexpected cargo version: got %q, want %q", cargo.Version, want)
+	}
+	if got := string(report["goarch"]); got != `"arm64"` {
+		t.Errorf("unexpected goarch: %s", got)
+	}
+
+	// A missing pkg-config is reported rather than failing.
+	buf.Reset()
+	if err := writeSelfCheck(context.Background(), &buf, "", errors.New("pkg-config not found"), flags); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(buf.String(), "pkg-config not found") {
+		t.Errorf("expected report to contain the lookup error:\n%s", buf.String())
+	}
+}
+
+func TestGetLibraryFor_Provider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("stub provider requires a unix shell")
+	}
+	logger = zap.NewNop()
+
+	// The stub provider records each request and answers the operation.
+	bindir := t.TempDir()
+	record := filepath.Join(t.TempDir(), "requests")
+	script := `#!/bin/sh
+cat >> ` + record + `
+echo >> ` + record + `
+case "$1" in
+install) echo '{"buildid": "abc"}' ;;
+package-config) printf '%s\n' '{"package_config": "Name: mylib\nVersion: 1.0.0\nDescription: My library\nLibs: -lmylib\n"}' ;;
+*) echo "unknown operation $1" >&2; exit 1 ;;
+esac
+`
+	if err := ioutil.WriteFile(filepath.Join(bindir, "pkg-config-lib-mylib"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bindir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// Providers are not run unless they have been enabled.
+	t.Setenv("PKG_CONFIG_LIBRARY_PROVIDERS", "")
+	if _, ok, err := getLibraryFor(context.Background(), "mylib", Flags{}); ok || err != nil {
+		t.Errorf("expected no library with providers disabled, got %v, %v", ok, err)
+	}
+	if _, err := os.Stat(record); !os.IsNotExist(err) {
+		t.Errorf("expected the provider not to run with providers disabled: %v", err)
+	}
+
+	t.Setenv("PKG_CONFIG_LIBRARY_PROVIDERS", "1")
+	if _, ok, err := getLibraryFor(context.Background(), "otherlib", Flags{}); ok || err != nil {
+		t.Errorf("expected no library without a provider, got %v, %v", ok, err)
+	}
+
+	flags := Flags{Static: true, Target: &flux.Target{OS: "linux", Arch: "arm64"}}
+	l, ok, err := getLibraryFor(context.Background(), "mylib", flags)
+	if err != nil || !ok {
+		t.Fatalf("expected the provider to be found, got %v, %v", ok, err)
+	}
+
+	buildid, err := l.Install(context.Background(), zap.NewNop())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if buildid != "abc" {
+		t.Errorf("unexpected build id: got %q, want %q", buildid, "abc")
+	}
+
+	var buf bytes.Buffer
+	if err := l.WritePackageConfig(&buf, buildid); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := buf.String(), "Name: mylib\nVersion: 1.0.0\nDescription: My library\nLibs: -lmylib\n"; got != want {
+		t.Errorf("unexpected package config: got %q, want %q", got, want)
+	}
+
+	data, err := ioutil.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"mylib","target":"linux/arm64","static":true}` + "\n" +
+		`{"name":"mylib","target":"linux/arm64","static":true,"buildid":"abc"}` + "\n"
+	if got := string(data); got != want {
+		t.Errorf("unexpected provider requests: got %q, want %q", got, want)
+	}
+}
+
+func TestShowPackageConfig(t *testing.T) {
+	logger = zap.NewNop()
+
+	for _, tt := range []struct {
+		name    string
+		noBuild bool
+		want    string
+	}{
+		{name: "Build", want: "Name: Flux\nLibs: -lflux-abc123\n"},
+		{name: "NoBuild", noBuild: true, want: "Name: Flux\nLibs: -lflux-\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				buf bytes.Buffer
+				l   fakeLibrary
+			)
+			if err := showPackageConfig(context.Background(), &buf, &l, tt.noBuild, ""); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got, want := buf.String(), tt.want; got != want {
+				t.Errorf("unexpected package config:\n got: %q\nwant: %q", got, want)
+			}
+			if got, want := l.installed, !tt.noBuild; got != want {
+				t.Errorf("unexpected install: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseFlags_NoBuild(t *testing.T) {
+	if _, _, err := parseFlags("pkg-config", []string{"--no-build", "flux"}); err == nil {
+		t.Error("expected error when --no-build is used without --show-pc")
+	}
+	_, flags, err := parseFlags("pkg-config", []string{"--show-pc", "--no-build", "flux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !flags.ShowPc || !flags.NoBuild {
+		t.Errorf("unexpected flags: %+v", flags)
+	}
+}
+
+func TestRunPkgConfig_Libdir(t *testing.T) {
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Skip("pkg-config is not installed")
+	}
+	t.Setenv("PKG_CONFIG_PATH", "")
+
+	pkgConfigPath := t.TempDir()
+	pc := "Name: Flux\nVersion: 0.194.3\nDescription: Library for the InfluxData Flux engine\nLibs: -lflux\n"
+	if err := ioutil.WriteFile(filepath.Join(pkgConfigPath, "flux.pc"), []byte(pc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unrelated := t.TempDir()
+	t.Setenv("PKG_CONFIG_LIBDIR", unrelated)
+
+	env := pkgConfigEnv(pkgConfigPath, nil)
+	if got, want := env[len(env)-1], "PKG_CONFIG_LIBDIR="+pkgConfigPath+string(os.PathListSeparator)+unrelated; got != want {
+		t.Errorf("unexpected PKG_CONFIG_LIBDIR: got %q, want %q", got, want)
+	}
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	if err := runPkgConfig(pkgConfigExec, pkgConfigPath, []string{"flux"}, Flags{Libs: true}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := strings.TrimSpace(buf.String()), "-lflux"; got != want {
+		t.Errorf("unexpected output: got %q, want %q", got, want)
+	}
+}
+
+func TestRunPkgConfig_Uninstalled(t *testing.T) {
+	pkgConfigExec, err := exec.LookPath("pkg-config")
+	if err != nil {
+		t.Skip("pkg-config is not installed")
+	}
+
+	pkgConfigPath := t.TempDir()
+	pc := "Name: Flux\nVersion: 0.194.3\nDescription: Library for the InfluxData Flux engine\nLibs: -lflux\n"
+	if err := ioutil.WriteFile(filepath.Join(pkgConfigPath, "flux.pc"), []byte(pc), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	stdout = &buf
+	defer func() { stdout = os.Stdout }()
+
+	// No uninstalled package config is generated so
+	// pkg-config reports that it would not be used.
+	err = runPkgConfig(pkgConfigExec, pkgConfigPath, []string{"flux"}, Flags{Uninstalled: true})
+	if exitErr, ok := err.(*exec.ExitError); !ok {
+		t.Errorf("expected exit error, got %v", err)
+	} else if code := exitErr.ExitCode(); code != 1 {
+		t.Errorf("unexpected exit code: got %d, want 1", code)
+	}
+
+	// Normal queries are unaffected.
+	buf.Reset()
+	_, flags, err := parseFlags("pkg-config", []string{"--libs", "flux"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := runPkgConfig(pkgConfigExec, pkgConfigPath, []string{"flux"}, flags); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got, want := strings.TrimSpace(buf.String()), "-lflux"; got != want {
+		t.Errorf("unexpected output: got %q, want %q", got, want)
+	}
+}
+
+func TestVerifyBuildLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flux.pkglock")
+	recorded := &flux.BuildLock{
+		Version: "v0.194.3",
+		Target:  "x86_64-unknown-linux-gnu",
+		Rustc:   "rustc 1.68.0",
+		Cargo:   "cargo 1.68.0",
+	}
+	if err := writeBuildLocks(path, map[string]*flux.BuildLock{"flux": recorded}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	locks, err := readBuildLocks(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	lock := *recorded
+	if err := verifyBuildLock(locks, "flux", &lock); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := verifyBuildLock(locks, "flux-a", &lock); err == nil {
+		t.Error("expected error for library without recorded inputs")
+	}
+
+	lock.Rustc = "rustc 1.69.0"
+	if err := verifyBuildLock(locks, "flux", &lock); err == nil {
+		t.Error("expected error for changed rustc version")
+	} else if !strings.Contains(err.Error(), `rustc: recorded "rustc 1.68.0", got "rustc 1.69.0"`) {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "ModuleNotFound", err: fmt.Errorf("%w matching flux", flux.ErrModuleNotFound), want: exitModuleNotFound},
+		{name: "BuildFailed", err: &flux.BuildError{Err: errors.New("exit status 101")}, want: exitBuildFailed},
+		{name: "VersionUndetermined", err: fmt.Errorf("writing: %w", flux.ErrVersionUndetermined), want: exitVersionUndetermined},
+		{name: "Other", err: errors.New("other"), want: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("unexpected exit code: got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildLibraries_KeepGoing(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger = zap.New(core)
+	defer func() { logger = zap.NewNop() }()
+
+	for _, tt := range []struct {
+		name      string
+		keepGoing bool
+		attempted []string
+		want      int
+	}{
+		{name: "StopOnFailure", attempted: []string{"flux-a"}, want: exitBuildFailed},
+		{name: "KeepGoing", keepGoing: true, attempted: []string{"flux-a", "flux-b"}, want: exitBuildFailed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = logs.TakeAll()
+
+			// The first library fails to build and the second succeeds.
+			var attempted []string
+			got := buildLibraries([]string{"flux-a", "flux-b"}, tt.keepGoing, func(lib string) int {
+				attempted = append(attempted, lib)
+				if lib == "flux-a" {
+					return exitBuildFailed
+				}
+				return 0
+			})
+			if got != tt.want {
+				t.Errorf("unexpected exit code: got %d, want %d", got, tt.want)
+			}
+			if !reflect.DeepEqual(attempted, tt.attempted) {
+				t.Errorf("unexpected libraries attempted: got %v, want %v", attempted, tt.attempted)
+			}
+
+			status := make(map[string]interface{})
+			for _, entry := range logs.FilterMessage("Library build status").All() {
+				status[entry.ContextMap()["name"].(string)] = entry.ContextMap()["status"]
+			}
+			var want map[string]interface{}
+			if tt.keepGoing {
+				want = map[string]interface{}{"flux-a": "failed", "flux-b": "succeeded"}
+			}
+			if len(status) == 0 && len(want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(status, want) {
+				t.Errorf("unexpected build status: got %v, want %v", status, want)
+			}
+		})
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := tailBuffer{limit: 32}
+	for i := 0; i < 10; i++ {
+		_, _ = fmt.Fprintf(&b, "line %d\n", i)
+	}
+
+	// Only the complete lines at the tail are retained.
+	if got, want := b.String(), "line 6\nline 7\nline 8\nline 9\n"; got != want {
+		t.Errorf("unexpected contents: got %q, want %q", got, want)
+	}
+	if n := b.size; n > 32 {
+		t.Errorf("buffer exceeded its limit: got %d bytes", n)
+	}
+
+	b.Reset()
+	_, _ = io.WriteString(&b, "short\n")
+	if got, want := b.String(), "short\n"; got != want {
+		t.Errorf("unexpected contents after reset: got %q, want %q", got, want)
+	}
+}
+
+func TestWriteFailureOutput_BuildOutput(t *testing.T) {
+	t.Setenv("PKG_CONFIG_LOG", "")
+	t.Setenv("PKG_CONFIG_LOG_SYSLOG", "")
+	t.Setenv("PKG_CONFIG_QUIET", "")
+
+	stderr.Reset()
+	defer stderr.Reset()
+
+	var l *zap.Logger
+	configureLogger(&l)
+	l.Info("Executing cargo build")
+
+	// The diagnostics of a failed build exceed the info tail
+	// and must all be written with the failure.
+	var output bytes.Buffer
+	for i := 0; i < 3*failureInfoLines; i++ {
+		fmt.Fprintf(&output, "error[E%04d]: mismatched types\n", i)
+	}
+	_ = logutil.LogFailureOutput(&output, l)
+	for i := 0; i < 2*failureInfoLines; i++ {
+		l.Info("Cleaning up", zap.Int("step", i))
+	}
+	l.Error("Error installing library", zap.String("name", "flux"))
+
+	var buf bytes.Buffer
+	writeFailureOutput(&buf)
+	for i := 0; i < 3*failureInfoLines; i++ {
+		if line := fmt.Sprintf("error[E%04d]: mismatched types\n", i); !strings.Contains(buf.String(), line) {
+			t.Errorf("expected failure output to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestLogBufferSize(t *testing.T) {
+	for _, tt := range []struct {
+		env  string
+		want int
+		err  bool
+	}{
+		{env: "", want: defaultLogBufferSize},
+		{env: "16", want: 16 * 1024},
+		{env: "0", want: defaultLogBufferSize, err: true},
+		{env: "lots", want: defaultLogBufferSize, err: true},
+	} {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("PKG_CONFIG_LOG_BUFFER_KB", tt.env)
+			got, err := logBufferSize()
+			if got != tt.want {
+				t.Errorf("unexpected size: got %d, want %d", got, tt.want)
+			}
+			if tt.err != (err != nil) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteFailureOutput_FocusOnErrors(t *testing.T) {
+	t.Setenv("PKG_CONFIG_LOG", "")
+	t.Setenv("PKG_CONFIG_LOG_SYSLOG", "")
+	t.Setenv("PKG_CONFIG_QUIET", "")
+
+	stderr.Reset()
+	defer stderr.Reset()
+
+	var l *zap.Logger
+	configureLogger(&l)
+	l.Info("Started pkg-config")
+	l.Warn("Unable to determine cargo target. Using the default.")
+	for i := 0; i < 30; i++ {
+		l.Info("Compiling", zap.Int("crate", i))
+	}
+	l.Error("Error installing library", zap.String("name", "flux"))
+
+	var buf bytes.Buffer
+	writeFailureOutput(&buf)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	// The warning and error are kept along with
+	// only the most recent info lines.
+	want := []string{"(21 earlier log lines omitted)", "Unable to determine cargo target. Using the default."}
+	for i := 20; i < 30; i++ {
+		want = append(want, fmt.Sprintf(`Compiling	{"crate": %d}`, i))
+	}
+	want = append(want, `Error installing library	{"name": "flux"}`)
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("unexpected failure output:\n got: %q\nwant: %q", lines, want)
+	}
+
+	// The full output is still retained.
+	if !strings.Contains(stderr.String(), "Started pkg-config") {
+		t.Errorf("expected full output to be retained, got:\n%s", stderr.String())
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// isBrokenPipe reports whether the error is from writing to
+// an output that was closed, either because pkg-config was killed
+// by SIGPIPE or because a write returned EPIPE.
+func isBrokenPipe(err error) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		return ok && status.Signaled() && status.Signal() == syscall.SIGPIPE
+	}
+	return errors.Is(err, syscall.EPIPE)
+}
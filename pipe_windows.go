@@ -0,0 +1,13 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isBrokenPipe reports whether the error is from writing to an output
+// that was closed. There is no SIGPIPE on windows so only the error
+// from the write is checked.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ERROR_BROKEN_PIPE)
+}
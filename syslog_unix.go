@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslogWriter connects to syslog with messages tagged with the tag.
+func dialSyslogWriter(network, raddr, tag string) (io.Writer, error) {
+	return syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_USER, tag)
+}
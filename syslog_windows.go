@@ -0,0 +1,11 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// dialSyslogWriter reports that syslog is not supported on windows.
+func dialSyslogWriter(network, raddr, tag string) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}